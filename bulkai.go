@@ -4,26 +4,30 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/igolaizola/bulkai/pkg/ai"
-	"github.com/igolaizola/bulkai/pkg/ai/bluewillow"
-	"github.com/igolaizola/bulkai/pkg/ai/midjourney"
+	_ "github.com/igolaizola/bulkai/pkg/ai/bluewillow"
+	_ "github.com/igolaizola/bulkai/pkg/ai/custom"
+	_ "github.com/igolaizola/bulkai/pkg/ai/midjourney"
+	_ "github.com/igolaizola/bulkai/pkg/ai/niji"
 	"github.com/igolaizola/bulkai/pkg/discord"
 	"github.com/igolaizola/bulkai/pkg/http"
 	"github.com/igolaizola/bulkai/pkg/img"
-	"gopkg.in/yaml.v2"
+	sessionstore "github.com/igolaizola/bulkai/pkg/session"
 )
 
 type Album struct {
@@ -41,29 +45,47 @@ type Image struct {
 	URL    string `json:"url"`
 	Prompt string `json:"prompt"`
 	File   string `json:"file"`
+	// Thumbnail is a resized version of the image served by the discord
+	// media proxy.
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Size and Hash (hex encoded SHA-256) of the local file.
+	Size int64  `json:"size,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	// CreatedAt is when the image was generated, used to sort the gallery.
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Config struct {
-	Debug          bool          `yaml:"debug"`
-	Bot            string        `yaml:"bot"`
-	Proxy          string        `yaml:"proxy"`
-	Output         string        `yaml:"output"`
-	Album          string        `yaml:"album"`
-	Prefix         string        `yaml:"prefix"`
-	Suffix         string        `yaml:"suffix"`
-	Prompts        []string      `yaml:"prompts"`
-	Variation      bool          `yaml:"variation"`
-	Upscale        bool          `yaml:"upscale"`
-	Download       bool          `yaml:"download"`
-	Thumbnail      bool          `yaml:"thumbnail"`
-	Html           bool          `yaml:"html"`
-	Channel        string        `yaml:"channel"`
-	Concurrency    int           `yaml:"concurrency"`
-	Wait           time.Duration `yaml:"wait"`
-	ReplicateToken string        `yaml:"replicate-token"`
-	MidjourneyCDN  bool          `yaml:"midjourney-cdn"`
-	SessionFile    string        `yaml:"session"`
-	Session        Session       `yaml:"-"`
+	Debug            bool          `yaml:"debug"`
+	Bot              string        `yaml:"bot"`
+	Proxy            string        `yaml:"proxy"`
+	ProxyFile        string        `yaml:"proxy-file"`
+	CAFiles          []string      `yaml:"ca-file"`
+	Pins             []string      `yaml:"pin"`
+	Insecure         bool          `yaml:"insecure"`
+	Output           string        `yaml:"output"`
+	Album            string        `yaml:"album"`
+	Prefix           string        `yaml:"prefix"`
+	Suffix           string        `yaml:"suffix"`
+	Prompts          []string      `yaml:"prompts"`
+	Variation        bool          `yaml:"variation"`
+	Upscale          bool          `yaml:"upscale"`
+	Download         bool          `yaml:"download"`
+	Thumbnail        bool          `yaml:"thumbnail"`
+	ThumbnailWidth   int           `yaml:"thumbnail-width"`
+	Html             bool          `yaml:"html"`
+	Channel          string        `yaml:"channel"`
+	Concurrency      int           `yaml:"concurrency"`
+	Wait             time.Duration `yaml:"wait"`
+	DownloadWorkers  int           `yaml:"download-workers"`
+	DownloadsPerHost int           `yaml:"downloads-per-host"`
+	SessionFile      string        `yaml:"session"`
+	Session          Session       `yaml:"-"`
+
+	// BotConfigs contains the backend specific configurations indexed by
+	// backend name. If a backend has no entry, its default configuration is
+	// used.
+	BotConfigs map[string]interface{} `yaml:"-"`
 }
 
 type Session struct {
@@ -74,11 +96,51 @@ type Session struct {
 	SuperProperties string `yaml:"super-properties"`
 	Locale          string `yaml:"locale"`
 	Cookie          string `yaml:"cookie"`
+	// HTTP2 is the HTTP/2 fingerprint in Akamai format.
+	HTTP2 string `yaml:"http2"`
+}
+
+func (s *Session) check() error {
+	if s.Token == "" {
+		return errors.New("missing token")
+	}
+	if s.JA3 == "" {
+		return errors.New("missing ja3")
+	}
+	if s.UserAgent == "" {
+		return errors.New("missing user agent")
+	}
+	if s.Cookie == "" {
+		return errors.New("missing cookie")
+	}
+	if s.Language == "" {
+		return errors.New("missing language")
+	}
+	return nil
+}
+
+// validateProfile checks that the user agent, the ja3 fingerprint and the
+// super properties of the session describe the same browser.
+func (s *Session) validateProfile() error {
+	profile := http.NewBrowserProfile(s.UserAgent, s.JA3, s.Language)
+	var props *http.BrowserProperties
+	if sp, err := discord.ParseSuperProperties(s.SuperProperties); err == nil {
+		props = &http.BrowserProperties{
+			OS:               sp.OS,
+			Browser:          sp.Browser,
+			BrowserVersion:   sp.BrowserVersion,
+			BrowserUserAgent: sp.BrowserUserAgent,
+		}
+	}
+	return profile.Validate(props)
 }
 
 type Status struct {
 	Percentage float32
 	Estimated  time.Duration
+	// Pending is the number of images waiting to be downloaded and
+	// post-processed.
+	Pending int
 }
 
 type Option func(*option)
@@ -95,8 +157,8 @@ func WithOnUpdate(onUpdate func(Status)) Option {
 
 // Generate launches multiple ai generations.
 func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
-	if cfg.Session.Token == "" {
-		return errors.New("missing token")
+	if err := cfg.Session.check(); err != nil {
+		return err
 	}
 	if cfg.Bot == "" {
 		return errors.New("missing bot name")
@@ -104,18 +166,6 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 	if cfg.Output == "" {
 		return errors.New("missing output directory")
 	}
-	if cfg.Session.JA3 == "" {
-		return errors.New("missing ja3")
-	}
-	if cfg.Session.UserAgent == "" {
-		return errors.New("missing user agent")
-	}
-	if cfg.Session.Cookie == "" {
-		return errors.New("missing cookie")
-	}
-	if cfg.Session.Language == "" {
-		return errors.New("missing language")
-	}
 
 	// Load options
 	o := &option{}
@@ -124,27 +174,19 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 	}
 
 	// Check ai bot
-	var newCli func(*discord.Client, string, bool) (ai.Client, error)
-	var cli ai.Client
-	switch strings.ToLower(cfg.Bot) {
-	case "bluewillow":
-		newCli = func(c *discord.Client, channelID string, debug bool) (ai.Client, error) {
-			return bluewillow.New(c, &bluewillow.Config{
-				ChannelID: channelID,
-				Debug:     debug,
-			})
-		}
-	case "midjourney":
-		newCli = func(c *discord.Client, channelID string, debug bool) (ai.Client, error) {
-			return midjourney.New(c, &midjourney.Config{
-				ChannelID:      channelID,
-				Debug:          debug,
-				ReplicateToken: cfg.ReplicateToken,
-				MidjourneyCDN:  cfg.MidjourneyCDN,
-			})
-		}
-	default:
-		return fmt.Errorf("unsupported bot: %s", cfg.Bot)
+	backend, ok := ai.Lookup(cfg.Bot)
+	if !ok {
+		return fmt.Errorf("unsupported bot: %s (available: %s)", cfg.Bot, strings.Join(ai.Backends(), ", "))
+	}
+	if cfg.Upscale && !backend.Capabilities.Upscale {
+		return fmt.Errorf("bot %s doesn't support upscale", backend.Name)
+	}
+	if cfg.Variation && !backend.Capabilities.Variation {
+		return fmt.Errorf("bot %s doesn't support variation", backend.Name)
+	}
+	botCfg, ok := cfg.BotConfigs[backend.Name]
+	if !ok {
+		botCfg = backend.NewConfig()
 	}
 
 	// New album
@@ -153,6 +195,7 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 		albumID = time.Now().UTC().Format("20060102_150405")
 	}
 	var album *Album
+	var since time.Time
 	albumDir := fmt.Sprintf("%s/%s", cfg.Output, albumID)
 	imgDir := fmt.Sprintf("%s/images", albumDir)
 
@@ -182,6 +225,7 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 		}
 		album = albumCandidate
 		prompts = album.Prompts
+		since = album.UpdatedAt
 		log.Println("album resumed:", albumDir)
 	}
 
@@ -224,69 +268,35 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 	}
 
 	// Check total images
-	var lck sync.Mutex
 	total := len(prompts) * 4
 	if cfg.Variation {
 		total = total + total*4
 	}
 
-	// Create http client
-	httpClient, err := http.NewClient(cfg.Session.JA3, cfg.Session.UserAgent, cfg.Session.Language, cfg.Proxy)
+	// Create and start discord client
+	tlsCfg := NewTLSConfig(cfg.CAFiles, cfg.Pins, cfg.Insecure)
+	pool, err := NewProxyPool(ctx, cfg.Proxy, cfg.ProxyFile, tlsCfg)
 	if err != nil {
-		return fmt.Errorf("couldn't create http client: %w", err)
-	}
-
-	// Set proxy
-	if cfg.Proxy != "" {
-		p := strings.TrimPrefix(cfg.Proxy, "http://")
-		p = strings.TrimPrefix(p, "https://")
-		os.Setenv("HTTPS_PROXY", p)
-		os.Setenv("HTTP_PROXY", p)
+		return err
 	}
-
-	if err := http.SetCookies(httpClient, "https://discord.com", cfg.Session.Cookie); err != nil {
-		return fmt.Errorf("couldn't set cookies: %w", err)
-	}
-	defer func() {
-		cookie, err := http.GetCookies(httpClient, "https://discord.com")
-		if err != nil {
-			log.Printf("couldn't get cookies: %v\n", err)
-		}
-		cfg.Session.Cookie = strings.ReplaceAll(cookie, "\n", "")
-		// TODO: save session to common method
-		data, err := yaml.Marshal(cfg.Session)
-		if err != nil {
-			log.Println(fmt.Errorf("couldn't marshal session: %w", err))
-		}
-		if err := os.WriteFile(cfg.SessionFile, data, 0644); err != nil {
-			log.Println(fmt.Errorf("couldn't write session: %w", err))
-		}
-	}()
-
-	// Create discord client
-	client, err := discord.New(ctx, &discord.Config{
-		Token:           cfg.Session.Token,
-		SuperProperties: cfg.Session.SuperProperties,
-		Locale:          cfg.Session.Locale,
-		UserAgent:       cfg.Session.UserAgent,
-		HTTPClient:      httpClient,
-		Debug:           cfg.Debug,
-	})
+	client, closeClient, err := startClient(ctx, &cfg.Session, cfg.SessionFile, pool, tlsCfg, cfg.DownloadsPerHost, cfg.Debug)
 	if err != nil {
-		return fmt.Errorf("couldn't create discord client: %w", err)
-	}
-
-	// Start discord client
-	if err := client.Start(ctx); err != nil {
-		return fmt.Errorf("couldn't start discord client: %w", err)
+		pauseAlbum(albumDir, album, err, cfg.Thumbnail, cfg.Html)
+		return err
 	}
+	defer closeClient()
 
 	// Start ai client
-	cli, err = newCli(client, cfg.Channel, cfg.Debug)
+	cli, err := backend.New(client, &ai.Options{
+		ChannelID: cfg.Channel,
+		Debug:     cfg.Debug,
+		Since:     since,
+	}, botCfg)
 	if err != nil {
 		return fmt.Errorf("couldn't create %s client: %w", cfg.Bot, err)
 	}
 	if err := cli.Start(ctx); err != nil {
+		pauseAlbum(albumDir, album, err, cfg.Thumbnail, cfg.Html)
 		return fmt.Errorf("couldn't start ai client: %w", err)
 	}
 
@@ -319,8 +329,30 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 		log.Println("album created:", albumDir)
 	}
 
-	// Launch ai bulk operation
-	imageChan := ai.Bulk(ctx, cli, prompts, album.Finished, cfg.Variation, cfg.Upscale, cfg.Concurrency, cfg.Wait)
+	// Launch ai bulk operation, images are downloaded and post-processed in
+	// a separate pipeline so generation never waits for them
+	bulkCtx, cancelBulk := context.WithCancel(ctx)
+	defer cancelBulk()
+	imageChan := ai.Bulk(bulkCtx, cli, prompts, album.Finished, cfg.Variation, cfg.Upscale, cfg.Concurrency, cfg.Wait)
+	pipe := newPipeline(ctx, cfg.DownloadWorkers, func(ctx context.Context, image *ai.Image) []*Image {
+		return toImages(ctx, client, image, imgDir, cfg.Download, cfg.Upscale, cfg.Thumbnail, cfg.ThumbnailWidth)
+	})
+	// Prompts are finished when their last image has been processed
+	pending := make(map[int]int)
+	last := make(map[int]bool)
+	// The album is paused if discord rejects the session, so it can be
+	// resumed with a new one
+	invalid := client.Invalid()
+	finished := func() string {
+		switch {
+		case client.Err() != nil:
+			return "paused"
+		case len(album.Images) < total:
+			return "partially finished"
+		default:
+			return "finished"
+		}
+	}
 	var exit bool
 	for !exit {
 		var status string
@@ -328,30 +360,46 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 		case <-ctx.Done():
 			status = "cancelled"
 			exit = true
+		case <-invalid:
+			// Stop generating, but keep processing the pending images
+			log.Println("❌ discord rejected the session, stopping generation")
+			invalid = nil
+			cancelBulk()
+			continue
 		case image, ok := <-imageChan:
 			if !ok {
-				status = "finished"
-				if album.Percentage < 100 {
-					status = "partially finished"
+				// Wait for the pipeline to process the remaining images
+				imageChan = nil
+				if pipe.Pending() > 0 {
+					continue
 				}
+				status = finished()
 				exit = true
 			} else {
 				status = "running"
-				lck.Lock()
-				album.UpdatedAt = time.Now().UTC()
-				images := toImages(ctx, client, image, imgDir, cfg.Download, cfg.Upscale, cfg.Thumbnail)
-				if err != nil {
-					log.Println(err)
-				} else {
-					album.Images = append(album.Images, images...)
-					if image.IsLast {
-						album.Finished = append(album.Finished, image.PromptIndex)
-					}
+				pending[image.PromptIndex]++
+				if image.IsLast {
+					last[image.PromptIndex] = true
 				}
-				lck.Unlock()
+				pipe.Add(ctx, image)
+				continue
+			}
+		case result := <-pipe.Results():
+			pipe.Done()
+			status = "running"
+			album.Images = append(album.Images, result.images...)
+			index := result.image.PromptIndex
+			pending[index]--
+			if pending[index] == 0 && last[index] {
+				album.Finished = append(album.Finished, index)
+				delete(pending, index)
+				delete(last, index)
+			}
+			if imageChan == nil && pipe.Pending() == 0 {
+				status = finished()
+				exit = true
 			}
 		}
-		lck.Lock()
 		album.UpdatedAt = time.Now().UTC()
 
 		if total == 0 {
@@ -368,6 +416,7 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 						o.onUpdate(Status{
 							Percentage: percentage,
 							Estimated:  estimated,
+							Pending:    pipe.Pending(),
 						})
 					}
 				}
@@ -376,30 +425,195 @@ func Generate(ctx context.Context, cfg *Config, opts ...Option) error {
 		}
 		album.Status = status
 
-		err := SaveAlbum(albumDir, album, cfg.Thumbnail, cfg.Html)
-		lck.Unlock()
-		if err != nil {
+		if err := SaveAlbum(albumDir, album, cfg.Thumbnail, cfg.Html); err != nil {
 			return fmt.Errorf("couldn't generate html: %w", err)
 		}
 	}
 	log.Printf("album %s %s\n", albumDir, album.Status)
 
-	return nil
+	return client.Err()
+}
+
+// pauseAlbum marks a resumed album as paused if the error was caused by an
+// invalid session.
+func pauseAlbum(albumDir string, album *Album, err error, thumbnail, html bool) {
+	if album == nil || !errors.Is(err, discord.ErrSessionInvalid) {
+		return
+	}
+	album.Status = "paused"
+	album.UpdatedAt = time.Now().UTC()
+	if err := SaveAlbum(albumDir, album, thumbnail, html); err != nil {
+		log.Println(fmt.Errorf("couldn't save album: %w", err))
+	}
 }
 
-func toImages(ctx context.Context, client *discord.Client, image *ai.Image, imgDir string, download, upscale, preview bool) []*Image {
+// NewTLSConfig returns the config to verify server certificates.
+// Disabling the verification is logged loudly, because the session token
+// can be stolen.
+func NewTLSConfig(caFiles, pins []string, insecure bool) *http.TLSConfig {
+	if insecure {
+		log.Println("⚠️ ⚠️ ⚠️ TLS certificate verification is DISABLED, anyone between you and discord can steal your token. Use --insecure only for debugging.")
+	}
+	return &http.TLSConfig{
+		CAFiles:  caFiles,
+		Pins:     pins,
+		Insecure: insecure,
+	}
+}
+
+// NewProxyPool creates a proxy pool from an inline list of proxies and a
+// proxy file, and checks the health of its proxies.
+func NewProxyPool(ctx context.Context, proxies, proxyFile string, tlsCfg *http.TLSConfig) (*http.ProxyPool, error) {
+	urls, err := http.ParseProxies(proxies, proxyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := http.NewProxyPool(urls, http.WithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create proxy pool: %w", err)
+	}
+	if pool.Len() > 1 {
+		log.Printf("checking %d proxies\n", pool.Len())
+	}
+	if err := pool.Check(ctx); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// sessionCheckpoint is the interval to save the rotated cookies of the session.
+const sessionCheckpoint = 5 * time.Minute
+
+// startClient creates and starts a discord client using the session.
+// The account traffic goes through its sticky proxy of the pool, while
+// downloads are rotated across all the healthy proxies.
+// The returned function stops the client and saves the session with the
+// updated cookies, if the session file is set.
+func startClient(ctx context.Context, session *Session, sessionFile string, pool *http.ProxyPool, tlsCfg *http.TLSConfig, downloadsPerHost int, debug bool) (*discord.Client, func(), error) {
+	if err := session.validateProfile(); err != nil {
+		log.Printf("⚠️ %v\n", err)
+	}
+	account, err := discord.TokenUserID(session.Token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create http clients, the dialer is also used for the gateway websocket
+	dialer := pool.Dialer(account)
+	httpClient, err := http.NewClient(session.JA3, session.UserAgent, session.Language, "", http.WithHTTP2Fingerprint(session.HTTP2), http.WithDialer(dialer), http.WithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create http client: %w", err)
+	}
+	downloadClient, err := http.NewClient(session.JA3, session.UserAgent, session.Language, "", http.WithHTTP2Fingerprint(session.HTTP2), http.WithDialer(pool.DownloadDialer()), http.WithTLSConfig(tlsCfg))
+	if err != nil {
+		_ = http.Close(httpClient)
+		return nil, nil, fmt.Errorf("couldn't create download client: %w", err)
+	}
+	closeClients := func() {
+		_ = http.Close(httpClient)
+		_ = http.Close(downloadClient)
+	}
+	// The gateway websocket verifies certificates like the http clients
+	gatewayTLS, err := tlsCfg.Std()
+	if err != nil {
+		closeClients()
+		return nil, nil, err
+	}
+
+	if err := http.SetCookies(httpClient, "https://discord.com", session.Cookie); err != nil {
+		closeClients()
+		return nil, nil, fmt.Errorf("couldn't set cookies: %w", err)
+	}
+	// Save rotated cookies periodically, so they aren't lost if the process
+	// is killed during a long run.
+	// Sessions that don't come from a file aren't saved.
+	saveSession := func() {}
+	if sessionFile != "" {
+		saveSession = sessionstore.NewStore(sessionFile).Checkpoint(ctx, sessionCheckpoint, func() (string, error) {
+			cookie, err := http.GetCookies(httpClient, "https://discord.com")
+			return strings.ReplaceAll(cookie, "\n", ""), err
+		})
+	}
+
+	// Create discord client
+	client, err := discord.New(ctx, &discord.Config{
+		Token:            session.Token,
+		SuperProperties:  session.SuperProperties,
+		Locale:           session.Locale,
+		UserAgent:        session.UserAgent,
+		HTTPClient:       httpClient,
+		DownloadClient:   downloadClient,
+		Dialer:           dialer,
+		TLSConfig:        gatewayTLS,
+		Debug:            debug,
+		DownloadsPerHost: downloadsPerHost,
+	})
+	if err != nil {
+		saveSession()
+		closeClients()
+		return nil, nil, fmt.Errorf("couldn't create discord client: %w", err)
+	}
+
+	// Start discord client
+	if err := client.Start(ctx); err != nil {
+		if errors.Is(err, discord.ErrSessionInvalid) {
+			pool.Disable(account)
+		}
+		saveSession()
+		closeClients()
+		return nil, nil, fmt.Errorf("couldn't start discord client: %w", err)
+	}
+
+	// Stop the traffic of the account if discord rejects the session, the
+	// rest of the accounts and the downloads aren't affected
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-client.Invalid():
+			pool.Disable(account)
+		}
+	}()
+	return client, func() {
+		close(done)
+		_ = client.Stop()
+		saveSession()
+		closeClients()
+	}, nil
+}
+
+// toImages converts a generated image to album images, downloading and
+// post-processing it if needed.
+// If thumbnailWidth is set, thumbnails are obtained from the discord media
+// proxy instead of resizing the downloaded image.
+func toImages(ctx context.Context, client *discord.Client, image *ai.Image, imgDir string, download, upscale, preview bool, thumbnailWidth int) []*Image {
+	var thumbnail string
+	if thumbnailWidth > 0 {
+		thumbnail, _ = discord.MediaProxyURL(image.URL, thumbnailWidth)
+	}
 	if !download {
 		return []*Image{{
-			Prompt: image.Prompt,
-			URL:    image.URL,
+			Prompt:    image.Prompt,
+			URL:       image.URL,
+			Thumbnail: thumbnail,
+			CreatedAt: time.Now().UTC(),
 		}}
 	}
 
 	// Create image output name
 	localFile := image.FileName()
 	imgOutput := fmt.Sprintf("%s/%s", imgDir, localFile)
-	if err := client.Download(ctx, image.URL, imgOutput); err != nil {
+	var size int64
+	var hash string
+	file, err := downloadImage(ctx, client, image.URL, imgOutput)
+	if err != nil {
 		log.Println(fmt.Errorf("❌ couldn't download `%s`: %w", image.URL, err))
+	} else {
+		// The extension may have changed depending on the content type
+		imgOutput = file.Path
+		localFile = filepath.Base(file.Path)
+		size = file.Size
+		hash = file.Hash
 	}
 
 	// Generate preview image
@@ -407,17 +621,31 @@ func toImages(ctx context.Context, client *discord.Client, image *ai.Image, imgD
 		base := filepath.Base(imgOutput)
 		base = strings.TrimSuffix(base, filepath.Ext(base))
 		previewOutput := fmt.Sprintf("%s/_thumbnails/%s.jpg", imgDir, base)
-		if err := img.Resize(8, imgOutput, previewOutput); err != nil {
-			log.Println(fmt.Errorf("❌ couldn't preview `%s`: %w", imgOutput, err))
+		var proxied bool
+		if thumbnail != "" {
+			if err := proxyThumbnail(ctx, client, thumbnail, previewOutput); err != nil {
+				log.Println(fmt.Errorf("❌ couldn't download thumbnail `%s`, resizing instead: %w", thumbnail, err))
+			} else {
+				proxied = true
+			}
+		}
+		if !proxied {
+			if err := img.Resize(8, imgOutput, previewOutput); err != nil {
+				log.Println(fmt.Errorf("❌ couldn't preview `%s`: %w", imgOutput, err))
+			}
 		}
 	}
 
 	// Current image is an upscale image, return it
 	if upscale {
 		return []*Image{{
-			Prompt: image.Prompt,
-			URL:    image.URL,
-			File:   localFile,
+			Prompt:    image.Prompt,
+			URL:       image.URL,
+			File:      localFile,
+			Thumbnail: thumbnail,
+			Size:      size,
+			Hash:      hash,
+			CreatedAt: time.Now().UTC(),
 		}}
 	}
 
@@ -427,17 +655,29 @@ func toImages(ctx context.Context, client *discord.Client, image *ai.Image, imgD
 	localFiles := image.FileNames()
 	var imgOutputs []string
 	for _, localFile := range localFiles {
+		localFile = strings.TrimSuffix(localFile, filepath.Ext(localFile)) + filepath.Ext(imgOutput)
 		imgOutputs = append(imgOutputs, fmt.Sprintf("%s/%s", imgDir, localFile))
 		images = append(images, &Image{
-			Prompt: image.Prompt,
-			URL:    image.URL,
-			File:   localFile,
+			Prompt:    image.Prompt,
+			URL:       image.URL,
+			File:      localFile,
+			Thumbnail: thumbnail,
+			CreatedAt: time.Now().UTC(),
 		})
 	}
 	if err := img.Split4(imgOutput, imgOutputs); err != nil {
 		log.Println(fmt.Errorf("❌ couldn't split `%s`: %w", imgOutput, err))
 		return images
 	}
+	for i, imgOutput := range imgOutputs {
+		size, hash, err := checksum(imgOutput)
+		if err != nil {
+			log.Println(fmt.Errorf("❌ couldn't calculate checksum of `%s`: %w", imgOutput, err))
+			continue
+		}
+		images[i].Size = size
+		images[i].Hash = hash
+	}
 
 	// Create preview images
 	if preview {
@@ -453,49 +693,623 @@ func toImages(ctx context.Context, client *discord.Client, image *ai.Image, imgD
 	return images
 }
 
-var albumHTML = `<html>
+// maxDownloadAttempts is the number of times an image is downloaded again if
+// it can't be decoded.
+const maxDownloadAttempts = 3
+
+// downloadImage downloads an image and verifies that it can be decoded.
+func downloadImage(ctx context.Context, client *discord.Client, u, output string) (*discord.File, error) {
+	for i := 0; i < maxDownloadAttempts; i++ {
+		file, err := client.Download(ctx, u, output)
+		if err != nil {
+			return nil, err
+		}
+		if err := img.Verify(file.Path); err != nil {
+			log.Println(fmt.Errorf("❌ corrupt download `%s`, downloading again: %w", u, err))
+			_ = os.Remove(file.Path)
+			continue
+		}
+		return file, nil
+	}
+	return nil, fmt.Errorf("couldn't download a valid image after %d attempts", maxDownloadAttempts)
+}
+
+// proxyThumbnail downloads a thumbnail from the discord media proxy and
+// converts it to jpg.
+func proxyThumbnail(ctx context.Context, client *discord.Client, u, output string) error {
+	file, err := downloadImage(ctx, client, u, output)
+	if err != nil {
+		return err
+	}
+	if file.Path == output {
+		return nil
+	}
+	defer func() { _ = os.Remove(file.Path) }()
+	return img.Resize(1, file.Path, output)
+}
+
+// checksum returns the size and the hex encoded SHA-256 of a file.
+func checksum(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// albumHTML is a self-contained gallery page.
+// Image data is embedded as JSON and rendered by the browser, so pages stay
+// fast with albums of tens of thousands of images.
+// Favourites are stored in the local storage of the browser.
+var albumHTML = `<!DOCTYPE html>
+<html lang="en">
 <head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Title }}</title>
 <style>
-div.gallery {
-	margin: 5px;
-	border: 1px solid #ccc;
-	float: left;
-	width: 128px;
+* {
+	box-sizing: border-box;
 }
 
-div.gallery:hover {
-	border: 1px solid #777;
+body {
+	margin: 0;
+	font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif;
+	background: #16181c;
+	color: #e6e6e6;
 }
 
-div.gallery img {
-	width: 100%;
-	height: auto;
+header {
+	position: sticky;
+	top: 0;
+	z-index: 1;
+	padding: 12px 16px;
+	background: #1f2227;
+	border-bottom: 1px solid #30343b;
+}
+
+h1 {
+	margin: 0;
+	font-size: 20px;
+}
+
+header p {
+	margin: 4px 0 10px;
+	color: #9aa0a8;
+	font-size: 13px;
+}
+
+.toolbar {
+	display: flex;
+	flex-wrap: wrap;
+	gap: 8px;
+	align-items: center;
+	font-size: 14px;
+}
+
+.toolbar input[type=search] {
+	flex: 1 1 240px;
+}
+
+input, select, button {
+	padding: 5px 8px;
+	border: 1px solid #3a3f47;
+	border-radius: 4px;
+	background: #2a2e35;
+	color: inherit;
+	font: inherit;
+}
+
+button {
+	cursor: pointer;
+}
+
+button:disabled {
+	cursor: default;
+	opacity: 0.4;
+}
+
+#count {
+	margin-left: auto;
+	color: #9aa0a8;
+}
+
+main {
+	padding: 8px 16px;
+}
+
+section h2 {
+	margin: 16px 0 8px;
+	font-size: 14px;
+	font-weight: normal;
+	word-break: break-word;
+}
+
+section h2 span {
+	margin-left: 8px;
+	color: #9aa0a8;
 }
 
-div.gallery input {
-	margin-top: 5px;
+.grid {
+	display: grid;
+	grid-template-columns: repeat(auto-fill, minmax(180px, 1fr));
+	gap: 8px;
+}
+
+.item {
+	position: relative;
+	border: 1px solid #30343b;
+	border-radius: 4px;
+	overflow: hidden;
+	background: #1f2227;
+}
+
+.item:hover {
+	border-color: #6b7280;
+}
+
+.item img {
+	display: block;
 	width: 100%;
+	aspect-ratio: 1;
+	object-fit: cover;
+	cursor: zoom-in;
+}
+
+.item .caption {
+	padding: 4px 6px;
+	font-size: 12px;
+	color: #9aa0a8;
+	white-space: nowrap;
+	overflow: hidden;
+	text-overflow: ellipsis;
+}
+
+.star {
+	position: absolute;
+	top: 4px;
+	right: 4px;
+	padding: 0 6px;
+	border: none;
+	background: rgba(0, 0, 0, 0.5);
+	color: #fff;
+	font-size: 18px;
+	opacity: 0;
+}
+
+.item:hover .star, .item.favourite .star {
+	opacity: 1;
+}
+
+.favourite .star, #lightbox.favourite .star {
+	color: #f5c518;
+}
+
+.pager {
+	display: flex;
+	gap: 8px;
+	justify-content: center;
+	align-items: center;
+	padding: 12px;
+	font-size: 14px;
+}
+
+.empty {
+	padding: 32px;
+	text-align: center;
+	color: #9aa0a8;
+}
+
+#lightbox {
+	position: fixed;
+	inset: 0;
+	z-index: 2;
+	display: flex;
+	align-items: center;
+	justify-content: center;
+	background: rgba(0, 0, 0, 0.92);
+}
+
+#lightbox[hidden] {
+	display: none;
+}
+
+#lightbox figure {
+	margin: 0;
+	max-width: calc(100vw - 140px);
+	text-align: center;
+}
+
+#lightbox img {
+	max-width: 100%;
+	max-height: calc(100vh - 140px);
+}
+
+#lightbox figcaption {
+	margin-top: 8px;
+	font-size: 14px;
+	word-break: break-word;
+}
+
+#lightbox .star {
+	position: static;
+	opacity: 1;
+}
+
+#lightbox .nav, #lightbox .close {
+	position: absolute;
+	border: none;
+	background: none;
+	color: #fff;
+	font-size: 40px;
+}
+
+#lightbox .prev {
+	left: 16px;
+}
+
+#lightbox .next {
+	right: 16px;
+}
+
+#lightbox .close {
+	top: 8px;
+	right: 16px;
+	font-size: 32px;
 }
 </style>
 </head>
-<body>
+<body data-album="{{ .ID }}">
 
+<header>
 <h1>{{ .Title }}</h1>
 <p>{{ .Status }}, elapsed: {{ .Elapsed }}</p>
-{{range  .Images }}
-<div class="gallery">
-  <a target="_blank" href="{{ .URL }}">
-    <img src="{{ .Source }}">
-  </a>
-  <input type="text" value="{{ .Prompt }}">
+<div class="toolbar">
+	<input id="search" type="search" placeholder="Search prompts" autocomplete="off">
+	<select id="sort">
+		<option value="prompt">Sort by prompt</option>
+		<option value="newest">Newest first</option>
+		<option value="oldest">Oldest first</option>
+	</select>
+	<label><input id="group" type="checkbox" checked> Group by prompt</label>
+	<label><input id="favourites" type="checkbox"> Favourites only</label>
+	<select id="size">
+		<option value="100">100 per page</option>
+		<option value="200" selected>200 per page</option>
+		<option value="500">500 per page</option>
+		<option value="1000">1000 per page</option>
+	</select>
+	<button id="export" type="button">Export favourites</button>
+	<span id="count"></span>
 </div>
-{{end}}
+</header>
+
+<nav class="pager"></nav>
+<main id="gallery"></main>
+<nav class="pager"></nav>
+
+<div id="lightbox" hidden>
+	<button class="close" type="button" title="Close (Esc)">&times;</button>
+	<button class="nav prev" type="button" title="Previous (Left)">&lsaquo;</button>
+	<figure>
+		<a target="_blank" rel="noopener"><img alt=""></a>
+		<figcaption>
+			<span class="position"></span>
+			<button class="star" type="button" title="Favourite (F)">&#9733;</button>
+			<p class="prompt"></p>
+		</figcaption>
+	</figure>
+	<button class="nav next" type="button" title="Next (Right)">&rsaquo;</button>
+</div>
+
+<script id="images" type="application/json">{{ .Images }}</script>
+<script>
+(function () {
+	"use strict";
+
+	var images = JSON.parse(document.getElementById("images").textContent) || [];
+	images.forEach(function (img, i) {
+		img.index = i;
+		img.search = img.prompt.toLowerCase();
+	});
+
+	var $ = function (id) { return document.getElementById(id); };
+	var search = $("search"), sort = $("sort"), group = $("group"),
+		onlyFavourites = $("favourites"), size = $("size"), gallery = $("gallery"),
+		count = $("count"), lightbox = $("lightbox");
+	var pagers = document.querySelectorAll(".pager");
+
+	// Favourites are kept per album in the local storage
+	var storageKey = "bulkai:" + document.body.dataset.album + ":favourites";
+	var favourites = {};
+	try {
+		JSON.parse(localStorage.getItem(storageKey) || "[]").forEach(function (u) {
+			favourites[u] = true;
+		});
+	} catch (e) {
+	}
+	function toggleFavourite(img) {
+		if (favourites[img.url]) {
+			delete favourites[img.url];
+		} else {
+			favourites[img.url] = true;
+		}
+		try {
+			localStorage.setItem(storageKey, JSON.stringify(Object.keys(favourites)));
+		} catch (e) {
+		}
+		return !!favourites[img.url];
+	}
+
+	function element(tag, className) {
+		var e = document.createElement(tag);
+		if (className) {
+			e.className = className;
+		}
+		return e;
+	}
+
+	// filter returns the images matching the search and the favourites
+	// filter, sorted by the selected criteria.
+	// When grouping by time, groups are sorted by their newest or oldest
+	// image.
+	function filter() {
+		var words = search.value.toLowerCase().split(/\s+/).filter(Boolean);
+		var list = images.filter(function (img) {
+			if (onlyFavourites.checked && !favourites[img.url]) {
+				return false;
+			}
+			return words.every(function (w) { return img.search.indexOf(w) >= 0; });
+		});
+		var mode = sort.value;
+		if (mode === "prompt") {
+			return list.sort(function (a, b) {
+				return a.prompt < b.prompt ? -1 : a.prompt > b.prompt ? 1 : a.index - b.index;
+			});
+		}
+		var dir = mode === "newest" ? -1 : 1;
+		var groupTime = {};
+		list.forEach(function (img) {
+			var t = groupTime[img.prompt];
+			if (t === undefined || (img.time - t) * dir < 0) {
+				groupTime[img.prompt] = img.time;
+			}
+		});
+		return list.sort(function (a, b) {
+			if (group.checked && a.prompt !== b.prompt) {
+				var d = (groupTime[a.prompt] - groupTime[b.prompt]) * dir;
+				return d || (a.prompt < b.prompt ? -1 : 1);
+			}
+			return (a.time - b.time) * dir || a.index - b.index;
+		});
+	}
+
+	var list = [], page = 0, current = -1;
+
+	function update() {
+		list = filter();
+		page = 0;
+		render();
+	}
+
+	function pageSize() {
+		return parseInt(size.value, 10);
+	}
+
+	function render() {
+		var n = pageSize();
+		var pages = Math.max(1, Math.ceil(list.length / n));
+		page = Math.min(page, pages - 1);
+		var start = page * n;
+		var slice = list.slice(start, start + n);
+
+		count.textContent = list.length === images.length ?
+			images.length + " images" : list.length + " of " + images.length + " images";
+		gallery.textContent = "";
+		if (slice.length === 0) {
+			var empty = element("p", "empty");
+			empty.textContent = "No images found";
+			gallery.appendChild(empty);
+		}
+
+		var counts = {};
+		if (group.checked) {
+			list.forEach(function (img) { counts[img.prompt] = (counts[img.prompt] || 0) + 1; });
+		}
+		var fragment = document.createDocumentFragment();
+		var grid = null, prompt = null;
+		slice.forEach(function (img, i) {
+			if (!grid || (group.checked && img.prompt !== prompt)) {
+				var section = element("section");
+				if (group.checked) {
+					var title = element("h2");
+					title.textContent = img.prompt;
+					var total = element("span");
+					total.textContent = counts[img.prompt] + (counts[img.prompt] === 1 ? " image" : " images");
+					title.appendChild(total);
+					section.appendChild(title);
+				}
+				grid = element("div", "grid");
+				section.appendChild(grid);
+				fragment.appendChild(section);
+				prompt = img.prompt;
+			}
+			grid.appendChild(item(img, start + i));
+		});
+		gallery.appendChild(fragment);
+		renderPagers(pages);
+	}
+
+	function item(img, position) {
+		var div = element("div", favourites[img.url] ? "item favourite" : "item");
+		var link = element("a");
+		link.href = img.url;
+		link.addEventListener("click", function (e) {
+			e.preventDefault();
+			open(position);
+		});
+		var thumbnail = element("img");
+		thumbnail.loading = "lazy";
+		thumbnail.src = img.src;
+		thumbnail.alt = img.prompt;
+		link.appendChild(thumbnail);
+		var star = element("button", "star");
+		star.type = "button";
+		star.title = "Favourite";
+		star.innerHTML = "&#9733;";
+		star.addEventListener("click", function () {
+			div.classList.toggle("favourite", toggleFavourite(img));
+		});
+		var caption = element("div", "caption");
+		caption.textContent = img.prompt;
+		caption.title = img.prompt;
+		div.appendChild(link);
+		div.appendChild(star);
+		div.appendChild(caption);
+		return div;
+	}
+
+	function renderPagers(pages) {
+		pagers.forEach(function (pager) {
+			pager.textContent = "";
+			if (pages <= 1) {
+				return;
+			}
+			var prev = element("button");
+			prev.type = "button";
+			prev.textContent = "Previous";
+			prev.disabled = page === 0;
+			prev.addEventListener("click", function () { goTo(page - 1); });
+			var label = element("span");
+			label.textContent = "Page " + (page + 1) + " of " + pages;
+			var next = element("button");
+			next.type = "button";
+			next.textContent = "Next";
+			next.disabled = page >= pages - 1;
+			next.addEventListener("click", function () { goTo(page + 1); });
+			pager.appendChild(prev);
+			pager.appendChild(label);
+			pager.appendChild(next);
+		});
+	}
+
+	function goTo(p) {
+		page = p;
+		render();
+		window.scrollTo(0, 0);
+	}
+
+	// Lightbox
+	var full = lightbox.querySelector("img"), fullLink = lightbox.querySelector("a"),
+		position = lightbox.querySelector(".position"), caption = lightbox.querySelector(".prompt");
+
+	function open(i) {
+		if (i < 0 || i >= list.length) {
+			return;
+		}
+		current = i;
+		var img = list[i];
+		full.src = img.url;
+		full.alt = img.prompt;
+		fullLink.href = img.url;
+		caption.textContent = img.prompt;
+		position.textContent = (i + 1) + " / " + list.length;
+		lightbox.classList.toggle("favourite", !!favourites[img.url]);
+		lightbox.hidden = false;
+	}
+
+	function close() {
+		lightbox.hidden = true;
+		full.removeAttribute("src");
+		// Keep the page of the last image shown
+		var p = Math.floor(current / pageSize());
+		current = -1;
+		if (onlyFavourites.checked) {
+			list = filter();
+		}
+		if (p !== page) {
+			goTo(p);
+		} else {
+			render();
+		}
+	}
+
+	lightbox.querySelector(".close").addEventListener("click", close);
+	lightbox.querySelector(".prev").addEventListener("click", function () { open(current - 1); });
+	lightbox.querySelector(".next").addEventListener("click", function () { open(current + 1); });
+	lightbox.querySelector(".star").addEventListener("click", function () {
+		lightbox.classList.toggle("favourite", toggleFavourite(list[current]));
+	});
+	lightbox.addEventListener("click", function (e) {
+		if (e.target === lightbox) {
+			close();
+		}
+	});
+	document.addEventListener("keydown", function (e) {
+		if (lightbox.hidden) {
+			return;
+		}
+		switch (e.key) {
+		case "Escape":
+			close();
+			break;
+		case "ArrowLeft":
+			open(current - 1);
+			break;
+		case "ArrowRight":
+			open(current + 1);
+			break;
+		case "f":
+		case "F":
+			lightbox.classList.toggle("favourite", toggleFavourite(list[current]));
+			break;
+		default:
+			return;
+		}
+		e.preventDefault();
+	});
+
+	// Export the files of the favourite images, one per line
+	$("export").addEventListener("click", function () {
+		var files = images.filter(function (img) { return favourites[img.url]; })
+			.map(function (img) { return img.url; });
+		if (files.length === 0) {
+			alert("No favourite images");
+			return;
+		}
+		var link = element("a");
+		link.href = URL.createObjectURL(new Blob([files.join("\n") + "\n"], {type: "text/plain"}));
+		link.download = "favourites-" + document.body.dataset.album + ".txt";
+		document.body.appendChild(link);
+		link.click();
+		document.body.removeChild(link);
+		URL.revokeObjectURL(link.href);
+	});
+
+	var timer;
+	search.addEventListener("input", function () {
+		clearTimeout(timer);
+		timer = setTimeout(update, 150);
+	});
+	[sort, group, onlyFavourites, size].forEach(function (e) {
+		e.addEventListener("change", update);
+	});
+	update();
+})();
+</script>
 
 </body>
 </html>
 `
 
 type htmlData struct {
+	ID      string
 	Title   string
 	Status  string
 	Images  []*htmlImage
@@ -503,9 +1317,11 @@ type htmlData struct {
 }
 
 type htmlImage struct {
-	URL    string
-	Source string
-	Prompt string
+	URL    string `json:"url"`
+	Source string `json:"src"`
+	Prompt string `json:"prompt"`
+	// Time is the creation time in unix milliseconds, zero if unknown.
+	Time int64 `json:"time"`
 }
 
 func SaveAlbum(dir string, a *Album, thumbnail bool, html bool) error {
@@ -530,16 +1346,25 @@ func SaveAlbum(dir string, a *Album, thumbnail bool, html bool) error {
 	}
 
 	var local htmlData
+	local.ID = a.ID
 	local.Title = fmt.Sprintf("Album %s", a.ID)
 	local.Status = fmt.Sprintf("%s %d%% %s", a.Status, int(a.Percentage), a.UpdatedAt.Format("2006-01-02 15:04:05"))
 	local.Elapsed = a.UpdatedAt.Sub(a.CreatedAt).String()
 	external := local
 	for _, img := range a.Images {
-		prompt := strings.ReplaceAll(img.Prompt, "\"", "&quot;")
+		var created int64
+		if !img.CreatedAt.IsZero() {
+			created = img.CreatedAt.UnixMilli()
+		}
+		source := img.URL
+		if img.Thumbnail != "" {
+			source = img.Thumbnail
+		}
 		external.Images = append(external.Images, &htmlImage{
 			URL:    img.URL,
-			Source: img.URL,
-			Prompt: prompt,
+			Source: source,
+			Prompt: img.Prompt,
+			Time:   created,
 		})
 		url := fmt.Sprintf("images/%s", img.File)
 		src := url
@@ -551,7 +1376,8 @@ func SaveAlbum(dir string, a *Album, thumbnail bool, html bool) error {
 		local.Images = append(local.Images, &htmlImage{
 			URL:    url,
 			Source: src,
-			Prompt: prompt,
+			Prompt: img.Prompt,
+			Time:   created,
 		})
 	}
 
@@ -0,0 +1,207 @@
+package bulkai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/igolaizola/bulkai/pkg/ai"
+	"github.com/igolaizola/bulkai/pkg/discord"
+	"github.com/igolaizola/bulkai/pkg/http"
+)
+
+// CheckError is returned by CheckSession when a check fails.
+type CheckError struct {
+	// Check is the name of the failed check.
+	Check string
+	// ExitCode is the exit code associated to the check.
+	ExitCode int
+	// Hint is an actionable message to fix the problem.
+	Hint string
+	Err  error
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("%s check failed: %v (%s)", e.Check, e.Err, e.Hint)
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// Session checks, the exit code of each check is its index plus 2.
+var sessionChecks = []struct {
+	name string
+	hint string
+}{
+	{"config", "review the session file and the bot name"},
+	{"super-properties", "create a new session with `bulkai create-session`"},
+	{"fingerprint", "review the ja3 and user-agent values of the session"},
+	{"token", "the token is invalid or expired, create a new session with `bulkai create-session` or `bulkai import-session`"},
+	{"cookies", "cookies were rejected, create a new session with `bulkai create-session` or `bulkai import-session`, or use another proxy"},
+	{"gateway", "check your network connection and proxy"},
+	{"channel", "send a message to the bot or review the channel parameter"},
+	{"command", "make sure the bot is added to the channel and you have access to its commands"},
+	{"proxy", "review the proxy list or remove the proxies that don't work"},
+}
+
+// NewCheckError returns the error of a failed check.
+// It panics if the check doesn't exist.
+func NewCheckError(name string, err error) error {
+	for i, c := range sessionChecks {
+		if c.name != name {
+			continue
+		}
+		return &CheckError{
+			Check:    name,
+			ExitCode: i + 2,
+			Hint:     c.hint,
+			Err:      err,
+		}
+	}
+	panic(fmt.Sprintf("bulkai: unknown check %s", name))
+}
+
+// CheckSession verifies that the session can be used with the bot without
+// launching any job.
+// The session file isn't updated.
+func CheckSession(ctx context.Context, cfg *Config) error {
+	ok := func(msg string) {
+		log.Printf("✅ %s\n", msg)
+	}
+
+	// Check config
+	if err := cfg.Session.check(); err != nil {
+		return NewCheckError("config", err)
+	}
+	if cfg.Bot == "" {
+		return NewCheckError("config", errors.New("missing bot name"))
+	}
+	backend, found := ai.Lookup(cfg.Bot)
+	if !found {
+		return NewCheckError("config", fmt.Errorf("unsupported bot: %s (available: %s)", cfg.Bot, strings.Join(ai.Backends(), ", ")))
+	}
+	botCfg, found := cfg.BotConfigs[backend.Name]
+	if !found {
+		botCfg = backend.NewConfig()
+	}
+	ok("session config is complete")
+
+	// Check super properties
+	superProperties, err := discord.ParseSuperProperties(cfg.Session.SuperProperties)
+	if err != nil {
+		return NewCheckError("super-properties", err)
+	}
+	ok(fmt.Sprintf("super properties decoded (%s %s, build %d)", superProperties.Browser, superProperties.BrowserVersion, superProperties.ClientBuildNumber))
+
+	// Check proxies
+	tlsCfg := NewTLSConfig(cfg.CAFiles, cfg.Pins, cfg.Insecure)
+	pool, err := NewProxyPool(ctx, cfg.Proxy, cfg.ProxyFile, tlsCfg)
+	if err != nil {
+		return NewCheckError("proxy", err)
+	}
+	if pool.Len() > 0 {
+		ok(fmt.Sprintf("proxies reachable (%d configured)", pool.Len()))
+	}
+
+	// Check fingerprint
+	if err := cfg.Session.validateProfile(); err != nil {
+		return NewCheckError("fingerprint", err)
+	}
+	account, err := discord.TokenUserID(cfg.Session.Token)
+	if err != nil {
+		return NewCheckError("token", err)
+	}
+	dialer := pool.Dialer(account)
+	httpClient, err := http.NewClient(cfg.Session.JA3, cfg.Session.UserAgent, cfg.Session.Language, "", http.WithHTTP2Fingerprint(cfg.Session.HTTP2), http.WithDialer(dialer), http.WithTLSConfig(tlsCfg))
+	if err != nil {
+		return NewCheckError("fingerprint", err)
+	}
+	defer func() { _ = http.Close(httpClient) }()
+	if err := http.SetCookies(httpClient, "https://discord.com", cfg.Session.Cookie); err != nil {
+		return NewCheckError("cookies", err)
+	}
+	gatewayTLS, err := tlsCfg.Std()
+	if err != nil {
+		return NewCheckError("fingerprint", err)
+	}
+	client, err := discord.New(ctx, &discord.Config{
+		Token:           cfg.Session.Token,
+		SuperProperties: cfg.Session.SuperProperties,
+		Locale:          cfg.Session.Locale,
+		UserAgent:       cfg.Session.UserAgent,
+		HTTPClient:      httpClient,
+		Dialer:          dialer,
+		TLSConfig:       gatewayTLS,
+		Debug:           cfg.Debug,
+	})
+	if err != nil {
+		return NewCheckError("token", err)
+	}
+	ok("fingerprint loaded")
+
+	// Check token and cookies
+	resp, err := client.Do(ctx, "GET", "users/@me", nil)
+	if err != nil {
+		var discordErr discord.Error
+		if errors.As(err, &discordErr) && discordErr.StatusCode == 401 {
+			return NewCheckError("token", err)
+		}
+		return NewCheckError("cookies", err)
+	}
+	var user discord.User
+	if err := json.Unmarshal(resp, &user); err != nil {
+		return NewCheckError("token", fmt.Errorf("couldn't unmarshal user %s: %w", string(resp), err))
+	}
+	ok(fmt.Sprintf("token is valid (user %s)", user.Username))
+	cookie, err := http.GetCookies(httpClient, "https://discord.com")
+	if err != nil {
+		return NewCheckError("cookies", err)
+	}
+	if cookie == "" {
+		return NewCheckError("cookies", errors.New("no cookies after request"))
+	}
+	ok("cookies accepted")
+
+	// Check gateway
+	if err := client.Start(ctx); err != nil {
+		if errors.Is(err, discord.ErrSessionInvalid) {
+			return NewCheckError("token", err)
+		}
+		return NewCheckError("gateway", err)
+	}
+	defer func() { _ = client.Stop() }()
+	ok("gateway connected")
+
+	// Check channel
+	if cfg.Channel != "" {
+		channelID := cfg.Channel
+		if split := strings.SplitN(channelID, "/", 2); len(split) == 2 {
+			channelID = split[1]
+		}
+		if _, err := client.Do(ctx, "GET", fmt.Sprintf("channels/%s", channelID), nil); err != nil {
+			return NewCheckError("channel", fmt.Errorf("channel %s is not reachable: %w", cfg.Channel, err))
+		}
+		ok(fmt.Sprintf("channel %s is reachable", cfg.Channel))
+	}
+
+	// Check bot command, the client fails if there is no DM channel
+	cli, err := backend.New(client, &ai.Options{
+		ChannelID: cfg.Channel,
+		Debug:     cfg.Debug,
+	}, botCfg)
+	if err != nil {
+		return NewCheckError("channel", err)
+	}
+	if cfg.Channel == "" {
+		ok(fmt.Sprintf("DM channel with %s found", backend.Name))
+	}
+	if err := cli.Start(ctx); err != nil {
+		return NewCheckError("command", err)
+	}
+	ok(fmt.Sprintf("%s command found", backend.Name))
+	return nil
+}
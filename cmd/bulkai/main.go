@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -9,9 +11,16 @@ import (
 	"os/signal"
 	"runtime/debug"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/igolaizola/bulkai"
+	"github.com/igolaizola/bulkai/pkg/ai"
+	"github.com/igolaizola/bulkai/pkg/cmd/createsession"
+	"github.com/igolaizola/bulkai/pkg/cmd/importsession"
 	"github.com/igolaizola/bulkai/pkg/cmd/refresh"
+	"github.com/igolaizola/bulkai/pkg/discord"
+	"github.com/igolaizola/bulkai/pkg/secret"
 	"github.com/igolaizola/bulkai/pkg/session"
 	"github.com/peterbourgon/ff/v3"
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -31,6 +40,21 @@ func main() {
 	// Launch command
 	cmd := newCommand()
 	if err := cmd.ParseAndRun(ctx, os.Args[1:]); err != nil {
+		// Session checks have their own exit codes
+		var checkErr *bulkai.CheckError
+		if errors.As(err, &checkErr) {
+			log.Printf("❌ %s check failed: %v\n", checkErr.Check, checkErr.Err)
+			log.Printf("👉 %s\n", checkErr.Hint)
+			cancel()
+			os.Exit(checkErr.ExitCode)
+		}
+		// Invalid sessions must be renewed before resuming
+		if errors.Is(err, discord.ErrSessionInvalid) {
+			log.Printf("❌ %v\n", err)
+			log.Println("👉 create a new session with `bulkai create-session` or `bulkai import-session` (use --profile to replace a profile) and run the same command again to resume")
+			cancel()
+			os.Exit(1)
+		}
 		log.Fatal(err)
 	}
 }
@@ -46,8 +70,13 @@ func newCommand() *ffcli.Command {
 		},
 		Subcommands: []*ffcli.Command{
 			newGenerateCommand(),
+			newImportCommand(),
 			newCreateSessionCommand(),
+			newImportSessionCommand(),
+			newCheckSessionCommand(),
 			newRefreshCommand(),
+			newFingerprintCommand(),
+			newSessionCommand(),
 			newVersionCommand(),
 		},
 	}
@@ -61,7 +90,11 @@ func newGenerateCommand() *ffcli.Command {
 	fs.StringVar(&cfg.Bot, "bot", "", "bot name")
 	var prompts fsStrings
 	fs.Var(&prompts, "prompt", "prompt list")
-	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy address (optional)")
+	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy address, or a list of proxies separated by commas (optional)")
+	fs.StringVar(&cfg.ProxyFile, "proxy-file", "", "file with a proxy address per line (optional)")
+	fs.Var((*fsStrings)(&cfg.CAFiles), "ca-file", "PEM file with certificates trusted in addition to the system ones, can be repeated (optional)")
+	fs.Var((*fsStrings)(&cfg.Pins), "pin", "base64 sha256 hash of a certificate public key that discord.com must present, can be repeated (optional)")
+	fs.BoolVar(&cfg.Insecure, "insecure", false, "disable TLS certificate verification, only for debugging (INSECURE)")
 	fs.StringVar(&cfg.Output, "output", "output", "output directory")
 	fs.StringVar(&cfg.Album, "album", "", "album id (optional)")
 	fs.StringVar(&cfg.Prefix, "prefix", "", "prefix to be added")
@@ -70,16 +103,32 @@ func newGenerateCommand() *ffcli.Command {
 	fs.BoolVar(&cfg.Download, "download", true, "download images")
 	fs.BoolVar(&cfg.Upscale, "upscale", true, "upscale images")
 	fs.BoolVar(&cfg.Thumbnail, "thumbnail", true, "generate thumbnails")
+	fs.IntVar(&cfg.ThumbnailWidth, "thumbnail-width", 0, "width of thumbnails obtained from the discord media proxy, if 0 they are resized locally (optional)")
 	fs.BoolVar(&cfg.Html, "html", true, "generate html files")
 	fs.StringVar(&cfg.Channel, "channel", "", "channel in format guid/channel (optional, if not provided DMs will be used)")
 	fs.IntVar(&cfg.Concurrency, "concurrency", 3, "concurrency (optional, if 0 the maximum for the bot will be used)")
 	fs.DurationVar(&cfg.Wait, "wait", 0, "wait time between prompts (optional)")
+	fs.IntVar(&cfg.DownloadWorkers, "download-workers", 4, "number of images downloaded and post-processed at the same time")
+	fs.IntVar(&cfg.DownloadsPerHost, "downloads-per-host", 2, "maximum concurrent downloads from the same host")
 	fs.BoolVar(&cfg.Debug, "debug", false, "debug mode")
-	fs.StringVar(&cfg.ReplicateToken, "replicate-token", "", "replicate token (optional)")
-	fs.BoolVar(&cfg.MidjourneyCDN, "midjourney-cdn", false, "use midjourney cdn instead of discord cdn")
+
+	// Backend specific flags
+	cfg.BotConfigs = map[string]interface{}{}
+	for _, name := range ai.Backends() {
+		backend, _ := ai.Lookup(name)
+		botCfg := backend.NewConfig()
+		if err := backend.RegisterFlags(fs, botCfg); err != nil {
+			panic(err)
+		}
+		cfg.BotConfigs[name] = botCfg
+	}
+	// Deprecated flags kept for backwards compatibility
+	fs.Var(fs.Lookup("midjourney.replicate-token").Value, "replicate-token", "deprecated, use midjourney.replicate-token")
+	fs.Var(fs.Lookup("midjourney.cdn").Value, "midjourney-cdn", "deprecated, use midjourney.cdn")
 
 	// Session
 	fs.StringVar(&cfg.SessionFile, "session", "session.yaml", "session config file (optional)")
+	profile := newProfileFlags(fs)
 
 	fsSession := flag.NewFlagSet("", flag.ExitOnError)
 	for _, fs := range []*flag.FlagSet{fs, fsSession} {
@@ -90,6 +139,7 @@ func newGenerateCommand() *ffcli.Command {
 		fs.StringVar(&cfg.Session.SuperProperties, "super-properties", "", "super properties")
 		fs.StringVar(&cfg.Session.Locale, "locale", "", "locale")
 		fs.StringVar(&cfg.Session.Cookie, "cookie", "", "cookie")
+		fs.StringVar(&cfg.Session.HTTP2, "http2", "", "http2 fingerprint in akamai format (optional)")
 	}
 
 	return &ffcli.Command{
@@ -103,7 +153,13 @@ func newGenerateCommand() *ffcli.Command {
 		ShortHelp: "generate images in bulk",
 		FlagSet:   fs,
 		Exec: func(ctx context.Context, args []string) error {
-			loadSession(fsSession, cfg.SessionFile)
+			sessionFile, err := profile.sessionFile(fs, cfg.SessionFile)
+			if err != nil {
+				return err
+			}
+			if cfg.SessionFile, err = loadSession(fsSession, sessionFile); err != nil {
+				return fmt.Errorf("couldn't load session: %w", err)
+			}
 			cfg.Prompts = prompts
 			last := 0
 			return bulkai.Generate(ctx, cfg, bulkai.WithOnUpdate(func(s bulkai.Status) {
@@ -112,26 +168,98 @@ func newGenerateCommand() *ffcli.Command {
 					return
 				}
 				last = curr
-				fmt.Printf("{\"progress\": \"%d\", \"estimated\": \"%s\"}\n", curr, s.Estimated)
+				fmt.Printf("{\"progress\": \"%d\", \"estimated\": \"%s\", \"pending\": \"%d\"}\n", curr, s.Estimated, s.Pending)
 			}))
 		},
 	}
 }
 
+func newImportCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	_ = fs.String("config", "bulkai.yaml", "config file (optional)")
+
+	cfg := &bulkai.ImportConfig{}
+	fs.StringVar(&cfg.Bot, "bot", "midjourney", "bot name (midjourney or niji)")
+	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy address, or a list of proxies separated by commas (optional)")
+	fs.StringVar(&cfg.ProxyFile, "proxy-file", "", "file with a proxy address per line (optional)")
+	fs.Var((*fsStrings)(&cfg.CAFiles), "ca-file", "PEM file with certificates trusted in addition to the system ones, can be repeated (optional)")
+	fs.Var((*fsStrings)(&cfg.Pins), "pin", "base64 sha256 hash of a certificate public key that discord.com must present, can be repeated (optional)")
+	fs.BoolVar(&cfg.Insecure, "insecure", false, "disable TLS certificate verification, only for debugging (INSECURE)")
+	fs.StringVar(&cfg.Output, "output", "output", "output directory")
+	fs.StringVar(&cfg.Album, "album", "", "album id (optional)")
+	fs.StringVar(&cfg.Channel, "channel", "", "channel in format guid/channel (optional, if not provided DMs will be used)")
+	fs.BoolVar(&cfg.Upscale, "upscale", true, "import upscaled images instead of previews")
+	fs.BoolVar(&cfg.Download, "download", true, "download images")
+	fs.BoolVar(&cfg.Thumbnail, "thumbnail", true, "generate thumbnails")
+	fs.IntVar(&cfg.ThumbnailWidth, "thumbnail-width", 0, "width of thumbnails obtained from the discord media proxy, if 0 they are resized locally (optional)")
+	fs.BoolVar(&cfg.Html, "html", true, "generate html files")
+	fs.StringVar(&cfg.From, "from", "", "import messages sent after this date, format 2006-01-02 or RFC3339 (optional)")
+	fs.StringVar(&cfg.To, "to", "", "import messages sent before this date, format 2006-01-02 or RFC3339 (optional)")
+	fs.StringVar(&cfg.Prompt, "prompt", "", "import only prompts matching this regular expression (optional)")
+	fs.BoolVar(&cfg.Debug, "debug", false, "debug mode")
+
+	// Session
+	fs.StringVar(&cfg.SessionFile, "session", "session.yaml", "session config file (optional)")
+	profile := newProfileFlags(fs)
+
+	fsSession := flag.NewFlagSet("", flag.ExitOnError)
+	for _, fs := range []*flag.FlagSet{fs, fsSession} {
+		fs.StringVar(&cfg.Session.UserAgent, "user-agent", "", "user agent")
+		fs.StringVar(&cfg.Session.JA3, "ja3", "", "ja3 fingerprint")
+		fs.StringVar(&cfg.Session.Language, "language", "", "language")
+		fs.StringVar(&cfg.Session.Token, "token", "", "authentication token")
+		fs.StringVar(&cfg.Session.SuperProperties, "super-properties", "", "super properties")
+		fs.StringVar(&cfg.Session.Locale, "locale", "", "locale")
+		fs.StringVar(&cfg.Session.Cookie, "cookie", "", "cookie")
+		fs.StringVar(&cfg.Session.HTTP2, "http2", "", "http2 fingerprint in akamai format (optional)")
+	}
+
+	return &ffcli.Command{
+		Name:       "import",
+		ShortUsage: "bulkai import [flags] <key> <value data...>",
+		Options: []ff.Option{
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ffyaml.Parser),
+			ff.WithEnvVarPrefix("BULKAI"),
+			ff.WithIgnoreUndefined(true),
+		},
+		ShortHelp: "import images from a channel history into an album",
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			sessionFile, err := profile.sessionFile(fs, cfg.SessionFile)
+			if err != nil {
+				return err
+			}
+			if cfg.SessionFile, err = loadSession(fsSession, sessionFile); err != nil {
+				return fmt.Errorf("couldn't load session: %w", err)
+			}
+			return bulkai.Import(ctx, cfg)
+		},
+	}
+}
+
 func newRefreshCommand() *ffcli.Command {
 	fs := flag.NewFlagSet("refresh", flag.ExitOnError)
 	_ = fs.String("config", "", "config file (optional)")
 
 	cfg := &refresh.Config{}
 
-	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy address (optional)")
+	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy address, or a list of proxies separated by commas (optional)")
+	fs.StringVar(&cfg.ProxyFile, "proxy-file", "", "file with a proxy address per line (optional)")
+	fs.Var((*fsStrings)(&cfg.CAFiles), "ca-file", "PEM file with certificates trusted in addition to the system ones, can be repeated (optional)")
+	fs.Var((*fsStrings)(&cfg.Pins), "pin", "base64 sha256 hash of a certificate public key that discord.com must present, can be repeated (optional)")
+	fs.BoolVar(&cfg.Insecure, "insecure", false, "disable TLS certificate verification, only for debugging (INSECURE)")
 	fs.StringVar(&cfg.Input, "input", "input", "input file")
 	fs.StringVar(&cfg.Output, "output", "output", "output file")
+	fs.StringVar(&cfg.Album, "album", "", "album directory to refresh in place, input and output are ignored (optional)")
+	fs.DurationVar(&cfg.Margin, "margin", time.Hour, "refresh URLs that expire within this duration")
+	fs.BoolVar(&cfg.Force, "force", false, "refresh all URLs even if they haven't expired")
 	fs.DurationVar(&cfg.Wait, "wait", 0, "wait time between requests (optional)")
 	fs.BoolVar(&cfg.Debug, "debug", false, "debug mode")
 
 	// Session
 	fs.StringVar(&cfg.SessionFile, "session", "session.yaml", "session config file (optional)")
+	profile := newProfileFlags(fs)
 
 	fsSession := flag.NewFlagSet("", flag.ExitOnError)
 	for _, fs := range []*flag.FlagSet{fs, fsSession} {
@@ -142,6 +270,7 @@ func newRefreshCommand() *ffcli.Command {
 		fs.StringVar(&cfg.Session.SuperProperties, "super-properties", "", "super properties")
 		fs.StringVar(&cfg.Session.Locale, "locale", "", "locale")
 		fs.StringVar(&cfg.Session.Cookie, "cookie", "", "cookie")
+		fs.StringVar(&cfg.Session.HTTP2, "http2", "", "http2 fingerprint in akamai format (optional)")
 	}
 
 	return &ffcli.Command{
@@ -155,19 +284,358 @@ func newRefreshCommand() *ffcli.Command {
 		ShortHelp: "refresh discord CDN URLs in a file",
 		FlagSet:   fs,
 		Exec: func(ctx context.Context, args []string) error {
-			loadSession(fsSession, cfg.SessionFile)
+			sessionFile, err := profile.sessionFile(fs, cfg.SessionFile)
+			if err != nil {
+				return err
+			}
+			if cfg.SessionFile, err = loadSession(fsSession, sessionFile); err != nil {
+				return fmt.Errorf("couldn't load session: %w", err)
+			}
 			return refresh.Run(ctx, cfg)
 		},
 	}
 }
 
+func newCheckSessionCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("check-session", flag.ExitOnError)
+	_ = fs.String("config", "bulkai.yaml", "config file (optional)")
+
+	cfg := &bulkai.Config{}
+	fs.StringVar(&cfg.Bot, "bot", "", "bot name")
+	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy address, or a list of proxies separated by commas (optional)")
+	fs.StringVar(&cfg.ProxyFile, "proxy-file", "", "file with a proxy address per line (optional)")
+	fs.Var((*fsStrings)(&cfg.CAFiles), "ca-file", "PEM file with certificates trusted in addition to the system ones, can be repeated (optional)")
+	fs.Var((*fsStrings)(&cfg.Pins), "pin", "base64 sha256 hash of a certificate public key that discord.com must present, can be repeated (optional)")
+	fs.BoolVar(&cfg.Insecure, "insecure", false, "disable TLS certificate verification, only for debugging (INSECURE)")
+	fs.StringVar(&cfg.Channel, "channel", "", "channel in format guid/channel (optional, if not provided DMs will be used)")
+	fs.BoolVar(&cfg.Debug, "debug", false, "debug mode")
+
+	// Backend specific flags
+	cfg.BotConfigs = map[string]interface{}{}
+	for _, name := range ai.Backends() {
+		backend, _ := ai.Lookup(name)
+		botCfg := backend.NewConfig()
+		if err := backend.RegisterFlags(fs, botCfg); err != nil {
+			panic(err)
+		}
+		cfg.BotConfigs[name] = botCfg
+	}
+
+	// Session
+	fs.StringVar(&cfg.SessionFile, "session", "session.yaml", "session config file (optional)")
+	profile := newProfileFlags(fs)
+
+	fsSession := flag.NewFlagSet("", flag.ExitOnError)
+	for _, fs := range []*flag.FlagSet{fs, fsSession} {
+		fs.StringVar(&cfg.Session.UserAgent, "user-agent", "", "user agent")
+		fs.StringVar(&cfg.Session.JA3, "ja3", "", "ja3 fingerprint")
+		fs.StringVar(&cfg.Session.Language, "language", "", "language")
+		fs.StringVar(&cfg.Session.Token, "token", "", "authentication token")
+		fs.StringVar(&cfg.Session.SuperProperties, "super-properties", "", "super properties")
+		fs.StringVar(&cfg.Session.Locale, "locale", "", "locale")
+		fs.StringVar(&cfg.Session.Cookie, "cookie", "", "cookie")
+		fs.StringVar(&cfg.Session.HTTP2, "http2", "", "http2 fingerprint in akamai format (optional)")
+	}
+
+	return &ffcli.Command{
+		Name:       "check-session",
+		ShortUsage: "bulkai check-session [flags] <key> <value data...>",
+		Options: []ff.Option{
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ffyaml.Parser),
+			ff.WithEnvVarPrefix("BULKAI"),
+			ff.WithIgnoreUndefined(true),
+		},
+		ShortHelp: "check that the session works without launching jobs",
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			sessionFile, err := profile.sessionFile(fs, cfg.SessionFile)
+			if err != nil {
+				return err
+			}
+			if cfg.SessionFile, err = loadSession(fsSession, sessionFile); err != nil {
+				return bulkai.NewCheckError("config", fmt.Errorf("couldn't load session: %w", err))
+			}
+			return bulkai.CheckSession(ctx, cfg)
+		},
+	}
+}
+
+func newFingerprintCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	_ = fs.String("config", "bulkai.yaml", "config file (optional)")
+
+	cfg := &bulkai.FingerprintConfig{}
+
+	// Session
+	fs.StringVar(&cfg.SessionFile, "session", "session.yaml", "session config file (optional)")
+	profile := newProfileFlags(fs)
+
+	fsSession := flag.NewFlagSet("", flag.ExitOnError)
+	for _, fs := range []*flag.FlagSet{fs, fsSession} {
+		fs.StringVar(&cfg.Session.UserAgent, "user-agent", "", "user agent")
+		fs.StringVar(&cfg.Session.JA3, "ja3", "", "ja3 fingerprint")
+		fs.StringVar(&cfg.Session.Language, "language", "", "language")
+		fs.StringVar(&cfg.Session.Token, "token", "", "authentication token")
+		fs.StringVar(&cfg.Session.SuperProperties, "super-properties", "", "super properties")
+		fs.StringVar(&cfg.Session.Locale, "locale", "", "locale")
+		fs.StringVar(&cfg.Session.Cookie, "cookie", "", "cookie")
+		fs.StringVar(&cfg.Session.HTTP2, "http2", "", "http2 fingerprint in akamai format (optional)")
+	}
+
+	return &ffcli.Command{
+		Name:       "fingerprint",
+		ShortUsage: "bulkai fingerprint [flags] <key> <value data...>",
+		Options: []ff.Option{
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ffyaml.Parser),
+			ff.WithEnvVarPrefix("BULKAI"),
+			ff.WithIgnoreUndefined(true),
+		},
+		ShortHelp: "check offline the tls and http2 fingerprint sent with the session",
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			sessionFile, err := profile.sessionFile(fs, cfg.SessionFile)
+			if err != nil {
+				return err
+			}
+			if cfg.SessionFile, err = loadSession(fsSession, sessionFile); err != nil {
+				return fmt.Errorf("couldn't load session: %w", err)
+			}
+			return bulkai.CheckFingerprint(ctx, cfg)
+		},
+	}
+}
+
+func newSessionCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "session",
+		ShortUsage: "bulkai session <subcommand>",
+		ShortHelp:  "manage session files and profiles",
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+		Subcommands: []*ffcli.Command{
+			newSessionListCommand(),
+			newSessionShowCommand(),
+			newSessionRemoveCommand(),
+			newSessionRenameCommand(),
+			newSessionDefaultCommand(),
+			newSessionCryptCommand("encrypt", "encrypt a session file with the passphrase from "+secret.KeyEnv+" or "+secret.KeyFileEnv, secret.EncryptFile),
+			newSessionCryptCommand("decrypt", "decrypt a session file with the passphrase from "+secret.KeyEnv+" or "+secret.KeyFileEnv, secret.DecryptFile),
+		},
+	}
+}
+
+func newSessionListCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+
+	return &ffcli.Command{
+		Name:       "list",
+		ShortUsage: "bulkai session list [flags]",
+		Options:    []ff.Option{ff.WithEnvVarPrefix("BULKAI")},
+		ShortHelp:  "list session profiles",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			list, err := session.NewProfiles(*dir).List()
+			if err != nil {
+				return err
+			}
+			if len(list) == 0 {
+				log.Printf("no profiles in %s\n", *dir)
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tUSER ID\tCREATED\tLAST USED\tBACKUPS")
+			for _, info := range list {
+				name := info.Name
+				if info.Default {
+					name += " (default)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", name, profileUserID(info), formatDate(info.Created), formatDate(info.LastUsed), len(info.Backups))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newSessionShowCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+
+	return &ffcli.Command{
+		Name:       "show",
+		ShortUsage: "bulkai session show [flags] <name>",
+		Options:    []ff.Option{ff.WithEnvVarPrefix("BULKAI")},
+		ShortHelp:  "show a session profile",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return flag.ErrHelp
+			}
+			info, err := session.NewProfiles(*dir).Info(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("name:      %s\n", info.Name)
+			fmt.Printf("file:      %s\n", info.Path)
+			fmt.Printf("user id:   %s\n", profileUserID(info))
+			fmt.Printf("encrypted: %t\n", info.Encrypted)
+			fmt.Printf("default:   %t\n", info.Default)
+			fmt.Printf("created:   %s\n", formatDate(info.Created))
+			fmt.Printf("last used: %s\n", formatDate(info.LastUsed))
+			fmt.Printf("backups:   %d\n", len(info.Backups))
+			for _, b := range info.Backups {
+				fmt.Printf("  %s\n", b)
+			}
+			if info.Err != nil {
+				fmt.Printf("error:     %v\n", info.Err)
+			}
+			return nil
+		},
+	}
+}
+
+func newSessionRemoveCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+
+	return &ffcli.Command{
+		Name:       "rm",
+		ShortUsage: "bulkai session rm [flags] <name>",
+		Options:    []ff.Option{ff.WithEnvVarPrefix("BULKAI")},
+		ShortHelp:  "remove a session profile and its backups",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return flag.ErrHelp
+			}
+			if err := session.NewProfiles(*dir).Remove(args[0]); err != nil {
+				return err
+			}
+			log.Printf("profile %s removed\n", args[0])
+			return nil
+		},
+	}
+}
+
+func newSessionRenameCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+
+	return &ffcli.Command{
+		Name:       "rename",
+		ShortUsage: "bulkai session rename [flags] <name> <new name>",
+		Options:    []ff.Option{ff.WithEnvVarPrefix("BULKAI")},
+		ShortHelp:  "rename a session profile",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 2 {
+				return flag.ErrHelp
+			}
+			if err := session.NewProfiles(*dir).Rename(args[0], args[1]); err != nil {
+				return err
+			}
+			log.Printf("profile %s renamed to %s\n", args[0], args[1])
+			return nil
+		},
+	}
+}
+
+func newSessionDefaultCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("default", flag.ExitOnError)
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+
+	return &ffcli.Command{
+		Name:       "default",
+		ShortUsage: "bulkai session default [flags] [name]",
+		Options:    []ff.Option{ff.WithEnvVarPrefix("BULKAI")},
+		ShortHelp:  "print or set the default session profile",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			profiles := session.NewProfiles(*dir)
+			switch len(args) {
+			case 0:
+				name, err := profiles.Default()
+				if err != nil {
+					return err
+				}
+				if name == "" {
+					return errors.New("no default profile")
+				}
+				fmt.Println(name)
+				return nil
+			case 1:
+				if err := profiles.SetDefault(args[0]); err != nil {
+					return err
+				}
+				log.Printf("default profile set to %s\n", args[0])
+				return nil
+			default:
+				return flag.ErrHelp
+			}
+		},
+	}
+}
+
+func profileUserID(info *session.Info) string {
+	switch {
+	case info.UserID != "":
+		return info.UserID
+	case info.Encrypted && info.Err != nil:
+		return "encrypted"
+	default:
+		return "unknown"
+	}
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func newSessionCryptCommand(name, help string, fn func(input, output string) error) *ffcli.Command {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	input := fs.String("session", "session.yaml", "session file")
+	profile := newProfileFlags(fs)
+	output := fs.String("output", "", "output file (optional, if not provided the session file is overwritten)")
+
+	return &ffcli.Command{
+		Name:       name,
+		ShortUsage: fmt.Sprintf("bulkai session %s [flags]", name),
+		Options:    []ff.Option{ff.WithEnvVarPrefix("BULKAI")},
+		ShortHelp:  help,
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			in, err := profile.sessionFile(fs, *input)
+			if err != nil {
+				return err
+			}
+			out := *output
+			if out == "" {
+				out = in
+			}
+			if err := fn(in, out); err != nil {
+				return err
+			}
+			log.Printf("session %sed to %s\n", name, out)
+			return nil
+		},
+	}
+}
+
 func newCreateSessionCommand() *ffcli.Command {
 	fs := flag.NewFlagSet("create-session", flag.ExitOnError)
 	_ = fs.String("config", "", "config file (optional)")
 
 	output := fs.String("output", "session.yaml", "output file (optional)")
 	proxy := fs.String("proxy", "", "proxy server (optional)")
-	profile := fs.Bool("profile", false, "use profile (optional)")
+	chromeProfile := fs.Bool("chrome-profile", false, "use chrome profile (optional)")
+	profile := fs.String("profile", "", "save the session to this profile instead of the output file (optional)")
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
 	return &ffcli.Command{
 		Name:       "create-session",
 		ShortUsage: "bulkai create-session [flags] <key> <value data...>",
@@ -179,7 +647,48 @@ func newCreateSessionCommand() *ffcli.Command {
 		ShortHelp: "create session using chrome",
 		FlagSet:   fs,
 		Exec: func(ctx context.Context, args []string) error {
-			return session.Run(ctx, *profile, *output, *proxy)
+			out := *output
+			if *profile != "" {
+				var err error
+				if out, err = session.NewProfiles(*dir).Create(*profile); err != nil {
+					return err
+				}
+			}
+			return createsession.Run(ctx, *chromeProfile, out, *proxy)
+		},
+	}
+}
+
+func newImportSessionCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("import-session", flag.ExitOnError)
+	_ = fs.String("config", "", "config file (optional)")
+
+	cfg := &importsession.Config{}
+	fs.StringVar(&cfg.Input, "input", "", "har file or file with a curl command of a discord api request, - reads from stdin")
+	fs.StringVar(&cfg.Output, "output", "session.yaml", "output file (optional)")
+	fs.StringVar(&cfg.JA3, "ja3", "", "ja3 fingerprint of the browser, defaults to the one of the browser of the user agent (optional)")
+	fs.StringVar(&cfg.HTTP2, "http2", "", "http2 fingerprint of the browser in akamai format (optional)")
+	profile := fs.String("profile", "", "save the session to this profile instead of the output file (optional)")
+	dir := fs.String("session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+	return &ffcli.Command{
+		Name:       "import-session",
+		ShortUsage: "bulkai import-session [flags] <key> <value data...>",
+		Options: []ff.Option{
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ff.PlainParser),
+			ff.WithEnvVarPrefix("BULKAI"),
+		},
+		ShortHelp: "import session from a har file or a curl command",
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if *profile != "" {
+				out, err := session.NewProfiles(*dir).Create(*profile)
+				if err != nil {
+					return err
+				}
+				cfg.Output = out
+			}
+			return importsession.Run(ctx, cfg)
 		},
 	}
 }
@@ -212,18 +721,75 @@ func newVersionCommand() *ffcli.Command {
 	}
 }
 
-func loadSession(fs *flag.FlagSet, file string) error {
+// loadSession sets the session flags from the file and returns the file.
+// If the file doesn't exist the session comes only from flags or environment
+// variables, and an empty file is returned so it isn't updated.
+func loadSession(fs *flag.FlagSet, file string) (string, error) {
 	if file == "" {
-		return fmt.Errorf("session file not specified")
+		return "", fmt.Errorf("session file not specified")
 	}
-	if _, err := os.Stat(file); err != nil {
-		return nil
+	data, err := session.NewStore(file).Load()
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
 	}
 	log.Printf("loading session from %s", file)
-	return ff.Parse(fs, []string{}, []ff.Option{
-		ff.WithConfigFile(file),
-		ff.WithConfigFileParser(ffyaml.Parser),
-	}...)
+	if err := ffyaml.Parser(bytes.NewReader(data), func(name, value string) error {
+		if session.IsMetadata(name) {
+			return nil
+		}
+		return fs.Set(name, value)
+	}); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// profileFlags selects a session profile instead of a session file.
+type profileFlags struct {
+	name string
+	dir  string
+}
+
+func newProfileFlags(fs *flag.FlagSet) *profileFlags {
+	p := &profileFlags{}
+	fs.StringVar(&p.name, "profile", "", "session profile, overrides the session file (optional)")
+	fs.StringVar(&p.dir, "session-dir", session.DefaultDir(), "directory of session profiles (optional)")
+	return p
+}
+
+// sessionFile returns the file of the profile if it is set.
+// Otherwise it returns the session file if it was set explicitly, or the
+// default profile if there is one.
+func (p *profileFlags) sessionFile(fs *flag.FlagSet, file string) (string, error) {
+	profiles := session.NewProfiles(p.dir)
+	if p.name != "" {
+		return profiles.Lookup(p.name)
+	}
+	var explicit bool
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "session" {
+			explicit = true
+		}
+	})
+	if explicit {
+		return file, nil
+	}
+	name, err := profiles.Default()
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return file, nil
+	}
+	path, err := profiles.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("default profile: %w", err)
+	}
+	log.Printf("using default profile %s\n", name)
+	return path, nil
 }
 
 type fsStrings []string
@@ -0,0 +1,97 @@
+package bulkai
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/fingerprint"
+	"github.com/igolaizola/bulkai/pkg/http"
+)
+
+type FingerprintConfig struct {
+	SessionFile string  `yaml:"session"`
+	Session     Session `yaml:"-"`
+}
+
+// CheckFingerprint sends a request with the http client of the session to a
+// local server, which observes its TLS and HTTP/2 fingerprint, and prints
+// the differences with the fingerprint of the session.
+// It works offline and doesn't use the session token.
+func CheckFingerprint(ctx context.Context, cfg *FingerprintConfig) error {
+	if cfg.Session.JA3 == "" || cfg.Session.UserAgent == "" {
+		return fmt.Errorf("missing ja3 or user agent in session")
+	}
+
+	srv, err := fingerprint.NewServer()
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	// The client must trust the certificate of the local server
+	dir, err := os.MkdirTemp("", "bulkai-fingerprint")
+	if err != nil {
+		return fmt.Errorf("couldn't create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, srv.CertificatePEM(), 0600); err != nil {
+		return fmt.Errorf("couldn't write certificate: %w", err)
+	}
+
+	client, err := http.NewClient(cfg.Session.JA3, cfg.Session.UserAgent, cfg.Session.Language, "",
+		http.WithHTTP2Fingerprint(cfg.Session.HTTP2),
+		http.WithTLSConfig(&http.TLSConfig{CAFiles: []string{ca}}),
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't create http client: %w", err)
+	}
+	defer func() { _ = http.Close(client) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(srv.URL())
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		errC <- err
+	}()
+	fp, err := srv.Next(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't capture fingerprint: %w", err)
+	}
+	if err := <-errC; err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	fmt.Printf("ja3:          %s\n", fp.JA3)
+	fmt.Printf("ja3 hash:     %s\n", fp.JA3Hash)
+	fmt.Printf("ja4:          %s\n", fp.JA4)
+	fmt.Printf("ja4_r:        %s\n", fp.JA4R)
+	fmt.Printf("protocol:     %s\n", fp.Protocol)
+	fmt.Printf("http2:        %s\n", fp.HTTP2)
+	fmt.Printf("header order: %s\n", strings.Join(fp.HeaderOrder, ", "))
+
+	diffs := fp.Diff(&fingerprint.Expected{
+		TLS:       cfg.Session.JA3,
+		UserAgent: cfg.Session.UserAgent,
+		HTTP2:     cfg.Session.HTTP2,
+	})
+	if len(diffs) == 0 {
+		log.Println("✅ observed fingerprint matches the session")
+		return nil
+	}
+	for _, d := range diffs {
+		log.Printf("❌ %s differs\n", d.Field)
+		fmt.Printf("- session:  %s\n", d.Expected)
+		fmt.Printf("+ observed: %s\n", d.Observed)
+	}
+	return fmt.Errorf("observed fingerprint differs from the session in %d fields", len(diffs))
+}
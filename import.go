@@ -0,0 +1,278 @@
+package bulkai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/ai"
+	"github.com/igolaizola/bulkai/pkg/ai/midjourney"
+	"github.com/igolaizola/bulkai/pkg/ai/niji"
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+type ImportConfig struct {
+	Debug          bool     `yaml:"debug"`
+	Bot            string   `yaml:"bot"`
+	Proxy          string   `yaml:"proxy"`
+	ProxyFile      string   `yaml:"proxy-file"`
+	CAFiles        []string `yaml:"ca-file"`
+	Pins           []string `yaml:"pin"`
+	Insecure       bool     `yaml:"insecure"`
+	Output         string   `yaml:"output"`
+	Album          string   `yaml:"album"`
+	Channel        string   `yaml:"channel"`
+	Upscale        bool     `yaml:"upscale"`
+	Download       bool     `yaml:"download"`
+	Thumbnail      bool     `yaml:"thumbnail"`
+	ThumbnailWidth int      `yaml:"thumbnail-width"`
+	Html           bool     `yaml:"html"`
+	// From and To filter messages by date, in format 2006-01-02 or RFC3339.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Prompt is a regular expression to filter messages by prompt.
+	Prompt      string  `yaml:"prompt"`
+	SessionFile string  `yaml:"session"`
+	Session     Session `yaml:"-"`
+}
+
+var importBots = map[string]midjourney.Bot{
+	midjourney.Midjourney.Name: midjourney.Midjourney,
+	niji.Bot.Name:              niji.Bot,
+}
+
+// Import creates an album from the images already generated in a channel.
+// If the album exists, only the images that aren't in the album are added.
+func Import(ctx context.Context, cfg *ImportConfig) error {
+	if err := cfg.Session.check(); err != nil {
+		return err
+	}
+	if cfg.Output == "" {
+		return errors.New("missing output directory")
+	}
+	bot, ok := importBots[strings.ToLower(cfg.Bot)]
+	if !ok {
+		return fmt.Errorf("unsupported bot for import: %s (available: midjourney, niji)", cfg.Bot)
+	}
+	from, err := parseDate(cfg.From, false)
+	if err != nil {
+		return fmt.Errorf("couldn't parse from date: %w", err)
+	}
+	to, err := parseDate(cfg.To, true)
+	if err != nil {
+		return fmt.Errorf("couldn't parse to date: %w", err)
+	}
+	var promptRegex *regexp.Regexp
+	if cfg.Prompt != "" {
+		promptRegex, err = regexp.Compile(cfg.Prompt)
+		if err != nil {
+			return fmt.Errorf("couldn't compile prompt regex: %w", err)
+		}
+	}
+
+	albumID := cfg.Album
+	if albumID == "" {
+		albumID = time.Now().UTC().Format("20060102_150405")
+	}
+	albumDir := fmt.Sprintf("%s/%s", cfg.Output, albumID)
+	imgDir := fmt.Sprintf("%s/images", albumDir)
+
+	// Load the album if it already exists
+	album := &Album{
+		ID:        albumID,
+		Status:    "created",
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+		Images:    []*Image{},
+	}
+	dataFile := fmt.Sprintf("%s/data.json", albumDir)
+	_, err = os.Stat(dataFile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("couldn't stat album data file: %w", err)
+	default:
+		data, err := os.ReadFile(dataFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read album data file: %w", err)
+		}
+		if err := json.Unmarshal(data, album); err != nil {
+			return fmt.Errorf("couldn't unmarshal album data file: %w", err)
+		}
+		log.Println("album resumed:", albumDir)
+	}
+	imported := make(map[string]struct{})
+	counts := make(map[string]int)
+	for _, image := range album.Images {
+		imported[strings.Split(image.URL, "?")[0]] = struct{}{}
+		counts[image.Prompt]++
+	}
+	promptIndex := make(map[string]int)
+	for i, prompt := range album.Prompts {
+		promptIndex[prompt] = i
+	}
+
+	if err := os.MkdirAll(albumDir, 0755); err != nil {
+		return fmt.Errorf("couldn't create album directory: %w", err)
+	}
+	if cfg.Download {
+		if err := os.MkdirAll(imgDir, 0755); err != nil {
+			return fmt.Errorf("couldn't create album images directory: %w", err)
+		}
+		if cfg.Thumbnail {
+			if err := os.MkdirAll(fmt.Sprintf("%s/_thumbnails", imgDir), 0755); err != nil {
+				return fmt.Errorf("couldn't create album images directory: %w", err)
+			}
+		}
+	}
+
+	// Create and start discord client
+	tlsCfg := NewTLSConfig(cfg.CAFiles, cfg.Pins, cfg.Insecure)
+	pool, err := NewProxyPool(ctx, cfg.Proxy, cfg.ProxyFile, tlsCfg)
+	if err != nil {
+		return err
+	}
+	client, closeClient, err := startClient(ctx, &cfg.Session, cfg.SessionFile, pool, tlsCfg, 0, cfg.Debug)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	channelID := cfg.Channel
+	if channelID == "" {
+		channelID = client.DM(bot.ID)
+		if channelID == "" {
+			return fmt.Errorf("couldn't find DM channel with %s bot", bot.Name)
+		}
+	}
+	if split := strings.SplitN(channelID, "/", 2); len(split) == 2 {
+		channelID = split[1]
+	}
+
+	after := "0"
+	if !from.IsZero() {
+		after = discord.SnowflakeFromTime(from)
+	}
+	status := "finished"
+	var total int
+	var sessionErr error
+	for done := false; !done; {
+		if ctx.Err() != nil {
+			status = "cancelled"
+			break
+		}
+		msgs, err := client.Messages(ctx, channelID, after)
+		if errors.Is(err, discord.ErrSessionInvalid) {
+			// Keep the imported images, the import can be resumed with a
+			// new session
+			status = "paused"
+			sessionErr = fmt.Errorf("couldn't get channel messages: %w", err)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't get channel messages: %w", err)
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for _, msg := range msgs {
+			after = msg.ID
+			if pastEnd(msg.Timestamp, to) {
+				done = true
+				break
+			}
+			if msg.Author == nil || msg.Author.ID != bot.ID {
+				continue
+			}
+			r, ok := midjourney.ParseMessage(msg)
+			if !ok {
+				continue
+			}
+			// Import upscales or previews depending on the configuration
+			if cfg.Upscale != (r.Kind == midjourney.Upscale) {
+				continue
+			}
+			if promptRegex != nil && !promptRegex.MatchString(r.Prompt) {
+				continue
+			}
+			if _, ok := imported[strings.Split(r.URL, "?")[0]]; ok {
+				continue
+			}
+
+			index, ok := promptIndex[r.Prompt]
+			if !ok {
+				index = len(album.Prompts)
+				promptIndex[r.Prompt] = index
+				album.Prompts = append(album.Prompts, r.Prompt)
+				album.Finished = append(album.Finished, index)
+			}
+			image := &ai.Image{
+				URL:         r.URL,
+				Prompt:      r.Prompt,
+				Preview:     !cfg.Upscale,
+				PromptIndex: index,
+				ImageIndex:  counts[r.Prompt],
+				IsLast:      true,
+			}
+			images := toImages(ctx, client, image, imgDir, cfg.Download, cfg.Upscale, cfg.Thumbnail, cfg.ThumbnailWidth)
+			for _, image := range images {
+				counts[image.Prompt]++
+				image.CreatedAt = msg.Timestamp.UTC()
+			}
+			album.Images = append(album.Images, images...)
+			imported[strings.Split(r.URL, "?")[0]] = struct{}{}
+			total += len(images)
+		}
+
+		// Save the album after each page
+		album.Status = "running"
+		album.UpdatedAt = time.Now().UTC()
+		if err := SaveAlbum(albumDir, album, cfg.Thumbnail, cfg.Html); err != nil {
+			return fmt.Errorf("couldn't save album: %w", err)
+		}
+		log.Printf("imported %d images\n", total)
+		// A page with less than 100 messages is the last one
+		if len(msgs) < 100 {
+			break
+		}
+	}
+
+	album.Status = status
+	if sessionErr == nil {
+		album.Percentage = 100
+	}
+	album.UpdatedAt = time.Now().UTC()
+	if err := SaveAlbum(albumDir, album, cfg.Thumbnail, cfg.Html); err != nil {
+		return fmt.Errorf("couldn't save album: %w", err)
+	}
+	log.Printf("album %s %s with %d new images\n", albumDir, album.Status, total)
+	return sessionErr
+}
+
+// parseDate parses a date in format 2006-01-02 or RFC3339.
+// If end is set, a date without time is moved to the start of the next day,
+// so the end of the range includes the whole day.
+func parseDate(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// pastEnd returns whether the timestamp is out of a range ending at the
+// given time, which is exclusive. A zero end means no limit.
+func pastEnd(ts, end time.Time) bool {
+	return !end.IsZero() && !ts.Before(end)
+}
@@ -0,0 +1,57 @@
+package bulkai
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value string
+		end   bool
+		want  time.Time
+	}{
+		{"", true, time.Time{}},
+		{"2024-05-01", false, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-01", true, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-01T12:30:00Z", true, time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseDate(tt.value, tt.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseDate(%q, %v) = %s, want %s", tt.value, tt.end, got, tt.want)
+		}
+	}
+	if _, err := parseDate("01/05/2024", false); err == nil {
+		t.Error("expected error with invalid date")
+	}
+}
+
+func TestPastEnd(t *testing.T) {
+	// A date-only end includes the whole day
+	end, err := parseDate("2024-05-01", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ts   time.Time
+		want bool
+	}{
+		{time.Date(2024, 4, 30, 23, 59, 59, 0, time.UTC), false},
+		{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 5, 1, 18, 45, 0, 0, time.UTC), false},
+		{time.Date(2024, 5, 1, 23, 59, 59, 999000000, time.UTC), false},
+		{time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		if got := pastEnd(tt.ts, end); got != tt.want {
+			t.Errorf("pastEnd(%s) = %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+	if pastEnd(time.Now(), time.Time{}) {
+		t.Error("zero end shouldn't limit the range")
+	}
+}
@@ -0,0 +1,100 @@
+package bulkai
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/igolaizola/bulkai/pkg/ai"
+)
+
+// processed is an image that has been downloaded and post-processed.
+type processed struct {
+	image  *ai.Image
+	images []*Image
+}
+
+// pipeline downloads and post-processes images using a bounded pool of
+// workers. Images are queued without limit, so the producer never waits for
+// the workers.
+type pipeline struct {
+	in      chan *ai.Image
+	results chan *processed
+	pending int64
+}
+
+func newPipeline(ctx context.Context, workers int, process func(context.Context, *ai.Image) []*Image) *pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &pipeline{
+		in:      make(chan *ai.Image),
+		results: make(chan *processed),
+	}
+	jobs := make(chan *ai.Image)
+
+	// Queue images until a worker is available
+	go func() {
+		var queue []*ai.Image
+		for {
+			var out chan *ai.Image
+			var next *ai.Image
+			if len(queue) > 0 {
+				out = jobs
+				next = queue[0]
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case image := <-p.in:
+				queue = append(queue, image)
+			case out <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+
+	// Launch workers
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case image := <-jobs:
+					images := process(ctx, image)
+					select {
+					case <-ctx.Done():
+						return
+					case p.results <- &processed{image: image, images: images}:
+					}
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Add queues an image to be processed.
+func (p *pipeline) Add(ctx context.Context, image *ai.Image) {
+	atomic.AddInt64(&p.pending, 1)
+	select {
+	case <-ctx.Done():
+	case p.in <- image:
+	}
+}
+
+// Results returns the channel of processed images.
+// Done must be called for each received result.
+func (p *pipeline) Results() <-chan *processed {
+	return p.results
+}
+
+// Done marks a result as consumed.
+func (p *pipeline) Done() {
+	atomic.AddInt64(&p.pending, -1)
+}
+
+// Pending returns the number of images queued or being processed.
+func (p *pipeline) Pending() int {
+	return int(atomic.LoadInt64(&p.pending))
+}
@@ -12,6 +12,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/igolaizola/bulkai/pkg/discord"
 )
 
 type Preview struct {
@@ -127,6 +129,10 @@ func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variati
 
 				// Launch preview
 				preview, err := imagine(cli, ctx, e.prompt)
+				if errors.Is(err, discord.ErrSessionInvalid) {
+					// Stop launching prompts, the session must be renewed
+					return
+				}
 				if err != nil {
 					log.Println(fmt.Errorf("❌ couldn't imagine %s %w", e.prompt, err))
 					continue
@@ -147,6 +153,9 @@ func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variati
 				for i := range preview.ImageIDs {
 					if upscaleEnabled {
 						u, err := upscale(cli, ctx, preview, i)
+						if errors.Is(err, discord.ErrSessionInvalid) {
+							return
+						}
 						if err != nil {
 							log.Println(fmt.Errorf("❌ couldn't upscale %s %d: %w", e.prompt, i, err))
 							continue
@@ -166,6 +175,9 @@ func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variati
 
 					// Get variation
 					variationPreview, err := variation(cli, ctx, preview, i)
+					if errors.Is(err, discord.ErrSessionInvalid) {
+						return
+					}
 					if err != nil {
 						log.Println(fmt.Errorf("❌ couldn't get variation: %w", err))
 						continue
@@ -187,6 +199,9 @@ func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variati
 					for j := range variationPreview.ImageIDs {
 						var u string
 						u, err := upscale(cli, ctx, variationPreview, j)
+						if errors.Is(err, discord.ErrSessionInvalid) {
+							return
+						}
 						if err != nil {
 							log.Println(fmt.Errorf("❌ couldn't upscale %s %d: %w", e.prompt, j, err))
 							continue
@@ -307,6 +322,10 @@ func retry(ctx context.Context, fn func(context.Context) error) error {
 		if err == nil {
 			return nil
 		}
+		// If the session is invalid, retrying won't help
+		if errors.Is(err, discord.ErrSessionInvalid) {
+			return err
+		}
 		var aiErr Error
 		// If the error is fatal, stop everything
 		if errors.As(err, &aiErr) && aiErr.Fatal() {
@@ -321,8 +340,9 @@ func retry(ctx context.Context, fn func(context.Context) error) error {
 		if attempts >= maxAttempts {
 			return err
 		}
-		// If the error is not a context deadline exceeded, wait before retrying
-		if !errors.Is(err, context.DeadlineExceeded) {
+		// If the error is not a context deadline exceeded or a lost gateway
+		// session, wait before retrying
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, discord.ErrSessionLost) {
 			log.Println("waiting and retrying...", err)
 			select {
 			case <-time.After(10 * time.Minute):
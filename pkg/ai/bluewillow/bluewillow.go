@@ -39,9 +39,28 @@ type Client struct {
 }
 
 type Config struct {
-	Debug     bool
-	ChannelID string
-	Timeout   time.Duration
+	Debug     bool          `yaml:"-"`
+	ChannelID string        `yaml:"-"`
+	Timeout   time.Duration `yaml:"timeout" usage:"timeout to receive a message from the bot (optional)"`
+}
+
+func init() {
+	ai.Register(ai.Backend{
+		Name: "bluewillow",
+		Capabilities: ai.Capabilities{
+			Upscale:   true,
+			Variation: true,
+		},
+		Config: func() interface{} {
+			return &Config{}
+		},
+		New: func(client *discord.Client, opts *ai.Options, cfg interface{}) (ai.Client, error) {
+			c := *cfg.(*Config)
+			c.ChannelID = opts.ChannelID
+			c.Debug = opts.Debug
+			return New(client, &c)
+		},
+	})
 }
 
 func New(client *discord.Client, cfg *Config) (ai.Client, error) {
@@ -86,7 +105,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 
 	c.c.OnEvent(func(e *discordgo.Event) {
 		switch e.Type {
-		case discord.MessageCreateEvent, discord.MessageUpdateEvent:
+		case discord.MessageCreateEvent, discord.MessageUpdateEvent, discord.MessageHistoryEvent:
 			var msg discord.Message
 			if err := json.Unmarshal(e.RawData, &msg); err != nil {
 				log.Println("bluewillow: couldn't unmarshal message: %w", err)
@@ -264,6 +283,9 @@ func (c *Client) receiveMessage(parent context.Context, key search, timeout time
 	})
 	c.lck.Unlock()
 
+	// Get the next reconnection before sending anything to the bot
+	reconnection := c.c.Reconnection()
+
 	// Execute the function if any
 	if fn != nil {
 		if err := fn(); err != nil {
@@ -272,14 +294,30 @@ func (c *Client) receiveMessage(parent context.Context, key search, timeout time
 	}
 
 	// Add a timeout to receive the message
-	ctx, cancel := context.WithTimeout(parent, timeout)
-	defer cancel()
-
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case msg := <-msgChan:
-		return msg, nil
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-parent.Done():
+			return nil, parent.Err()
+		case <-timer.C:
+			return nil, context.DeadlineExceeded
+		case msg := <-msgChan:
+			return msg, nil
+		case <-reconnection.Done():
+			// If the session wasn't resumed, the message may have been lost
+			if !reconnection.Resumed() {
+				return nil, fmt.Errorf("bluewillow: %w", discord.ErrSessionLost)
+			}
+			// Missed messages are replayed after resuming, so we restart the
+			// timeout because the bot couldn't reach us while disconnected
+			reconnection = c.c.Reconnection()
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		}
 	}
 }
 
@@ -341,6 +379,9 @@ func (c *Client) Start(ctx context.Context) error {
 		return fmt.Errorf("bluewillow: couldn't find imagine command")
 	}
 	c.cmd = cmd
+
+	// Backfill the channel history after reconnections
+	c.c.Watch(c.channelID)
 	return nil
 }
 
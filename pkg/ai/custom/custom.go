@@ -0,0 +1,512 @@
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/bwmarrin/snowflake"
+	"github.com/igolaizola/bulkai/pkg/ai"
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+type Client struct {
+	c         *discord.Client
+	def       *Definition
+	debug     bool
+	node      *snowflake.Node
+	callback  map[search][]func(*discord.Message) bool
+	cache     map[string]struct{}
+	lck       sync.Mutex
+	channelID string
+	guildID   string
+	cmd       *discordgo.ApplicationCommand
+}
+
+type Config struct {
+	Debug      bool        `yaml:"-"`
+	ChannelID  string      `yaml:"-"`
+	Definition *Definition `yaml:"-"`
+	// DefinitionFile is used to load the definition if it isn't provided.
+	DefinitionFile string `yaml:"definition" usage:"bot definition file"`
+}
+
+func init() {
+	ai.Register(ai.Backend{
+		Name: "custom",
+		Capabilities: ai.Capabilities{
+			Upscale:   true,
+			Variation: true,
+		},
+		Config: func() interface{} {
+			return &Config{}
+		},
+		New: func(client *discord.Client, opts *ai.Options, cfg interface{}) (ai.Client, error) {
+			c := *cfg.(*Config)
+			c.ChannelID = opts.ChannelID
+			c.Debug = opts.Debug
+			return New(client, &c)
+		},
+	})
+}
+
+func New(client *discord.Client, cfg *Config) (ai.Client, error) {
+	def := cfg.Definition
+	if def == nil {
+		if cfg.DefinitionFile == "" {
+			return nil, errors.New("custom: missing definition")
+		}
+		var err error
+		def, err = Load(cfg.DefinitionFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if def.contentRegex == nil {
+		if err := def.init(); err != nil {
+			return nil, fmt.Errorf("custom: invalid definition: %w", err)
+		}
+	}
+
+	node, err := snowflake.NewNode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't create snowflake node", def.Name)
+	}
+
+	channelID := cfg.ChannelID
+	if channelID == "" {
+		channelID = client.DM(def.BotID)
+		if channelID == "" {
+			return nil, fmt.Errorf("%s: couldn't find dm channel for bot", def.Name)
+		}
+	}
+
+	guildID := ""
+	if split := strings.SplitN(channelID, "/", 2); len(split) == 2 {
+		guildID = split[0]
+		channelID = split[1]
+	}
+	if guildID != "" {
+		client.Referer = fmt.Sprintf("channels/%s/%s", guildID, channelID)
+	} else {
+		client.Referer = fmt.Sprintf("channels/@me/%s", channelID)
+	}
+
+	c := &Client{
+		c:         client,
+		def:       def,
+		debug:     cfg.Debug,
+		node:      node,
+		callback:  make(map[search][]func(*discord.Message) bool),
+		cache:     make(map[string]struct{}),
+		channelID: channelID,
+		guildID:   guildID,
+	}
+
+	c.c.OnEvent(func(e *discordgo.Event) {
+		switch e.Type {
+		case discord.MessageCreateEvent, discord.MessageUpdateEvent, discord.MessageHistoryEvent:
+			var msg discord.Message
+			if err := json.Unmarshal(e.RawData, &msg); err != nil {
+				log.Printf("%s: couldn't unmarshal message: %v\n", c.def.Name, err)
+				return
+			}
+			// Ignore messages from other channels
+			if msg.ChannelID != c.channelID {
+				return
+			}
+			c.debugLog(e.Type, e.RawData)
+
+			// Only attachment based messages are processed
+			if len(msg.Attachments) == 0 {
+				return
+			}
+
+			// Ignore attachments of images that are not finished
+			if c.def.isIgnored(msg.Attachments[0].ContentType) {
+				return
+			}
+
+			// Ignore message already in the cache
+			cacheID := cleanURL(msg.Attachments[0].URL)
+			c.lck.Lock()
+			_, ok := c.cache[cacheID]
+			c.lck.Unlock()
+			if ok {
+				return
+			}
+
+			// Parse prompt
+			prompt, rest, ok := c.def.parseContent(msg.Content)
+			if !ok {
+				return
+			}
+			prompt = replaceLinks(prompt)
+
+			var key search
+			switch {
+			case c.def.isUpscale(rest):
+				key = upscaleSearch(prompt)
+			case c.def.isVariation(rest):
+				// Ignore messages that don't have preview data
+				if len(msg.Components) == 0 {
+					return
+				}
+				key = variationSearch(prompt)
+			default:
+				// Ignore messages that don't have preview data
+				if len(msg.Components) == 0 {
+					return
+				}
+				key = previewSearch(prompt)
+			}
+
+			// Search for matching callbacks
+			for {
+				c.lck.Lock()
+				callbacks := c.callback[key]
+				if len(callbacks) == 0 {
+					c.lck.Unlock()
+					return
+				}
+				// Get and remove the first callback
+				f := callbacks[0]
+				c.callback[key] = callbacks[1:]
+				c.lck.Unlock()
+
+				// Launch the callback
+				if ok := f(&msg); !ok {
+					// If returns false, it means it was expired
+					continue
+				}
+
+				// Add the message to the cache
+				c.lck.Lock()
+				c.cache[cacheID] = struct{}{}
+				c.lck.Unlock()
+				return
+			}
+		}
+	})
+	return c, nil
+}
+
+func (c *Client) Concurrency() int {
+	return c.def.Concurrency
+}
+
+func (c *Client) debugLog(t string, v interface{}) {
+	if !c.debug {
+		return
+	}
+	if v == nil {
+		log.Println(t)
+		return
+	}
+	js, _ := json.Marshal(v)
+	log.Println(t, string(js))
+}
+
+type search interface {
+	value() string
+}
+
+type previewSearch string
+
+func (s previewSearch) value() string {
+	return string(s)
+}
+
+type upscaleSearch string
+
+func (s upscaleSearch) value() string {
+	return string(s)
+}
+
+type variationSearch string
+
+func (s variationSearch) value() string {
+	return string(s)
+}
+
+func (c *Client) receiveMessage(parent context.Context, key search, fn func() error) (*discord.Message, error) {
+	msgChan := make(chan *discord.Message)
+	defer close(msgChan)
+	c.lck.Lock()
+	c.callback[key] = append(c.callback[key], func(m *discord.Message) bool {
+		// Check if channel is still open
+		select {
+		case <-msgChan:
+			return false
+		default:
+		}
+		// Send the message
+		msgChan <- m
+		return true
+	})
+	c.lck.Unlock()
+
+	// Get the next reconnection before sending anything to the bot
+	reconnection := c.c.Reconnection()
+
+	// Execute the function if any
+	if fn != nil {
+		if err := fn(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add a timeout to receive the message
+	timer := time.NewTimer(c.def.Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-parent.Done():
+			return nil, parent.Err()
+		case <-timer.C:
+			return nil, context.DeadlineExceeded
+		case msg := <-msgChan:
+			return msg, nil
+		case <-reconnection.Done():
+			// If the session wasn't resumed, the message may have been lost
+			if !reconnection.Resumed() {
+				return nil, fmt.Errorf("custom: %w", discord.ErrSessionLost)
+			}
+			// Missed messages are replayed after resuming, so we restart the
+			// timeout because the bot couldn't reach us while disconnected
+			reconnection = c.c.Reconnection()
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(c.def.Timeout)
+		}
+	}
+}
+
+func (c *Client) Start(ctx context.Context) error {
+	var appSearch discord.ApplicationCommandSearch
+
+	name := c.def.Name
+	botID := c.def.BotID
+	switch c.guildID {
+	case "":
+		// Search for command in a DM channel
+		u := fmt.Sprintf("users/%s/profile?with_mutual_guilds=false&with_mutual_friends_count=false", botID)
+		var user discord.User
+		resp, err := c.c.Do(ctx, "GET", u, nil)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't get user %s: %w", name, botID, err)
+		}
+		if err := json.Unmarshal(resp, &user); err != nil {
+			return fmt.Errorf("%s: couldn't unmarshal user %s: %w", name, string(resp), err)
+		}
+		if user.Application.ID == "" {
+			return fmt.Errorf("%s: couldn't find application id for user %s", name, botID)
+		}
+
+		u = fmt.Sprintf("channels/%s/application-command-index", c.channelID)
+		resp, err = c.c.Do(ctx, "GET", u, nil)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't get channel application commands: %w", name, err)
+		}
+		if err := json.Unmarshal(resp, &appSearch); err != nil {
+			return fmt.Errorf("%s: couldn't unmarshal application command search %s: %w", name, string(resp), err)
+		}
+	default:
+		// Search for command in a guild channel
+		u := fmt.Sprintf("guilds/%s/application-command-index", c.guildID)
+		resp, err := c.c.Do(ctx, "GET", u, nil)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't get guild application commands: %w", name, err)
+		}
+		if err := json.Unmarshal(resp, &appSearch); err != nil {
+			return fmt.Errorf("%s: couldn't unmarshal application command search %s: %w", name, string(resp), err)
+		}
+	}
+
+	command := c.def.Command
+	var cmd *discordgo.ApplicationCommand
+	for _, c := range appSearch.Commands {
+		if c.ApplicationID != botID {
+			continue
+		}
+		if c.Name != command {
+			continue
+		}
+		cmd = c
+		break
+	}
+	if cmd == nil {
+		return fmt.Errorf("%s: couldn't find %s command", name, command)
+	}
+	c.cmd = cmd
+
+	// Backfill the channel history after reconnections
+	c.c.Watch(c.channelID)
+	return nil
+}
+
+func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error) {
+	options := []*discordgo.ApplicationCommandInteractionDataOption{
+		{
+			Type:  discordgo.ApplicationCommandOptionString,
+			Name:  c.def.PromptOption,
+			Value: prompt,
+		},
+	}
+	for _, o := range c.def.Options {
+		typ, _ := o.optionType()
+		options = append(options, &discordgo.ApplicationCommandInteractionDataOption{
+			Type:  typ,
+			Name:  o.Name,
+			Value: o.Value,
+		})
+	}
+
+	nonce := c.node.Generate().String()
+	imagine := &discord.InteractionCommand{
+		Type:          2,
+		ApplicationID: c.cmd.ApplicationID,
+		ChannelID:     c.channelID,
+		GuildID:       c.guildID,
+		SessionID:     c.c.Session(),
+		Data: discord.InteractionCommandData{
+			Version:            c.cmd.Version,
+			ID:                 c.cmd.ID,
+			Name:               c.cmd.Name,
+			Type:               1,
+			Options:            options,
+			ApplicationCommand: c.cmd,
+		},
+		Nonce: nonce,
+	}
+	c.debugLog("IMAGINE", imagine)
+
+	// The bot may change the links of the prompt, so we replace them with
+	// placeholders.
+	responsePrompt := replaceLinks(prompt)
+
+	preview, err := c.receiveMessage(ctx, previewSearch(responsePrompt), func() error {
+		// Launch interaction inside the receive message process because the
+		// response may be received before it finishes, due to rate limit
+		// locking.
+		if _, err := c.c.Do(ctx, "POST", "interactions", imagine); err != nil {
+			return fmt.Errorf("%s: couldn't send %s interaction: %w", c.def.Name, c.def.Command, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't receive links message: %w", c.def.Name, err)
+	}
+
+	imageIDs := c.imageIDs(preview)
+	if len(imageIDs) == 0 {
+		return nil, fmt.Errorf("%s: message has no image ids", c.def.Name)
+	}
+	return &ai.Preview{
+		URL:            preview.Attachments[0].URL,
+		Prompt:         prompt,
+		ResponsePrompt: responsePrompt,
+		MessageID:      preview.ID,
+		ImageIDs:       imageIDs,
+	}, nil
+}
+
+func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([]string, error) {
+	msg, err := c.click(ctx, preview, index, c.def.UpscaleID, upscaleSearch(preview.ResponsePrompt))
+	if err != nil {
+		return nil, err
+	}
+	return []string{msg.Attachments[0].URL}, nil
+}
+
+func (c *Client) Variation(ctx context.Context, preview *ai.Preview, index int) (*ai.Preview, error) {
+	if c.def.VariationID == "" {
+		return nil, ai.NewError(fmt.Errorf("%s: variation not supported", c.def.Name), false)
+	}
+	msg, err := c.click(ctx, preview, index, c.def.VariationID, variationSearch(preview.ResponsePrompt))
+	if err != nil {
+		return nil, err
+	}
+	imageIDs := c.imageIDs(msg)
+	if len(imageIDs) == 0 {
+		return nil, fmt.Errorf("%s: message has no image ids", c.def.Name)
+	}
+	return &ai.Preview{
+		URL:            msg.Attachments[0].URL,
+		Prompt:         preview.Prompt,
+		ResponsePrompt: preview.ResponsePrompt,
+		MessageID:      msg.ID,
+		ImageIDs:       imageIDs,
+	}, nil
+}
+
+// click sends a button interaction and waits for the resulting message.
+func (c *Client) click(ctx context.Context, preview *ai.Preview, index int, prefix string, key search) (*discord.Message, error) {
+	if index < 0 || index >= len(preview.ImageIDs) {
+		return nil, fmt.Errorf("%s: invalid index %d", c.def.Name, index)
+	}
+	customID := fmt.Sprintf("%s%s", prefix, preview.ImageIDs[index])
+	nonce := c.node.Generate().String()
+	click := &discord.InteractionComponent{
+		Type:          3,
+		ApplicationID: c.cmd.ApplicationID,
+		ChannelID:     c.channelID,
+		GuildID:       c.guildID,
+		SessionID:     c.c.Session(),
+		Data: discord.InteractionComponentData{
+			ComponentType: 2,
+			CustomID:      customID,
+		},
+		Nonce:     nonce,
+		MessageID: preview.MessageID,
+	}
+	c.debugLog("CLICK", click)
+
+	msg, err := c.receiveMessage(ctx, key, func() error {
+		// Launch interaction inside the receive message process because the
+		// response may be received before it finishes, due to rate limit
+		// locking.
+		if _, err := c.c.Do(ctx, "POST", "interactions", click); err != nil {
+			return fmt.Errorf("%s: couldn't send %s interaction: %w", c.def.Name, customID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't receive links message: %w", c.def.Name, err)
+	}
+	return msg, nil
+}
+
+// imageIDs returns the image IDs from the upscale buttons of a message.
+func (c *Client) imageIDs(msg *discord.Message) []string {
+	var imageIDs []string
+	for _, comps := range msg.Components {
+		for _, comp := range comps.Components {
+			if !strings.HasPrefix(comp.CustomID, c.def.UpscaleID) {
+				continue
+			}
+			imageIDs = append(imageIDs, strings.TrimPrefix(comp.CustomID, c.def.UpscaleID))
+		}
+	}
+	return imageIDs
+}
+
+var linkRegex = regexp.MustCompile(`https?://[^\s]+`)
+var linkWrappedRegex = regexp.MustCompile(`<https?://[^\s]+>`)
+
+func replaceLinks(s string) string {
+	s = linkWrappedRegex.ReplaceAllString(s, "<LINK>")
+	return linkRegex.ReplaceAllString(s, "<LINK>")
+}
+
+func cleanURL(u string) string {
+	return strings.Split(u, "?")[0]
+}
@@ -0,0 +1,175 @@
+package custom
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gopkg.in/yaml.v2"
+)
+
+// Definition describes a discord image bot that works like midjourney:
+// a slash command is used to send the prompt and the results are messages
+// with attachments and buttons to upscale or get variations.
+type Definition struct {
+	// Name of the bot, used in logs and errors.
+	Name string `yaml:"name"`
+	// BotID is the discord user ID of the bot.
+	BotID string `yaml:"bot-id"`
+	// Command is the name of the slash command (default: imagine).
+	Command string `yaml:"command"`
+	// PromptOption is the name of the command option used to send the prompt
+	// (default: prompt).
+	PromptOption string `yaml:"prompt-option"`
+	// Options are extra command options sent with every prompt.
+	Options []Option `yaml:"options"`
+	// Content is a regular expression used to parse the message content.
+	// It must contain a named group `prompt` and may contain a named group
+	// `rest` where the upscale and variation terms are searched.
+	// The default value parses messages like `**prompt** rest`.
+	Content string `yaml:"content"`
+	// UpscaleTerms identify upscale messages.
+	UpscaleTerms []string `yaml:"upscale-terms"`
+	// VariationTerms identify variation messages.
+	VariationTerms []string `yaml:"variation-terms"`
+	// UpscaleID is the custom ID prefix of the upscale buttons.
+	UpscaleID string `yaml:"upscale-id"`
+	// VariationID is the custom ID prefix of the variation buttons.
+	VariationID string `yaml:"variation-id"`
+	// IgnoreContentTypes are attachment content types of unfinished images
+	// that must be ignored (e.g. image/webp).
+	IgnoreContentTypes []string `yaml:"ignore-content-types"`
+	// Concurrency is the maximum number of concurrent jobs (default: 1).
+	Concurrency int `yaml:"concurrency"`
+	// Timeout to receive a message from the bot (default: 10m).
+	Timeout time.Duration `yaml:"timeout"`
+
+	contentRegex *regexp.Regexp
+}
+
+// Option is a static command option.
+type Option struct {
+	Name string `yaml:"name"`
+	// Type of the option: string, integer, boolean or number
+	// (default: string).
+	Type  string      `yaml:"type"`
+	Value interface{} `yaml:"value"`
+}
+
+const defaultContent = `(?s)^[^*]*\*\*(?P<prompt>.+?)\*\*(?P<rest>.*)$`
+
+// Load reads a definition from a YAML file.
+func Load(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("custom: couldn't read definition: %w", err)
+	}
+	var def Definition
+	if err := yaml.UnmarshalStrict(data, &def); err != nil {
+		return nil, fmt.Errorf("custom: couldn't unmarshal definition %s: %w", path, err)
+	}
+	if err := def.init(); err != nil {
+		return nil, fmt.Errorf("custom: invalid definition %s: %w", path, err)
+	}
+	return &def, nil
+}
+
+func (d *Definition) init() error {
+	if d.Name == "" {
+		return errors.New("missing name")
+	}
+	if d.BotID == "" {
+		return errors.New("missing bot id")
+	}
+	if d.UpscaleID == "" {
+		return errors.New("missing upscale id")
+	}
+	if d.Command == "" {
+		d.Command = "imagine"
+	}
+	if d.PromptOption == "" {
+		d.PromptOption = "prompt"
+	}
+	if d.Content == "" {
+		d.Content = defaultContent
+	}
+	if d.Concurrency <= 0 {
+		d.Concurrency = 1
+	}
+	if d.Timeout == 0 {
+		d.Timeout = 10 * time.Minute
+	}
+	for _, o := range d.Options {
+		if _, err := o.optionType(); err != nil {
+			return err
+		}
+	}
+	reg, err := regexp.Compile(d.Content)
+	if err != nil {
+		return fmt.Errorf("couldn't compile content regex: %w", err)
+	}
+	if reg.SubexpIndex("prompt") < 0 {
+		return errors.New("content regex must have a prompt group")
+	}
+	d.contentRegex = reg
+	return nil
+}
+
+func (o Option) optionType() (discordgo.ApplicationCommandOptionType, error) {
+	switch strings.ToLower(o.Type) {
+	case "", "string":
+		return discordgo.ApplicationCommandOptionString, nil
+	case "integer":
+		return discordgo.ApplicationCommandOptionInteger, nil
+	case "boolean":
+		return discordgo.ApplicationCommandOptionBoolean, nil
+	case "number":
+		return discordgo.ApplicationCommandOptionNumber, nil
+	default:
+		return 0, fmt.Errorf("unsupported option type %s for %s", o.Type, o.Name)
+	}
+}
+
+// parseContent returns the prompt and the rest of the content.
+func (d *Definition) parseContent(content string) (string, string, bool) {
+	match := d.contentRegex.FindStringSubmatch(content)
+	if match == nil {
+		return "", "", false
+	}
+	prompt := match[d.contentRegex.SubexpIndex("prompt")]
+	var rest string
+	if idx := d.contentRegex.SubexpIndex("rest"); idx >= 0 {
+		rest = match[idx]
+	}
+	return prompt, rest, true
+}
+
+func (d *Definition) isUpscale(rest string) bool {
+	return containsAny(rest, d.UpscaleTerms)
+}
+
+func (d *Definition) isVariation(rest string) bool {
+	return containsAny(rest, d.VariationTerms)
+}
+
+func (d *Definition) isIgnored(contentType string) bool {
+	for _, t := range d.IgnoreContentTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(s string, terms []string) bool {
+	for _, t := range terms {
+		if strings.Contains(s, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package custom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	def, err := Load("testdata/bluewillow.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Command != "imagine" || def.PromptOption != "prompt" {
+		t.Errorf("unexpected command %s %s", def.Command, def.PromptOption)
+	}
+	if def.Concurrency != 5 {
+		t.Errorf("got concurrency %d, want 5", def.Concurrency)
+	}
+	if def.Timeout != 10*time.Minute {
+		t.Errorf("got timeout %s, want 10m", def.Timeout)
+	}
+	if !def.isIgnored("image/webp") {
+		t.Error("image/webp should be ignored")
+	}
+}
+
+func TestParseContent(t *testing.T) {
+	def, err := Load("testdata/bluewillow.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		content   string
+		prompt    string
+		upscale   bool
+		variation bool
+		ok        bool
+	}{
+		{
+			content: "**cute cat** - <@123456> (fast)",
+			prompt:  "cute cat",
+			ok:      true,
+		},
+		{
+			content: "**cute cat** - Upscaling by <@123456>",
+			prompt:  "cute cat",
+			upscale: true,
+			ok:      true,
+		},
+		{
+			content:   "**cute cat** - Variations by <@123456>",
+			prompt:    "cute cat",
+			variation: true,
+			ok:        true,
+		},
+		{
+			content: "no prompt here",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			prompt, rest, ok := def.parseContent(tt.content)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if prompt != tt.prompt {
+				t.Errorf("got prompt %q, want %q", prompt, tt.prompt)
+			}
+			if got := def.isUpscale(rest); got != tt.upscale {
+				t.Errorf("got upscale %v, want %v", got, tt.upscale)
+			}
+			if got := def.isVariation(rest); got != tt.variation {
+				t.Errorf("got variation %v, want %v", got, tt.variation)
+			}
+		})
+	}
+}
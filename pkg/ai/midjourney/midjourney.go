@@ -21,18 +21,46 @@ import (
 )
 
 const (
-	botID               = "936929561302675456"
-	upscaleTerm         = "Upscaled by"
-	imageNumberTerm     = "Image #"
-	variationTerm       = "Variations by"
-	variationSubtleTerm = "Variations (Subtle) by"
-	variationStrongTerm = "Variations (Strong) by"
-	upscaleID           = "MJ::JOB::upsample::"
-	variationID         = "MJ::JOB::variation::"
+	imageNumberTerm = "Image #"
+	upscaleID       = "MJ::JOB::upsample::"
+	variationID     = "MJ::JOB::variation::"
+	// soloSuffix is appended to the custom id of the buttons that act on a
+	// single image, like the ones of upscaled images or the niji reroll.
+	soloSuffix = "::SOLO"
 )
 
+// Result terms may include the mode between parentheses, such as
+// "Upscaled (Subtle) by" or "Variations (Strong) by", which niji・journey
+// uses for all its upscales.
+var (
+	upscaleRegex   = regexp.MustCompile(`Upscaled( \([^)]+\))? by`)
+	variationRegex = regexp.MustCompile(`Variations( \([^)]+\))? by`)
+)
+
+// Bot describes a discord application that works like the midjourney bot.
+type Bot struct {
+	// Name of the bot.
+	Name string
+	// ID is the discord user ID of the bot.
+	ID string
+	// CDN is the format of the image URLs in the bot CDN. It receives the job
+	// ID and the zero based index of the image.
+	CDN string
+	// Concurrency is the maximum number of concurrent jobs.
+	Concurrency int
+}
+
+// Midjourney is the midjourney bot.
+var Midjourney = Bot{
+	Name:        "midjourney",
+	ID:          "936929561302675456",
+	CDN:         "https://cdn.midjourney.com/%s/0_%d.png",
+	Concurrency: 12,
+}
+
 type Client struct {
 	c              *discord.Client
+	bot            Bot
 	debug          bool
 	node           *snowflake.Node
 	callback       map[search][]func(*discord.Message) bool
@@ -48,28 +76,59 @@ type Client struct {
 	timeout        time.Duration
 	queuedTimeout  time.Duration
 	midjourneyCDN  bool
+	since          time.Time
+	history        map[search][]*discord.Message
 }
 
 type Config struct {
-	Debug          bool
-	ChannelID      string
-	ReplicateToken string
-	Timeout        time.Duration
-	QueuedTimeout  time.Duration
-	MidjourneyCDN  bool
+	Debug          bool          `yaml:"-"`
+	ChannelID      string        `yaml:"-"`
+	ReplicateToken string        `yaml:"replicate-token" usage:"replicate token to solve captchas (optional)"`
+	Timeout        time.Duration `yaml:"timeout" usage:"timeout to receive a message from the bot (optional)"`
+	QueuedTimeout  time.Duration `yaml:"queued-timeout" usage:"timeout to receive a message of a queued job (optional)"`
+	MidjourneyCDN  bool          `yaml:"cdn" usage:"use midjourney cdn instead of discord cdn"`
+	// Bot to be used, if nil the midjourney bot is used.
+	Bot *Bot `yaml:"-"`
+	// Since is the time from which the channel history is backfilled.
+	Since time.Time `yaml:"-"`
+}
+
+func init() {
+	ai.Register(ai.Backend{
+		Name: "midjourney",
+		Capabilities: ai.Capabilities{
+			Upscale:   true,
+			Variation: true,
+		},
+		Config: func() interface{} {
+			return &Config{}
+		},
+		New: func(client *discord.Client, opts *ai.Options, cfg interface{}) (ai.Client, error) {
+			c := *cfg.(*Config)
+			c.ChannelID = opts.ChannelID
+			c.Debug = opts.Debug
+			c.Since = opts.Since
+			return New(client, &c)
+		},
+	})
 }
 
 func New(client *discord.Client, cfg *Config) (ai.Client, error) {
+	bot := Midjourney
+	if cfg.Bot != nil {
+		bot = *cfg.Bot
+	}
+
 	node, err := snowflake.NewNode(0)
 	if err != nil {
-		return nil, fmt.Errorf("midjourney: couldn't create snowflake node")
+		return nil, fmt.Errorf("%s: couldn't create snowflake node", bot.Name)
 	}
 
 	channelID := cfg.ChannelID
 	if channelID == "" {
-		channelID = client.DM(botID)
+		channelID = client.DM(bot.ID)
 		if channelID == "" {
-			return nil, fmt.Errorf("midjourney: couldn't find dm channel for bot")
+			return nil, fmt.Errorf("%s: couldn't find dm channel for bot", bot.Name)
 		}
 	}
 
@@ -95,6 +154,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 
 	c := &Client{
 		c:              client,
+		bot:            bot,
 		debug:          cfg.Debug,
 		node:           node,
 		callback:       make(map[search][]func(*discord.Message) bool),
@@ -106,14 +166,17 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 		timeout:        timeout,
 		queuedTimeout:  queuedTimeout,
 		midjourneyCDN:  cfg.MidjourneyCDN,
+		since:          cfg.Since,
+		history:        make(map[search][]*discord.Message),
 	}
 
 	c.c.OnEvent(func(e *discordgo.Event) {
 		switch e.Type {
-		case discord.MessageCreateEvent, discord.MessageUpdateEvent:
+		case discord.MessageCreateEvent, discord.MessageUpdateEvent, discord.MessageHistoryEvent:
 			var msg discord.Message
 			if err := json.Unmarshal(e.RawData, &msg); err != nil {
-				log.Println("midjourney: couldn't unmarshal message: %w", err)
+				log.Printf("%s: couldn't unmarshal message: %v\n", c.bot.Name, err)
+				return
 			}
 			// Ignore messages from other channels
 			if msg.ChannelID != c.channelID {
@@ -129,7 +192,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 				log.Println(err)
 				c.debugLog("ERR", err)
 				c.saveDump()
-				panic("❌ midjourney: action required")
+				panic(fmt.Sprintf("❌ %s: action required", c.bot.Name))
 			}
 			if ok {
 				return
@@ -165,10 +228,10 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 				// Remove links from the prompt
 				prompt = replaceLinks(prompt)
 
-				switch {
-				case strings.Contains(rest, upscaleTerm) || strings.Contains(rest, imageNumberTerm):
+				switch resultKind(rest) {
+				case Upscale:
 					key = upscaleSearch(prompt)
-				case strings.Contains(rest, variationTerm) || strings.Contains(rest, variationSubtleTerm) || strings.Contains(rest, variationStrongTerm):
+				case Variation:
 					key = variationSearch(prompt)
 				default:
 					key = previewSearch(prompt)
@@ -188,7 +251,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 				// Parse prompt
 				if _, _, ok := parseContent(msg.Content); !ok {
 					// Check if there is an error message
-					if err := parseError(&msg); err == nil {
+					if err := c.parseError(&msg); err == nil {
 						// Check if there is interaction data
 						if msg.Interaction == nil || msg.Interaction.ID == "" {
 							return
@@ -217,6 +280,12 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 				c.lck.Lock()
 				callbacks := c.callback[key]
 				if len(callbacks) == 0 {
+					// Keep unclaimed history results so they can be claimed
+					// later instead of launching the same job again
+					if e.Type == discord.MessageHistoryEvent && key != nil && len(msg.Attachments) > 0 {
+						c.history[key] = append(c.history[key], &msg)
+						c.cache[cacheID] = struct{}{}
+					}
 					c.lck.Unlock()
 					return
 				}
@@ -243,7 +312,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 }
 
 func (c *Client) Concurrency() int {
-	return 12
+	return c.bot.Concurrency
 }
 
 func (c *Client) debugLog(t string, v interface{}) {
@@ -277,14 +346,14 @@ func (c *Client) saveDump() {
 	}
 	// Create logs directory if it doesn't exist
 	if err := os.MkdirAll("logs", 0755); err != nil {
-		log.Println("midjourney: couldn't create logs directory:", err)
+		log.Printf("%s: couldn't create logs directory: %v\n", c.bot.Name, err)
 		return
 	}
 	// Save dump using the current time
 	now := time.Now()
 	filename := fmt.Sprintf("logs/dump_%s.txt", now.Format("20060102_150405"))
 	if err := os.WriteFile(filename, []byte(output), 0644); err != nil {
-		log.Println("midjourney: couldn't save dump:", err)
+		log.Printf("%s: couldn't save dump: %v\n", c.bot.Name, err)
 		return
 	}
 }
@@ -300,23 +369,123 @@ func parseContent(content string) (string, string, bool) {
 	return prompt, rest, true
 }
 
-func parseEmbedFooter(prompt string, msg *discord.Message) (string, error) {
+// Kind is the kind of a result message.
+type Kind int
+
+const (
+	Preview Kind = iota
+	Upscale
+	Variation
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Upscale:
+		return "upscale"
+	case Variation:
+		return "variation"
+	default:
+		return "preview"
+	}
+}
+
+// Result is a message of the bot with a generated image.
+type Result struct {
+	Kind      Kind
+	Prompt    string
+	URL       string
+	MessageID string
+	// ImageIDs are the ids of the images of a preview or variation.
+	ImageIDs []string
+	// Index is the zero based index of an upscaled image, -1 if unknown.
+	Index int
+}
+
+var imageNumberRegex = regexp.MustCompile(imageNumberTerm + `(\d)`)
+
+// ParseMessage parses a message of the bot with a generated image.
+// Unfinished images and other messages return false.
+func ParseMessage(msg *discord.Message) (*Result, bool) {
+	if len(msg.Attachments) == 0 || len(msg.Components) == 0 {
+		return nil, false
+	}
+	prompt, rest, ok := parseContent(msg.Content)
+	if !ok {
+		return nil, false
+	}
+	r := &Result{
+		Kind:      resultKind(rest),
+		Prompt:    prompt,
+		URL:       msg.Attachments[0].URL,
+		MessageID: msg.ID,
+		Index:     -1,
+	}
+	switch r.Kind {
+	case Upscale:
+		if m := imageNumberRegex.FindStringSubmatch(rest); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			r.Index = n - 1
+		}
+	default:
+		r.ImageIDs = imageIDs(msg)
+		if len(r.ImageIDs) == 0 {
+			return nil, false
+		}
+	}
+	return r, true
+}
+
+func resultKind(rest string) Kind {
+	switch {
+	case upscaleRegex.MatchString(rest) || strings.Contains(rest, imageNumberTerm):
+		return Upscale
+	case variationRegex.MatchString(rest):
+		return Variation
+	default:
+		return Preview
+	}
+}
+
+// imageIDs returns the image ids from the upscale buttons of a message.
+// Buttons of upscaled images use versioned actions, such as
+// "MJ::JOB::upsample_v6_2x_subtle::", so they aren't taken as image ids.
+func imageIDs(msg *discord.Message) []string {
+	var ids []string
+	for _, comps := range msg.Components {
+		if len(comps.Components) < 4 {
+			continue
+		}
+		if !strings.HasPrefix(comps.Components[0].CustomID, upscaleID) {
+			continue
+		}
+		for _, comp := range comps.Components {
+			if !strings.HasPrefix(comp.CustomID, upscaleID) {
+				continue
+			}
+			id := strings.TrimPrefix(comp.CustomID, upscaleID)
+			ids = append(ids, strings.TrimSuffix(id, soloSuffix))
+		}
+	}
+	return ids
+}
+
+func (c *Client) parseEmbedFooter(prompt string, msg *discord.Message) (string, error) {
 	if len(msg.Embeds) == 0 {
-		return "", errors.New("midjourney: message has no embed")
+		return "", fmt.Errorf("%s: message has no embed", c.bot.Name)
 	}
 	embed := msg.Embeds[0]
 	if embed.Footer == nil {
-		return "", errors.New("midjourney: embed has no footer")
+		return "", fmt.Errorf("%s: embed has no footer", c.bot.Name)
 	}
 	footer := embed.Footer.Text
 	if !strings.HasPrefix(footer, "/imagine ") {
-		return "", fmt.Errorf("midjourney: footer doesn't start with /imagine: %s", footer)
+		return "", fmt.Errorf("%s: footer doesn't start with /imagine: %s", c.bot.Name, footer)
 	}
 	footer = strings.TrimPrefix(footer, "/imagine ")
 	footer = strings.TrimSpace(footer)
 	prompt = strings.TrimSpace(prompt)
 	if !strings.HasPrefix(footer, prompt) {
-		return "", fmt.Errorf("midjourney: footer doesn't start with prompt: %s", footer)
+		return "", fmt.Errorf("%s: footer doesn't start with prompt: %s", c.bot.Name, footer)
 	}
 	suffixes := strings.TrimPrefix(footer, prompt)
 	// Remove extra space that sometimes appears when suffixes are configured
@@ -343,7 +512,7 @@ var ErrEmptyPrompt = errors.New("empty prompt")
 // Other errors
 var ErrMessageNotFound = ai.NewError(errors.New("message not found"), false)
 
-func parseError(msg *discord.Message) error {
+func (c *Client) parseError(msg *discord.Message) error {
 	if len(msg.Embeds) == 0 {
 		return nil
 	}
@@ -353,43 +522,43 @@ func parseError(msg *discord.Message) error {
 
 	switch title {
 	case "invalid parameter":
-		err := fmt.Errorf("midjourney: %w: %s", ErrInvalidParameter, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrInvalidParameter, desc)
 		return ai.NewError(err, false)
 	case "invalid link":
-		err := fmt.Errorf("midjourney: %w: %s", ErrInvalidLink, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrInvalidLink, desc)
 		return ai.NewError(err, false)
 	case "banned prompt", "banned prompt detected", "banned image prompt":
-		err := fmt.Errorf("midjourney: %w: %s", ErrBannedPrompt, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrBannedPrompt, desc)
 		return ai.NewError(err, false)
 	case "action needed to continue":
-		err := fmt.Errorf("midjourney: %w: %s", ErrActionNeeded, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrActionNeeded, desc)
 		return ai.NewError(err, false)
 	case "job queued":
-		err := fmt.Errorf("midjourney: %w: %s", ErrJobQueued, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrJobQueued, desc)
 		return ai.NewError(err, false)
 	case "queue full":
-		err := fmt.Errorf("midjourney: %w: %s", ErrQueueFull, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrQueueFull, desc)
 		return ai.NewError(err, true)
 	case "pending mod message":
-		err := fmt.Errorf("midjourney: %w: %s", ErrPendingMod, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrPendingMod, desc)
 		return ai.NewFatal(err)
 	case "action required to continue":
-		err := fmt.Errorf("midjourney: %w: %s", ErrActionRequired, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrActionRequired, desc)
 		return ai.NewFatal(err)
 	case "please complete the task":
-		err := fmt.Errorf("midjourney: %w: %s", ErrCompleteTask, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrCompleteTask, desc)
 		return ai.NewFatal(err)
 	case "invalid request":
-		err := fmt.Errorf("midjourney: %w: %s", ErrInvalidRequest, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrInvalidRequest, desc)
 		return ai.NewFatal(err)
 	case "job action restricted":
-		err := fmt.Errorf("midjourney: %w: %s", ErrJobActionRestricted, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrJobActionRestricted, desc)
 		return ai.NewFatal(err)
 	case "empty prompt":
-		err := fmt.Errorf("midjourney: %w: %s", ErrEmptyPrompt, desc)
+		err := fmt.Errorf("%s: %w: %s", c.bot.Name, ErrEmptyPrompt, desc)
 		return ai.NewFatal(err)
 	default:
-		err := fmt.Errorf("midjourney: %s: %s", title, desc)
+		err := fmt.Errorf("%s: %s: %s", c.bot.Name, title, desc)
 		return ai.NewError(err, true)
 	}
 }
@@ -445,6 +614,9 @@ func (c *Client) receiveMessage(parent context.Context, key search, timeout time
 	})
 	c.lck.Unlock()
 
+	// Get the next reconnection before sending anything to the bot
+	reconnection := c.c.Reconnection()
+
 	// Execute the function if any
 	if fn != nil {
 		if err := fn(); err != nil {
@@ -453,19 +625,78 @@ func (c *Client) receiveMessage(parent context.Context, key search, timeout time
 	}
 
 	// Add a timeout to receive the message
-	ctx, cancel := context.WithTimeout(parent, timeout)
-	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-parent.Done():
+			return nil, parent.Err()
+		case <-timer.C:
+			return nil, context.DeadlineExceeded
+		case msg := <-msgChan:
+			return msg, nil
+		case <-reconnection.Done():
+			// If the session wasn't resumed, the message may have been lost
+			if !reconnection.Resumed() {
+				return nil, fmt.Errorf("%s: %w", c.bot.Name, discord.ErrSessionLost)
+			}
+			// Missed messages are replayed after resuming, so we restart the
+			// timeout because the bot couldn't reach us while disconnected
+			reconnection = c.c.Reconnection()
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		}
+	}
+}
+
+// fromHistory returns and removes the first history message that matches the
+// search key and the filter function.
+func (c *Client) fromHistory(key search, fn func(*discord.Message) bool) (*discord.Message, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	msgs := c.history[key]
+	for i, msg := range msgs {
+		if !fn(msg) {
+			continue
+		}
+		c.history[key] = append(msgs[:i:i], msgs[i+1:]...)
+		return msg, true
+	}
+	return nil, false
+}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case msg := <-msgChan:
-		return msg, nil
+// previewFromHistory returns the first history preview whose prompt matches
+// the given prompt. The response prompt may contain parameters appended by
+// the bot.
+func (c *Client) previewFromHistory(prompt string) (*discord.Message, string, bool) {
+	prompt = replaceLinks(prompt)
+	c.lck.Lock()
+	var candidates []previewSearch
+	for key := range c.history {
+		k, ok := key.(previewSearch)
+		if !ok {
+			continue
+		}
+		if string(k) == prompt || strings.HasPrefix(string(k), prompt+" --") {
+			candidates = append(candidates, k)
+		}
+	}
+	c.lck.Unlock()
+	for _, k := range candidates {
+		msg, ok := c.fromHistory(k, func(*discord.Message) bool { return true })
+		if ok {
+			return msg, string(k), true
+		}
 	}
+	return nil, "", false
 }
 
 func (c *Client) Start(ctx context.Context) error {
 	var appSearch discord.ApplicationCommandSearch
+	botID := c.bot.ID
 
 	switch c.guildID {
 	case "":
@@ -474,33 +705,33 @@ func (c *Client) Start(ctx context.Context) error {
 		var user discord.User
 		resp, err := c.c.Do(ctx, "GET", u, nil)
 		if err != nil {
-			return fmt.Errorf("midjourney: couldn't get user %s: %w", botID, err)
+			return fmt.Errorf("%s: couldn't get user %s: %w", c.bot.Name, botID, err)
 		}
 		if err := json.Unmarshal(resp, &user); err != nil {
-			return fmt.Errorf("midjourney: couldn't unmarshal user %s: %w", string(resp), err)
+			return fmt.Errorf("%s: couldn't unmarshal user %s: %w", c.bot.Name, string(resp), err)
 		}
 		applicationID := user.Application.ID
 		if applicationID == "" {
-			return fmt.Errorf("midjourney: couldn't find application id for user %s", botID)
+			return fmt.Errorf("%s: couldn't find application id for user %s", c.bot.Name, botID)
 		}
 
 		u = fmt.Sprintf("channels/%s/application-command-index", c.channelID)
 		resp, err = c.c.Do(ctx, "GET", u, nil)
 		if err != nil {
-			return fmt.Errorf("midjourney: couldn't get channel application commands: %w", err)
+			return fmt.Errorf("%s: couldn't get channel application commands: %w", c.bot.Name, err)
 		}
 		if err := json.Unmarshal(resp, &appSearch); err != nil {
-			return fmt.Errorf("midjourney: couldn't unmarshal application command search %s: %w", string(resp), err)
+			return fmt.Errorf("%s: couldn't unmarshal application command search %s: %w", c.bot.Name, string(resp), err)
 		}
 	default:
 		// Search for command in a guild channel
 		u := fmt.Sprintf("guilds/%s/application-command-index", c.guildID)
 		resp, err := c.c.Do(ctx, "GET", u, nil)
 		if err != nil {
-			return fmt.Errorf("midjourney: couldn't get guild application commands: %w", err)
+			return fmt.Errorf("%s: couldn't get guild application commands: %w", c.bot.Name, err)
 		}
 		if err := json.Unmarshal(resp, &appSearch); err != nil {
-			return fmt.Errorf("midjourney: couldn't unmarshal application command search %s: %w", string(resp), err)
+			return fmt.Errorf("%s: couldn't unmarshal application command search %s: %w", c.bot.Name, string(resp), err)
 		}
 	}
 
@@ -516,16 +747,31 @@ func (c *Client) Start(ctx context.Context) error {
 		break
 	}
 	if cmd == nil {
-		return fmt.Errorf("midjourney: couldn't find imagine command")
+		return fmt.Errorf("%s: couldn't find imagine command", c.bot.Name)
 	}
 	c.cmd = cmd
+
+	// Backfill the channel after reconnections and, if requested, recover
+	// the results of a previous run
+	c.c.Watch(c.channelID)
+	if !c.since.IsZero() {
+		if err := c.c.Backfill(ctx, c.channelID, discord.SnowflakeFromTime(c.since)); err != nil {
+			return fmt.Errorf("%s: couldn't backfill channel history: %w", c.bot.Name, err)
+		}
+	}
 	return nil
 }
 
 func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error) {
 	// Validate prompt
 	if err := c.validator.ValidatePrompt(prompt); err != nil {
-		return nil, ai.NewError(err, false)
+		return nil, ai.NewError(fmt.Errorf("%s: %w", c.bot.Name, err), false)
+	}
+
+	// Check if the preview was already received from the channel history
+	if msg, responsePrompt, ok := c.previewFromHistory(prompt); ok {
+		log.Printf("%s: preview of %s recovered from channel history\n", c.bot.Name, prompt)
+		return c.toPreview(prompt, responsePrompt, msg)
 	}
 
 	nonce := c.node.Generate().String()
@@ -560,24 +806,24 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 		// response may be received before it finishes, due to rate limit
 		// locking.
 		if _, err := c.c.Do(ctx, "POST", "interactions", imagine); err != nil {
-			return fmt.Errorf("midjourney: couldn't send imagine interaction: %w", err)
+			return fmt.Errorf("%s: couldn't send imagine interaction: %w", c.bot.Name, err)
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("midjourney: couldn't receive imagine response (%s): %w", nonce, err)
+		return nil, fmt.Errorf("%s: couldn't receive imagine response (%s): %w", c.bot.Name, nonce, err)
 	}
 
 	// Parse prompt
 	responsePrompt, _, ok := parseContent(response.Content)
 	if !ok {
 		// Check if the response contains an error message
-		err := parseError(response)
+		err := c.parseError(response)
 		switch {
 		case errors.Is(err, ErrJobQueued):
 			// The job is queued, so it will be processed.
 			// We will take the response prompt from the message embed footer.
-			responsePrompt, err = parseEmbedFooter(prompt, response)
+			responsePrompt, err = c.parseEmbedFooter(prompt, response)
 			if err != nil {
 				return nil, err
 			}
@@ -588,14 +834,14 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 			// Search the response prompt by the interaction id
 			response, err := c.receiveMessage(ctx, interactionSearch(response.Interaction.ID), timeout, nil)
 			if err != nil {
-				return nil, fmt.Errorf("midjourney: couldn't receive imagine response (%s): %w", nonce, err)
+				return nil, fmt.Errorf("%s: couldn't receive imagine response (%s): %w", c.bot.Name, nonce, err)
 			}
 			responsePrompt, _, ok = parseContent(response.Content)
 			if !ok {
-				return nil, fmt.Errorf("midjourney: couldn't parse prompt from update message: %s", response.Content)
+				return nil, fmt.Errorf("%s: couldn't parse prompt from update message: %s", c.bot.Name, response.Content)
 			}
 		default:
-			return nil, fmt.Errorf("midjourney: couldn't parse prompt from imagine response: %s", response.Content)
+			return nil, fmt.Errorf("%s: couldn't parse prompt from imagine response: %s", c.bot.Name, response.Content)
 		}
 	}
 
@@ -605,26 +851,15 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 
 	preview, err := c.receiveMessage(ctx, previewSearch(responsePrompt), timeout, nil)
 	if err != nil {
-		return nil, fmt.Errorf("midjourney: couldn't receive links message for (%s): %w", responsePrompt, err)
+		return nil, fmt.Errorf("%s: couldn't receive links message for (%s): %w", c.bot.Name, responsePrompt, err)
 	}
+	return c.toPreview(prompt, responsePrompt, preview)
+}
 
-	var imageIDs []string
-	for _, comps := range preview.Components {
-		if len(comps.Components) < 4 {
-			continue
-		}
-		if !strings.HasPrefix(comps.Components[0].CustomID, upscaleID) {
-			continue
-		}
-		for _, comp := range comps.Components {
-			if !strings.HasPrefix(comp.CustomID, upscaleID) {
-				continue
-			}
-			imageIDs = append(imageIDs, strings.TrimPrefix(comp.CustomID, upscaleID))
-		}
-	}
+func (c *Client) toPreview(prompt, responsePrompt string, preview *discord.Message) (*ai.Preview, error) {
+	imageIDs := imageIDs(preview)
 	if len(imageIDs) == 0 {
-		return nil, fmt.Errorf("midjourney: message has no image ids")
+		return nil, fmt.Errorf("%s: message has no image ids", c.bot.Name)
 	}
 	return &ai.Preview{
 		URL:            preview.Attachments[0].URL,
@@ -637,8 +872,16 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 
 func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([]string, error) {
 	if index < 0 || index >= len(preview.ImageIDs) {
-		return nil, fmt.Errorf("midjourney: invalid index %d", index)
+		return nil, fmt.Errorf("%s: invalid index %d", c.bot.Name, index)
+	}
+	// Check if the upscale was already received from the channel history
+	if msg, ok := c.fromHistory(upscaleSearch(preview.ResponsePrompt), func(m *discord.Message) bool {
+		return strings.Contains(m.Content, fmt.Sprintf("%s%d", imageNumberTerm, index+1))
+	}); ok {
+		log.Printf("%s: upscale %d of %s recovered from channel history\n", c.bot.Name, index, preview.Prompt)
+		return c.toUpscaleURLs(msg, preview, index)
 	}
+
 	customID := fmt.Sprintf("%s%s", upscaleID, preview.ImageIDs[index])
 	nonce := c.node.Generate().String()
 	upscale := &discord.InteractionComponent{
@@ -665,16 +908,19 @@ func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([
 			if errors.Is(err, discord.ErrMessageNotFound) {
 				return ErrMessageNotFound
 			}
-			return fmt.Errorf("midjourney: couldn't send upscale interaction: %w", err)
+			return fmt.Errorf("%s: couldn't send upscale interaction: %w", c.bot.Name, err)
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("midjourney: couldn't receive links message: %w", err)
+		return nil, fmt.Errorf("%s: couldn't receive links message: %w", c.bot.Name, err)
 	}
+	return c.toUpscaleURLs(msg, preview, index)
+}
 
+func (c *Client) toUpscaleURLs(msg *discord.Message, preview *ai.Preview, index int) ([]string, error) {
 	discordURL := msg.Attachments[0].URL
-	mjURL, err := toMidjourneyCDN(preview.ImageIDs[index])
+	mjURL, err := c.toCDN(preview.ImageIDs[index])
 	if err != nil {
 		return nil, err
 	}
@@ -688,7 +934,7 @@ func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([
 
 func (c *Client) Variation(ctx context.Context, preview *ai.Preview, index int) (*ai.Preview, error) {
 	if index < 0 || index >= len(preview.ImageIDs) {
-		return nil, fmt.Errorf("midjourney: invalid index %d", index)
+		return nil, fmt.Errorf("%s: invalid index %d", c.bot.Name, index)
 	}
 	customID := fmt.Sprintf("%s%s", variationID, preview.ImageIDs[index])
 	nonce := c.node.Generate().String()
@@ -716,31 +962,17 @@ func (c *Client) Variation(ctx context.Context, preview *ai.Preview, index int)
 			if errors.Is(err, discord.ErrMessageNotFound) {
 				return ErrMessageNotFound
 			}
-			return fmt.Errorf("midjourney: couldn't send variation interaction: %w", err)
+			return fmt.Errorf("%s: couldn't send variation interaction: %w", c.bot.Name, err)
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("midjourney: couldn't receive links message: %w", err)
+		return nil, fmt.Errorf("%s: couldn't receive links message: %w", c.bot.Name, err)
 	}
 
-	var imageIDs []string
-	for _, comps := range msg.Components {
-		if len(comps.Components) < 4 {
-			continue
-		}
-		if !strings.HasPrefix(comps.Components[0].CustomID, upscaleID) {
-			continue
-		}
-		for _, comp := range comps.Components {
-			if !strings.HasPrefix(comp.CustomID, upscaleID) {
-				continue
-			}
-			imageIDs = append(imageIDs, strings.TrimPrefix(comp.CustomID, upscaleID))
-		}
-	}
+	imageIDs := imageIDs(msg)
 	if len(imageIDs) == 0 {
-		return nil, fmt.Errorf("midjourney: message has no image ids")
+		return nil, fmt.Errorf("%s: message has no image ids", c.bot.Name)
 	}
 	return &ai.Preview{
 		URL:            msg.Attachments[0].URL,
@@ -763,17 +995,17 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 		return false, nil
 	}
 	if c.replicateToken == "" {
-		return false, fmt.Errorf("midjourney: action required")
+		return false, fmt.Errorf("%s: action required", c.bot.Name)
 	}
 	if len(msg.Embeds) == 0 {
-		return false, fmt.Errorf("midjourney: missing embed in action")
+		return false, fmt.Errorf("%s: missing embed in action", c.bot.Name)
 	}
 	if msg.Embeds[0].Image == nil {
-		return false, fmt.Errorf("midjourney: missing image in embed")
+		return false, fmt.Errorf("%s: missing image in embed", c.bot.Name)
 	}
 	image := msg.Embeds[0].Image.URL
 	if image == "" {
-		return false, fmt.Errorf("midjourney: missing image url in embed")
+		return false, fmt.Errorf("%s: missing image url in embed", c.bot.Name)
 	}
 
 	var options []string
@@ -791,7 +1023,7 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 		Timeout:  1 * time.Minute,
 	})
 	if err != nil {
-		return false, fmt.Errorf("midjourney: couldn't ask image: %w", err)
+		return false, fmt.Errorf("%s: couldn't ask image: %w", c.bot.Name, err)
 	}
 	c.debugLog("ASK", struct {
 		Question string `json:"question"`
@@ -800,7 +1032,7 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 
 	response = strings.TrimSpace(strings.ToLower(response))
 	if response == "" {
-		return false, fmt.Errorf("midjourney: no response from image")
+		return false, fmt.Errorf("%s: no response from image", c.bot.Name)
 	}
 
 	match := -1
@@ -811,7 +1043,7 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 		}
 	}
 	if match < 0 {
-		return false, fmt.Errorf("midjourney: match not found (%s) in (%s)", response, strings.Join(options, ", "))
+		return false, fmt.Errorf("%s: match not found (%s) in (%s)", c.bot.Name, response, strings.Join(options, ", "))
 	}
 
 	// Launch click button
@@ -830,9 +1062,9 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 	}
 	c.debugLog("CLICK", click)
 	if _, err := c.c.Do(ctx, "POST", "interactions", click); err != nil {
-		return false, fmt.Errorf("midjourney: couldn't send click interaction: %w", err)
+		return false, fmt.Errorf("%s: couldn't send click interaction: %w", c.bot.Name, err)
 	}
-	log.Printf("✅ midjourney: action completed (%s) %d %s %s\n", strings.Join(options, ","), match, response, image)
+	log.Printf("✅ %s: action completed (%s) %d %s %s\n", c.bot.Name, strings.Join(options, ","), match, response, image)
 	return true, nil
 }
 
@@ -848,22 +1080,22 @@ func cleanURL(u string) string {
 	return strings.Split(u, "?")[0]
 }
 
-func toMidjourneyCDN(imageID string) (string, error) {
+func (c *Client) toCDN(imageID string) (string, error) {
 	split := strings.Split(imageID, "::")
 	if len(split) != 2 {
-		return "", fmt.Errorf("midjourney: couldn't split image id: %s", imageID)
+		return "", fmt.Errorf("%s: couldn't split image id: %s", c.bot.Name, imageID)
 	}
 	index, err := strconv.Atoi(split[0])
 	if err != nil {
-		return "", fmt.Errorf("midjourney: couldn't convert image index %s: %w", split[0], err)
+		return "", fmt.Errorf("%s: couldn't convert image index %s: %w", c.bot.Name, split[0], err)
 	}
 	if index < 1 || index > 4 {
-		return "", fmt.Errorf("midjourney: invalid image index %d", index)
+		return "", fmt.Errorf("%s: invalid image index %d", c.bot.Name, index)
 	}
 	index--
 	id := split[1]
 	if id == "" {
-		return "", fmt.Errorf("midjourney: empty id")
+		return "", fmt.Errorf("%s: empty id", c.bot.Name)
 	}
-	return fmt.Sprintf("https://cdn.midjourney.com/%s/0_%d.png", id, index), nil
+	return fmt.Sprintf(c.bot.CDN, id, index), nil
 }
@@ -3,8 +3,10 @@ package midjourney
 import (
 	"encoding/json"
 	"os"
+	"reflect"
 	"testing"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/igolaizola/bulkai/pkg/discord"
 )
 
@@ -18,3 +20,76 @@ func TestParseAppSearch(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestParseMessage(t *testing.T) {
+	attachments := []*discordgo.MessageAttachment{{URL: "https://cdn.discordapp.com/attachments/1/2/image.png"}}
+	buttons := []*discord.Component{{
+		Type: 1,
+		Components: []*discord.Component{
+			{CustomID: upscaleID + "1::abc"},
+			{CustomID: upscaleID + "2::abc"},
+			{CustomID: upscaleID + "3::abc"},
+			{CustomID: upscaleID + "4::abc"},
+		},
+	}}
+	tests := []struct {
+		name  string
+		msg   *discord.Message
+		want  *Result
+		found bool
+	}{
+		{
+			name: "preview",
+			msg: &discord.Message{
+				ID:          "10",
+				Content:     "**a red cat** - <@123> (fast)",
+				Attachments: attachments,
+				Components:  buttons,
+			},
+			want: &Result{
+				Kind:      Preview,
+				Prompt:    "a red cat",
+				URL:       attachments[0].URL,
+				MessageID: "10",
+				ImageIDs:  []string{"1::abc", "2::abc", "3::abc", "4::abc"},
+				Index:     -1,
+			},
+			found: true,
+		},
+		{
+			name: "upscale",
+			msg: &discord.Message{
+				ID:          "11",
+				Content:     "**a red cat** - Image #3 <@123>",
+				Attachments: attachments,
+				Components:  []*discord.Component{{Type: 1}},
+			},
+			want: &Result{
+				Kind:      Upscale,
+				Prompt:    "a red cat",
+				URL:       attachments[0].URL,
+				MessageID: "11",
+				Index:     2,
+			},
+			found: true,
+		},
+		{
+			name: "unfinished",
+			msg: &discord.Message{
+				Content:     "**a red cat** - <@123> (50%) (fast)",
+				Attachments: attachments,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := ParseMessage(tt.msg)
+			if found != tt.found {
+				t.Fatalf("got found %v, want %v", found, tt.found)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package midjourney
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -35,7 +36,7 @@ type validator struct {
 func (v *validator) ValidatePrompt(prompt string) error {
 	// Check if prompt is empty
 	if prompt == "" {
-		return fmt.Errorf("midjourney: prompt is empty")
+		return errors.New("prompt is empty")
 	}
 
 	// Convert prompt to lowercase
@@ -55,7 +56,7 @@ func (v *validator) ValidatePrompt(prompt string) error {
 	// Check if any words are banned
 	for _, word := range words {
 		if _, ok := v.banned[word]; ok {
-			return fmt.Errorf("midjourney: word %q is banned", word)
+			return fmt.Errorf("word %q is banned", word)
 		}
 	}
 	return nil
@@ -0,0 +1,67 @@
+// Package niji implements a client for the niji・journey bot.
+// The bot is a separate discord application built on top of midjourney, so
+// the midjourney client is reused with a different bot descriptor.
+// Its messages differ from the midjourney ones in a few ways:
+//   - the prompt includes the --niji parameter added by the bot settings.
+//   - upscales are always done with a mode, "Upscaled (Subtle) by" or
+//     "Upscaled (Creative) by", instead of "Upscaled by".
+//   - previews have a reroll button with the "::SOLO" suffix next to the
+//     upscale buttons.
+package niji
+
+import (
+	"github.com/igolaizola/bulkai/pkg/ai"
+	"github.com/igolaizola/bulkai/pkg/ai/midjourney"
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+// Bot is the niji・journey bot.
+var Bot = midjourney.Bot{
+	Name:        "niji",
+	ID:          "1022952195194359889",
+	CDN:         "https://cdn.midjourney.com/%s/0_%d.png",
+	Concurrency: 12,
+}
+
+// Config is the niji・journey configuration, which is the same as the
+// midjourney one.
+type Config = midjourney.Config
+
+func init() {
+	ai.Register(ai.Backend{
+		Name: "niji",
+		Capabilities: ai.Capabilities{
+			Upscale:   true,
+			Variation: true,
+		},
+		Config: func() interface{} {
+			return &Config{}
+		},
+		New: func(client *discord.Client, opts *ai.Options, cfg interface{}) (ai.Client, error) {
+			c := *cfg.(*Config)
+			c.ChannelID = opts.ChannelID
+			c.Debug = opts.Debug
+			c.Since = opts.Since
+			return New(client, &c)
+		},
+	})
+}
+
+// New creates a new niji・journey client.
+func New(client *discord.Client, cfg *Config) (ai.Client, error) {
+	c := *cfg
+	bot := Bot
+	c.Bot = &bot
+	return midjourney.New(client, &c)
+}
+
+// ParseMessage parses a message of the niji・journey bot with a generated
+// image.
+// Messages from other authors, unfinished images and other messages return
+// false.
+func ParseMessage(msg *discord.Message) (*midjourney.Result, bool) {
+	if msg.Author != nil && msg.Author.ID != Bot.ID {
+		return nil, false
+	}
+	return midjourney.ParseMessage(msg)
+}
@@ -0,0 +1,106 @@
+package niji
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/igolaizola/bulkai/pkg/ai/midjourney"
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+func TestParseMessage(t *testing.T) {
+	prompt := "a girl in a kimono under cherry blossoms, watercolor --niji 6"
+	tests := []struct {
+		file  string
+		want  *midjourney.Result
+		found bool
+	}{
+		{
+			file: "preview.json",
+			want: &midjourney.Result{
+				Kind:      midjourney.Preview,
+				Prompt:    prompt,
+				MessageID: "1262410033447866418",
+				ImageIDs: []string{
+					"1::6f0c1d2e-8a4b-4c7d-9e1f-2a3b4c5d6e7f",
+					"2::6f0c1d2e-8a4b-4c7d-9e1f-2a3b4c5d6e7f",
+					"3::6f0c1d2e-8a4b-4c7d-9e1f-2a3b4c5d6e7f",
+					"4::6f0c1d2e-8a4b-4c7d-9e1f-2a3b4c5d6e7f",
+				},
+				Index: -1,
+			},
+			found: true,
+		},
+		{
+			file: "upscale.json",
+			want: &midjourney.Result{
+				Kind:      midjourney.Upscale,
+				Prompt:    prompt,
+				MessageID: "1262410301232619581",
+				Index:     1,
+			},
+			found: true,
+		},
+		{
+			file: "upscale-subtle.json",
+			want: &midjourney.Result{
+				Kind:      midjourney.Upscale,
+				Prompt:    prompt,
+				MessageID: "1262410566916898878",
+				Index:     -1,
+			},
+			found: true,
+		},
+		{
+			file: "variation-strong.json",
+			want: &midjourney.Result{
+				Kind:      midjourney.Variation,
+				Prompt:    prompt,
+				MessageID: "1262410799499345941",
+				ImageIDs: []string{
+					"1::b41e7a90-3c2d-4f58-a6e1-0d9c8b7a6f54",
+					"2::b41e7a90-3c2d-4f58-a6e1-0d9c8b7a6f54",
+					"3::b41e7a90-3c2d-4f58-a6e1-0d9c8b7a6f54",
+					"4::b41e7a90-3c2d-4f58-a6e1-0d9c8b7a6f54",
+				},
+				Index: -1,
+			},
+			found: true,
+		},
+		{
+			file: "progress.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg discord.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			got, found := ParseMessage(&msg)
+			if found != tt.found {
+				t.Fatalf("got found %v, want %v", found, tt.found)
+			}
+			if !found {
+				return
+			}
+			tt.want.URL = msg.Attachments[0].URL
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			// Messages of other bots are ignored
+			msg.Author.ID = midjourney.Midjourney.ID
+			if _, found := ParseMessage(&msg); found {
+				t.Error("message of another bot was parsed")
+			}
+		})
+	}
+}
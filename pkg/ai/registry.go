@@ -0,0 +1,144 @@
+package ai
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+// Capabilities describes the operations supported by a backend.
+type Capabilities struct {
+	Upscale   bool
+	Variation bool
+	Describe  bool
+}
+
+// Options are the common options passed to every backend.
+type Options struct {
+	ChannelID string
+	Debug     bool
+	// Since is the time from which the channel history is backfilled when the
+	// client starts, so that jobs launched by a previous run can be completed.
+	// If zero, the history isn't backfilled.
+	Since time.Time
+}
+
+// Backend describes an ai client implementation that can be selected by name.
+type Backend struct {
+	// Name used to select the backend (e.g. `bot: midjourney`).
+	Name string
+	// Capabilities supported by the backend.
+	Capabilities Capabilities
+	// Config returns a new backend configuration with its default values.
+	// The fields with a yaml tag define the schema of the backend YAML
+	// sub-section (e.g. `midjourney: {replicate-token: ...}`).
+	// It can be nil if the backend doesn't have any configuration.
+	Config func() interface{}
+	// New creates a new client using the common options and a configuration
+	// previously returned by Config.
+	New func(client *discord.Client, opts *Options, cfg interface{}) (Client, error)
+}
+
+var (
+	backendsLck sync.Mutex
+	backends    = map[string]Backend{}
+)
+
+// Register makes a backend available by its name.
+// It panics if the name is empty, the backend has no constructor or a backend
+// with the same name is already registered.
+func Register(b Backend) {
+	backendsLck.Lock()
+	defer backendsLck.Unlock()
+	name := strings.ToLower(b.Name)
+	if name == "" {
+		panic("ai: backend name is empty")
+	}
+	if b.New == nil {
+		panic(fmt.Sprintf("ai: backend %s has no constructor", name))
+	}
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("ai: backend %s already registered", name))
+	}
+	b.Name = name
+	backends[name] = b
+}
+
+// Lookup returns the backend registered with the given name.
+func Lookup(name string) (Backend, bool) {
+	backendsLck.Lock()
+	defer backendsLck.Unlock()
+	b, ok := backends[strings.ToLower(name)]
+	return b, ok
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	backendsLck.Lock()
+	defer backendsLck.Unlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewConfig returns a new backend configuration with its default values or nil
+// if the backend doesn't have any configuration.
+func (b Backend) NewConfig() interface{} {
+	if b.Config == nil {
+		return nil
+	}
+	return b.Config()
+}
+
+// RegisterFlags registers a flag for each field of the backend configuration
+// that has a yaml tag. Flags are prefixed with the backend name, so that the
+// YAML sub-section `midjourney: {replicate-token: ...}` is parsed into the
+// flag `midjourney.replicate-token`.
+// The flag usage is taken from the `usage` tag.
+func (b Backend) RegisterFlags(fs *flag.FlagSet, cfg interface{}) error {
+	if cfg == nil {
+		return nil
+	}
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("ai: %s config must be a pointer to a struct", b.Name)
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" || !field.IsExported() {
+			continue
+		}
+		name := fmt.Sprintf("%s.%s", b.Name, tag)
+		usage := field.Tag.Get("usage")
+		ptr := v.Field(i).Addr().Interface()
+		switch p := ptr.(type) {
+		case *string:
+			fs.StringVar(p, name, *p, usage)
+		case *bool:
+			fs.BoolVar(p, name, *p, usage)
+		case *int:
+			fs.IntVar(p, name, *p, usage)
+		case *float64:
+			fs.Float64Var(p, name, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, name, *p, usage)
+		case flag.Value:
+			fs.Var(p, name, usage)
+		default:
+			return fmt.Errorf("ai: unsupported type %s for %s", field.Type, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package ai
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+type testConfig struct {
+	Token   string        `yaml:"token" usage:"token"`
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+	Ignored string        `yaml:"-"`
+}
+
+func TestRegisterFlags(t *testing.T) {
+	b := Backend{Name: "test"}
+	cfg := &testConfig{Token: "default"}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := b.RegisterFlags(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Lookup("test.ignored") != nil {
+		t.Error("unexpected flag test.ignored")
+	}
+	if got := fs.Lookup("test.token").DefValue; got != "default" {
+		t.Errorf("got default %q, want %q", got, "default")
+	}
+	if err := fs.Parse([]string{"-test.token", "foo", "-test.enabled", "-test.timeout", "5m"}); err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig{Token: "foo", Enabled: true, Timeout: 5 * time.Minute}
+	if *cfg != want {
+		t.Errorf("got %+v, want %+v", *cfg, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	Register(Backend{
+		Name: "Lookup-Test",
+		New:  func(*discord.Client, *Options, interface{}) (Client, error) { return nil, nil },
+	})
+	if _, ok := Lookup("lookup-test"); !ok {
+		t.Error("backend not found")
+	}
+	if _, ok := Lookup("LOOKUP-TEST"); !ok {
+		t.Error("backend not found with a different case")
+	}
+}
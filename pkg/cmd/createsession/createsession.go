@@ -1,4 +1,4 @@
-package session
+package createsession
 
 import (
 	"bytes"
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -19,7 +18,9 @@ import (
 	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 	"github.com/igolaizola/bulkai"
+	"github.com/igolaizola/bulkai/pkg/http"
 	"github.com/igolaizola/bulkai/pkg/scrapfly"
+	"github.com/igolaizola/bulkai/pkg/session"
 	"gopkg.in/yaml.v3"
 )
 
@@ -169,6 +170,25 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 		return errors.New("empty accept language")
 	}
 
+	// obtain http2 fingerprint
+	var akamaiBody string
+	if err := chromedp.Run(ctx,
+		chromedp.Navigate(scrapfly.FPAkamaiURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		chromedp.Text("body", &akamaiBody, chromedp.ByQuery),
+	); err != nil {
+		return fmt.Errorf("could not navigate to http2 fingerprint page: %w", err)
+	}
+	var fpAkamai scrapfly.FPAkamai
+	if err := json.Unmarshal([]byte(akamaiBody), &fpAkamai); err != nil {
+		return fmt.Errorf("couldn't unmarshal http2 fingerprint %s: %w", akamaiBody, err)
+	}
+	http2 := fpAkamai.Fingerprint
+	if _, err := http.ParseHTTP2Fingerprint(http2); err != nil {
+		return fmt.Errorf("invalid http2 fingerprint: %w", err)
+	}
+	log.Println("http2:", http2)
+
 	var lck sync.Mutex
 
 	// Obtain discord token
@@ -246,7 +266,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 	cookie = strings.ReplaceAll(cookie, ";  ", "; ")
 
 	// save session
-	session := &bulkai.Session{
+	sess := &bulkai.Session{
 		JA3:             ja3,
 		UserAgent:       userAgent,
 		Token:           token,
@@ -254,29 +274,26 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 		Locale:          xDiscordLocale,
 		Cookie:          cookie,
 		Language:        acceptLanguage,
+		HTTP2:           http2,
 	}
-	data, err := yaml.Marshal(session)
+	data, err := yaml.Marshal(sess)
 	if err != nil {
 		return fmt.Errorf("couldn't marshal session: %w", err)
 	}
 	log.Println("Session successfully obtained")
 
 	// If the file already exists, copy it to a backup file
-	if _, err := os.Stat(output); err == nil {
-		backup := output
-		ext := filepath.Ext(backup)
-		// Remove the extension from the output
-		backup = strings.TrimSuffix(backup, ext)
-		// Add a timestamp to the backup file
-		backup = fmt.Sprintf("%s_%s%s", backup, time.Now().Format("20060102150405"), ext)
-		if err := os.Rename(output, backup); err != nil {
-			return fmt.Errorf("couldn't backup session: %w", err)
-		}
+	store := session.NewStore(output)
+	backup, err := store.Backup()
+	if err != nil {
+		return err
+	}
+	if backup != "" {
 		log.Println("Previous session backed up to", backup)
 	}
 
 	// Write the session to the output file
-	if err := os.WriteFile(output, data, 0644); err != nil {
+	if err := store.Create(data); err != nil {
 		return fmt.Errorf("couldn't write session: %w", err)
 	}
 	log.Println("Session saved to", output)
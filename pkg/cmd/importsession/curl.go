@@ -0,0 +1,215 @@
+package importsession
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// curlValueFlags are the curl flags that have a value which isn't used.
+var curlValueFlags = map[string]bool{
+	"-X": true, "--request": true,
+	"-d": true, "--data": true, "--data-raw": true, "--data-binary": true, "--data-ascii": true, "--data-urlencode": true,
+	"-F": true, "--form": true,
+	"-e": true, "--referer": true,
+	"-u": true, "--user": true,
+	"-x": true, "--proxy": true,
+	"-o": true, "--output": true,
+	"-m": true, "--max-time": true, "--connect-timeout": true,
+}
+
+// parseCurl parses a "Copy as cURL (bash)" command.
+func parseCurl(cmd string) (*request, error) {
+	args, err := splitShell(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse curl command: %w", err)
+	}
+	if len(args) == 0 || args[0] != "curl" {
+		return nil, errors.New("not a curl command")
+	}
+	req := &request{headers: map[string]string{}}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value of curl flag %s", arg)
+			}
+			i++
+			return args[i], nil
+		}
+		switch {
+		case arg == "-H" || arg == "--header":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			name, val, ok := strings.Cut(v, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid curl header %q", v)
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			val = strings.TrimSpace(val)
+			if name == "cookie" && req.headers[name] != "" {
+				req.headers[name] += "; " + val
+				continue
+			}
+			req.headers[name] = val
+		case arg == "-b" || arg == "--cookie":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			req.headers["cookie"] = v
+		case arg == "-A" || arg == "--user-agent":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			req.headers["user-agent"] = v
+		case arg == "--url":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			req.url = v
+		case curlValueFlags[arg]:
+			if _, err := value(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(arg, "-"):
+		default:
+			if req.url == "" {
+				req.url = arg
+			}
+		}
+	}
+	if req.url == "" {
+		return nil, errors.New("missing url in curl command")
+	}
+	return req, nil
+}
+
+// splitShell splits a bash command into arguments, handling quotes, escapes
+// and line continuations.
+func splitShell(cmd string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	var inArg bool
+	runes := []rune(cmd)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			// Line continuation
+			if runes[i] == '\n' || runes[i] == '\r' {
+				continue
+			}
+			cur.WriteRune(runes[i])
+			inArg = true
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			cur.WriteString(string(runes[i+1 : end]))
+			i = end
+			inArg = true
+		case r == '$' && i+1 < len(runes) && runes[i+1] == '\'':
+			s, end, err := ansiQuoted(runes, i+2)
+			if err != nil {
+				return nil, err
+			}
+			cur.WriteString(s)
+			i = end
+			inArg = true
+		case r == '"':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[j+1]) {
+					j++
+					if runes[j] != '\n' {
+						cur.WriteRune(runes[j])
+					}
+					continue
+				}
+				cur.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated double quote")
+			}
+			i = j
+			inArg = true
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// ansiQuoted decodes a $'...' string starting after the opening quote and
+// returns it along with the index of the closing quote.
+func ansiQuoted(runes []rune, from int) (string, int, error) {
+	var sb strings.Builder
+	for i := from; i < len(runes); i++ {
+		r := runes[i]
+		if r == '\'' {
+			return sb.String(), i, nil
+		}
+		if r != '\\' || i+1 >= len(runes) {
+			sb.WriteRune(r)
+			continue
+		}
+		i++
+		switch runes[i] {
+		case 'n':
+			sb.WriteRune('\n')
+		case 't':
+			sb.WriteRune('\t')
+		case 'r':
+			sb.WriteRune('\r')
+		case 'x', 'u', 'U':
+			size := map[rune]int{'x': 2, 'u': 4, 'U': 8}[runes[i]]
+			end := i + 1
+			for end < len(runes) && end < i+1+size && strings.ContainsRune("0123456789abcdefABCDEF", runes[end]) {
+				end++
+			}
+			v, err := strconv.ParseUint(string(runes[i+1:end]), 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid escape sequence \\%c", runes[i])
+			}
+			if runes[i] == 'x' {
+				sb.WriteByte(byte(v))
+			} else {
+				sb.WriteRune(rune(v))
+			}
+			i = end - 1
+		default:
+			sb.WriteRune(runes[i])
+		}
+	}
+	return "", 0, errors.New("unterminated $' quote")
+}
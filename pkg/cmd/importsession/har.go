@@ -0,0 +1,62 @@
+package importsession
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type har struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				Cookies []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"cookies"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// parseHAR returns the requests of a HAR file in the order they were sent.
+func parseHAR(data []byte) ([]*request, error) {
+	var h har
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("couldn't parse har file: %w", err)
+	}
+	if len(h.Log.Entries) == 0 {
+		return nil, errors.New("har file has no entries")
+	}
+	var reqs []*request
+	for _, e := range h.Log.Entries {
+		req := &request{
+			url:     e.Request.URL,
+			headers: map[string]string{},
+		}
+		for _, hdr := range e.Request.Headers {
+			name := strings.ToLower(hdr.Name)
+			// HTTP/2 requests may send cookies in multiple headers
+			if name == "cookie" && req.headers[name] != "" {
+				req.headers[name] += "; " + hdr.Value
+				continue
+			}
+			req.headers[name] = hdr.Value
+		}
+		if req.headers["cookie"] == "" && len(e.Request.Cookies) > 0 {
+			var cookies []string
+			for _, c := range e.Request.Cookies {
+				cookies = append(cookies, c.Name+"="+c.Value)
+			}
+			req.headers["cookie"] = strings.Join(cookies, "; ")
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
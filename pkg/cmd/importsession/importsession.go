@@ -0,0 +1,166 @@
+package importsession
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/igolaizola/bulkai"
+	"github.com/igolaizola/bulkai/pkg/http"
+	"github.com/igolaizola/bulkai/pkg/session"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	// Input is a HAR file or a file with a cURL command, "-" reads from
+	// stdin.
+	Input  string `yaml:"input"`
+	Output string `yaml:"output"`
+	// JA3 is the fingerprint of the browser, if empty the default of the
+	// browser of the user agent is used.
+	JA3   string `yaml:"ja3"`
+	HTTP2 string `yaml:"http2"`
+}
+
+// request is the data of a discord request.
+type request struct {
+	url     string
+	headers map[string]string
+}
+
+// Run imports a session from a HAR file or a cURL command of a request to
+// the discord API.
+func Run(ctx context.Context, cfg *Config) error {
+	if cfg.Input == "" {
+		return errors.New("missing input file")
+	}
+	if cfg.Output == "" {
+		return errors.New("missing output file")
+	}
+	var data []byte
+	var err error
+	if cfg.Input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(cfg.Input)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read input: %w", err)
+	}
+
+	sess, err := parse(data)
+	if err != nil {
+		return err
+	}
+	sess.JA3 = cfg.JA3
+	if sess.JA3 == "" {
+		sess.JA3 = http.DefaultJA3(sess.UserAgent)
+		log.Println("Using the default ja3 of the browser, set --ja3 to use the fingerprint of your browser")
+	}
+	sess.HTTP2 = cfg.HTTP2
+	if err := http.NewBrowserProfile(sess.UserAgent, sess.JA3, sess.Language).Validate(nil); err != nil {
+		log.Printf("⚠️ %v\n", err)
+	}
+
+	out, err := yaml.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal session: %w", err)
+	}
+	log.Println("Session successfully imported")
+
+	// If the file already exists, copy it to a backup file
+	store := session.NewStore(cfg.Output)
+	backup, err := store.Backup()
+	if err != nil {
+		return err
+	}
+	if backup != "" {
+		log.Println("Previous session backed up to", backup)
+	}
+
+	// Write the session to the output file
+	if err := store.Create(out); err != nil {
+		return fmt.Errorf("couldn't write session: %w", err)
+	}
+	log.Println("Session saved to", cfg.Output)
+	return nil
+}
+
+// parse obtains the session from a HAR file or a cURL command.
+func parse(data []byte) (*bulkai.Session, error) {
+	var reqs []*request
+	var err error
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		reqs, err = parseHAR(trimmed)
+	case bytes.HasPrefix(trimmed, []byte("curl ")):
+		var req *request
+		req, err = parseCurl(string(trimmed))
+		reqs = []*request{req}
+	default:
+		return nil, errors.New("input must be a HAR file or a cURL command")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the values of the most recent requests, because cookies may have
+	// been rotated
+	sess := &bulkai.Session{}
+	var found bool
+	for _, req := range reqs {
+		if !isDiscordAPI(req.url) {
+			continue
+		}
+		found = true
+		for k, v := range map[string]*string{
+			"authorization":      &sess.Token,
+			"cookie":             &sess.Cookie,
+			"x-super-properties": &sess.SuperProperties,
+			"x-discord-locale":   &sess.Locale,
+			"user-agent":         &sess.UserAgent,
+			"accept-language":    &sess.Language,
+		} {
+			if h := strings.TrimSpace(req.headers[k]); h != "" {
+				*v = h
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("no request to the discord api found")
+	}
+	switch {
+	case sess.Token == "":
+		return nil, errors.New("authorization header not found, make sure the request is authenticated and sensitive data is included in the export")
+	case sess.Cookie == "":
+		return nil, errors.New("cookie header not found, make sure sensitive data is included in the export")
+	case sess.UserAgent == "":
+		return nil, errors.New("user-agent header not found")
+	case sess.Language == "":
+		return nil, errors.New("accept-language header not found")
+	}
+	if sess.SuperProperties == "" {
+		log.Println("⚠️ x-super-properties header not found")
+	}
+	return sess, nil
+}
+
+// isDiscordAPI returns whether the url is a request to the discord api.
+func isDiscordAPI(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host != "discord.com" && !strings.HasSuffix(host, ".discord.com") {
+		return false
+	}
+	return strings.HasPrefix(u.Path, "/api/")
+}
@@ -0,0 +1,101 @@
+package importsession
+
+import (
+	"testing"
+)
+
+const userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+func TestParseHAR(t *testing.T) {
+	data := `{"log": {"entries": [
+		{"request": {"url": "https://discord.com/api/v9/users/@me", "headers": [
+			{"name": ":authority", "value": "discord.com"},
+			{"name": "Authorization", "value": "token1"},
+			{"name": "cookie", "value": "a=1"},
+			{"name": "cookie", "value": "b=2"},
+			{"name": "User-Agent", "value": "` + userAgent + `"},
+			{"name": "Accept-Language", "value": "en-US,en;q=0.9"},
+			{"name": "X-Super-Properties", "value": "eyJvcyI6IldpbmRvd3MifQ=="},
+			{"name": "X-Discord-Locale", "value": "en-US"}
+		]}},
+		{"request": {"url": "https://cdn.discordapp.com/avatars/1.png", "headers": [
+			{"name": "cookie", "value": "other=1"}
+		]}},
+		{"request": {"url": "https://discord.com/api/v9/channels/1/messages", "headers": [
+			{"name": "authorization", "value": "token2"}
+		], "cookies": [{"name": "a", "value": "3"}, {"name": "b", "value": "4"}]}}
+	]}}`
+	sess, err := parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Token != "token2" {
+		t.Errorf("unexpected token %s", sess.Token)
+	}
+	if sess.Cookie != "a=3; b=4" {
+		t.Errorf("unexpected cookie %s", sess.Cookie)
+	}
+	if sess.UserAgent != userAgent || sess.Language != "en-US,en;q=0.9" || sess.Locale != "en-US" || sess.SuperProperties != "eyJvcyI6IldpbmRvd3MifQ==" {
+		t.Errorf("unexpected session %+v", sess)
+	}
+
+	// Sanitized HAR exports don't include the authorization header
+	sanitized := `{"log": {"entries": [{"request": {"url": "https://discord.com/api/v9/users/@me", "headers": [
+		{"name": "user-agent", "value": "` + userAgent + `"}
+	]}}]}}`
+	if _, err := parse([]byte(sanitized)); err == nil {
+		t.Error("expected error with sanitized har")
+	}
+}
+
+func TestParseCurl(t *testing.T) {
+	cmd := `curl 'https://discord.com/api/v9/users/@me/affinities/users' \
+  -H 'accept: */*' \
+  -H 'accept-language: en-US,en;q=0.9' \
+  -H 'authorization: token1' \
+  -b '__dcfduid=abc; __sdcfduid=def' \
+  -H $'referer: https://discord.com/channels/@me' \
+  -H 'user-agent: ` + userAgent + `' \
+  -H "x-discord-locale: en-US" \
+  -H 'x-super-properties: eyJvcyI6IldpbmRvd3MifQ==' \
+  --data-raw $'{"content":"it\'s"}' \
+  --compressed`
+	sess, err := parse([]byte(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Token != "token1" || sess.Cookie != "__dcfduid=abc; __sdcfduid=def" || sess.UserAgent != userAgent ||
+		sess.Language != "en-US,en;q=0.9" || sess.Locale != "en-US" || sess.SuperProperties != "eyJvcyI6IldpbmRvd3MifQ==" {
+		t.Errorf("unexpected session %+v", sess)
+	}
+
+	if _, err := parse([]byte(`curl 'https://example.com/api/v9/users/@me' -H 'authorization: token1'`)); err == nil {
+		t.Error("expected error with non discord request")
+	}
+}
+
+func TestSplitShell(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`curl 'a b' "c \"d\"" e\ f`, []string{"curl", "a b", `c "d"`, "e f"}},
+		{"curl \\\n  -H 'x: y'", []string{"curl", "-H", "x: y"}},
+		{`curl $'a\'b\x41é'`, []string{"curl", "a'bAé"}},
+	}
+	for _, tt := range tests {
+		got, err := splitShell(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("splitShell(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("splitShell(%q) = %q; want %q", tt.in, got, tt.want)
+				break
+			}
+		}
+	}
+}
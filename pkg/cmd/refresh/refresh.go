@@ -6,23 +6,42 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/igolaizola/bulkai"
 	"github.com/igolaizola/bulkai/pkg/discord"
 	"github.com/igolaizola/bulkai/pkg/http"
-	"gopkg.in/yaml.v2"
+	"github.com/igolaizola/bulkai/pkg/session"
 )
 
+// batchSize is the maximum number of URLs refreshed in a single request.
+const batchSize = 50
+
+// sessionCheckpoint is the interval to save the rotated cookies of the session.
+const sessionCheckpoint = 5 * time.Minute
+
 type Config struct {
-	Debug       bool          `yaml:"debug"`
-	Proxy       string        `yaml:"proxy"`
-	Wait        time.Duration `yaml:"wait"`
-	Input       string        `yaml:"input"`
-	Output      string        `yaml:"output"`
+	Debug     bool          `yaml:"debug"`
+	Proxy     string        `yaml:"proxy"`
+	ProxyFile string        `yaml:"proxy-file"`
+	CAFiles   []string      `yaml:"ca-file"`
+	Pins      []string      `yaml:"pin"`
+	Insecure  bool          `yaml:"insecure"`
+	Wait      time.Duration `yaml:"wait"`
+	Input     string        `yaml:"input"`
+	Output    string        `yaml:"output"`
+	// Album is the directory of an album to refresh in place, if set input
+	// and output are ignored.
+	Album string `yaml:"album"`
+	// Margin refreshes URLs that expire within this duration.
+	Margin      time.Duration `yaml:"margin"`
+	Force       bool          `yaml:"force"`
 	SessionFile string        `yaml:"session"`
 	Session     Session       `yaml:"-"`
 }
@@ -35,6 +54,7 @@ type Session struct {
 	SuperProperties string `yaml:"super-properties"`
 	Locale          string `yaml:"locale"`
 	Cookie          string `yaml:"cookie"`
+	HTTP2           string `yaml:"http2"`
 }
 
 func Run(ctx context.Context, cfg *Config) error {
@@ -53,6 +73,9 @@ func Run(ctx context.Context, cfg *Config) error {
 	if cfg.Session.Language == "" {
 		return errors.New("missing language")
 	}
+	if cfg.Album != "" {
+		return runAlbum(ctx, cfg)
+	}
 	if cfg.Input == "" {
 		return errors.New("missing input file")
 	}
@@ -71,117 +94,290 @@ func Run(ctx context.Context, cfg *Config) error {
 		return err
 	}
 
-	// Find all CDN URLs
-	urls := cdnReg.FindAllString(string(b), -1)
-	if len(urls) == 0 {
+	// Find all CDN URLs, they may be escaped if the file is JSON or HTML
+	matches := cdnReg.FindAllString(string(b), -1)
+	if len(matches) == 0 {
 		log.Println("no URLs found")
 		return nil
 	}
+	var urls []string
+	for _, m := range matches {
+		urls = append(urls, unescape(m))
+	}
 
-	// Create a unique list of URLs
-	var unique []string
-	lookup := map[string]struct{}{}
-	for _, url := range urls {
-		if _, ok := lookup[url]; !ok {
-			lookup[url] = struct{}{}
-			unique = append(unique, url)
+	refreshed, err := refresh(ctx, cfg, urls)
+	if len(refreshed) > 0 {
+		// Replace URLs in input file keeping their original escaping
+		text := string(b)
+		replaced := map[string]struct{}{}
+		for _, m := range matches {
+			if _, ok := replaced[m]; ok {
+				continue
+			}
+			replaced[m] = struct{}{}
+			ref, ok := refreshed[unescape(m)]
+			if !ok {
+				continue
+			}
+			text = strings.ReplaceAll(text, m, escapeAs(m, ref))
 		}
+		b = []byte(text)
 	}
 
-	// Create http client
-	httpClient, err := http.NewClient(cfg.Session.JA3, cfg.Session.UserAgent, cfg.Session.Language, cfg.Proxy)
-	if err != nil {
-		return fmt.Errorf("couldn't create http client: %w", err)
+	// Save output file
+	if err := os.WriteFile(cfg.Output, b, 0644); err != nil {
+		return err
 	}
+	return err
+}
 
-	// Set proxy
-	if cfg.Proxy != "" {
-		p := strings.TrimPrefix(cfg.Proxy, "http://")
-		p = strings.TrimPrefix(p, "https://")
-		os.Setenv("HTTPS_PROXY", p)
-		os.Setenv("HTTP_PROXY", p)
+// runAlbum refreshes the URLs of an album, updating its data file and
+// regenerating its html files.
+func runAlbum(ctx context.Context, cfg *Config) error {
+	dataFile := filepath.Join(cfg.Album, "data.json")
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read album data file: %w", err)
+	}
+	var album bulkai.Album
+	if err := json.Unmarshal(data, &album); err != nil {
+		return fmt.Errorf("couldn't unmarshal album data file: %w", err)
+	}
+	var urls []string
+	for _, image := range album.Images {
+		urls = append(urls, image.URL)
 	}
 
-	if err := http.SetCookies(httpClient, "https://discord.com", cfg.Session.Cookie); err != nil {
-		return fmt.Errorf("couldn't set cookies: %w", err)
+	refreshed, err := refresh(ctx, cfg, urls)
+	if len(refreshed) == 0 {
+		return err
 	}
-	defer func() {
-		cookie, err := http.GetCookies(httpClient, "https://discord.com")
-		if err != nil {
-			log.Printf("couldn't get cookies: %v\n", err)
+	for _, image := range album.Images {
+		ref, ok := refreshed[image.URL]
+		if !ok {
+			continue
 		}
-		cfg.Session.Cookie = strings.ReplaceAll(cookie, "\n", "")
-		// TODO: save session to common method
-		data, err := yaml.Marshal(cfg.Session)
-		if err != nil {
-			log.Println(fmt.Errorf("couldn't marshal session: %w", err))
+		image.URL = ref
+		// Media proxy thumbnails share the signature of the original URL
+		if image.Thumbnail != "" {
+			if thumbnail, ok := discord.MediaProxyURL(ref, discord.MediaProxyWidth(image.Thumbnail)); ok {
+				image.Thumbnail = thumbnail
+			}
+		}
+	}
+
+	// Html files are only regenerated if they were already generated
+	_, statErr := os.Stat(filepath.Join(cfg.Album, "remote.html"))
+	html := statErr == nil
+	_, statErr = os.Stat(filepath.Join(cfg.Album, "images", "_thumbnails"))
+	thumbnail := statErr == nil
+	if saveErr := bulkai.SaveAlbum(cfg.Album, &album, thumbnail, html); saveErr != nil {
+		return fmt.Errorf("couldn't save album: %w", saveErr)
+	}
+	log.Printf("album %s updated with %d refreshed URLs\n", cfg.Album, len(refreshed))
+	return err
+}
+
+// refresh refreshes the URLs that are expired or about to expire.
+// It returns the refreshed URLs indexed by the original URL.
+// URLs that couldn't be refreshed are logged and an error with the number of
+// failures is returned.
+func refresh(ctx context.Context, cfg *Config, urls []string) (map[string]string, error) {
+	// Create a unique list of URLs to be refreshed
+	var pending []string
+	lookup := map[string]struct{}{}
+	deadline := time.Now().Add(cfg.Margin)
+	var skipped int
+	for _, u := range urls {
+		if _, ok := lookup[u]; ok {
+			continue
 		}
-		if err := os.WriteFile(cfg.SessionFile, data, 0644); err != nil {
-			log.Println(fmt.Errorf("couldn't write session: %w", err))
+		lookup[u] = struct{}{}
+		if exp, ok := Expiry(u); ok && !cfg.Force && exp.After(deadline) {
+			skipped++
+			continue
 		}
-	}()
+		pending = append(pending, u)
+	}
+	log.Printf("%d URLs to refresh, %d still valid\n", len(pending), skipped)
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	// Create proxy pool, the account uses its sticky proxy
+	tlsCfg := bulkai.NewTLSConfig(cfg.CAFiles, cfg.Pins, cfg.Insecure)
+	pool, err := bulkai.NewProxyPool(ctx, cfg.Proxy, cfg.ProxyFile, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	account, err := discord.TokenUserID(cfg.Session.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create http client, the dialer is also used for the gateway websocket
+	dialer := pool.Dialer(account)
+	httpClient, err := http.NewClient(cfg.Session.JA3, cfg.Session.UserAgent, cfg.Session.Language, "", http.WithHTTP2Fingerprint(cfg.Session.HTTP2), http.WithDialer(dialer), http.WithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create http client: %w", err)
+	}
+	defer func() { _ = http.Close(httpClient) }()
+
+	if err := http.SetCookies(httpClient, "https://discord.com", cfg.Session.Cookie); err != nil {
+		return nil, fmt.Errorf("couldn't set cookies: %w", err)
+	}
+	// Sessions that don't come from a file aren't saved
+	if cfg.SessionFile != "" {
+		saveSession := session.NewStore(cfg.SessionFile).Checkpoint(ctx, sessionCheckpoint, func() (string, error) {
+			cookie, err := http.GetCookies(httpClient, "https://discord.com")
+			return strings.ReplaceAll(cookie, "\n", ""), err
+		})
+		defer saveSession()
+	}
 
 	// Create discord client
+	gatewayTLS, err := tlsCfg.Std()
+	if err != nil {
+		return nil, err
+	}
 	client, err := discord.New(ctx, &discord.Config{
 		Token:           cfg.Session.Token,
 		SuperProperties: cfg.Session.SuperProperties,
 		Locale:          cfg.Session.Locale,
 		UserAgent:       cfg.Session.UserAgent,
 		HTTPClient:      httpClient,
+		Dialer:          dialer,
+		TLSConfig:       gatewayTLS,
 		Debug:           cfg.Debug,
 	})
 	if err != nil {
-		return fmt.Errorf("couldn't create discord client: %w", err)
+		return nil, fmt.Errorf("couldn't create discord client: %w", err)
 	}
 
 	// Start discord client
 	if err := client.Start(ctx); err != nil {
-		return fmt.Errorf("couldn't start discord client: %w", err)
+		return nil, fmt.Errorf("couldn't start discord client: %w", err)
 	}
+	defer func() { _ = client.Stop() }()
 
-	// Refresh URLs
-	wait := 10 * time.Millisecond
-	for _, cdnURL := range unique {
+	// Refresh URLs in batches
+	return refreshBatches(ctx, pending, cfg.Wait, func(ctx context.Context, batch []string) (map[string]string, error) {
+		return refreshBatch(ctx, client, batch)
+	})
+}
+
+// refreshBatches refreshes the URLs in batches with fn, waiting between
+// batches.
+// It returns the refreshed URLs indexed by the original URL.
+// Failed batches are logged and skipped, unless the session is invalid, in
+// which case the rest of the batches would be rejected too.
+func refreshBatches(ctx context.Context, pending []string, wait time.Duration, fn func(context.Context, []string) (map[string]string, error)) (map[string]string, error) {
+	refreshed := map[string]string{}
+	var failed int
+	delay := 10 * time.Millisecond
+	for i := 0; i < len(pending); i += batchSize {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(wait):
+			return refreshed, ctx.Err()
+		case <-time.After(delay):
 		}
-		wait = cfg.Wait
+		delay = wait
 
-		// Refresh URL
-		u := "attachments/refresh-urls"
-		shortURL := strings.Split(cdnURL, "?")[0]
-		req := &refreshURLsRequest{
-			AttachmentURLs: []string{shortURL},
-		}
-		resp, err := client.Do(ctx, "POST", u, req)
+		batch := pending[i:min(i+batchSize, len(pending))]
+		results, err := fn(ctx, batch)
 		if err != nil {
-			return fmt.Errorf("couldn't refresh URL (%s): %w", cdnURL, err)
-		}
-		var refreshResp refreshURLsResponse
-		if err := json.Unmarshal(resp, &refreshResp); err != nil {
-			return fmt.Errorf("couldn't unmarshal response %s: %w", string(resp), err)
+			if ctx.Err() != nil {
+				return refreshed, ctx.Err()
+			}
+			if errors.Is(err, discord.ErrSessionInvalid) {
+				return refreshed, err
+			}
+			log.Printf("couldn't refresh %d URLs: %v\n", len(batch), err)
+			failed += len(batch)
+			continue
 		}
-		if len(refreshResp.RefreshedURLs) == 0 {
-			return fmt.Errorf("no refreshed URLs found (%s)", cdnURL)
+		for _, u := range batch {
+			ref, ok := results[shortURL(u)]
+			if !ok || ref == "" {
+				log.Printf("couldn't refresh URL %s: not found in response\n", u)
+				failed++
+				continue
+			}
+			refreshed[u] = ref
 		}
-		refURL := refreshResp.RefreshedURLs[0]
-		if refURL.Refreshed == "" {
-			return fmt.Errorf("no refreshed URL found (%s)", cdnURL)
-		}
-		// Replace URL in input file
-		b = []byte(strings.ReplaceAll(string(b), cdnURL, refURL.Refreshed))
+		log.Printf("refreshed %d/%d URLs\n", len(refreshed), len(pending))
+	}
+	if failed > 0 {
+		return refreshed, fmt.Errorf("couldn't refresh %d URLs", failed)
 	}
+	return refreshed, nil
+}
 
-	// Save output file
-	if err := os.WriteFile(cfg.Output, b, 0644); err != nil {
-		return err
+// refreshBatch refreshes a batch of URLs.
+// It returns the refreshed URLs indexed by the original URL without query.
+func refreshBatch(ctx context.Context, client *discord.Client, urls []string) (map[string]string, error) {
+	req := &refreshURLsRequest{}
+	for _, u := range urls {
+		req.AttachmentURLs = append(req.AttachmentURLs, shortURL(u))
+	}
+	resp, err := client.Do(ctx, "POST", "attachments/refresh-urls", req)
+	if err != nil {
+		return nil, err
+	}
+	var refreshResp refreshURLsResponse
+	if err := json.Unmarshal(resp, &refreshResp); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal response %s: %w", string(resp), err)
+	}
+	results := map[string]string{}
+	for _, r := range refreshResp.RefreshedURLs {
+		results[shortURL(r.Original)] = r.Refreshed
+	}
+	return results, nil
+}
+
+// Expiry returns the expiration time of a discord CDN URL, which is encoded
+// as a hexadecimal unix timestamp in the `ex` query parameter.
+func Expiry(u string) (time.Time, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ex := parsed.Query().Get("ex")
+	if ex == "" {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(ex, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+func shortURL(u string) string {
+	return strings.Split(u, "?")[0]
+}
+
+// Escaped forms of the query separator in JSON and HTML files.
+var escapes = []string{`\u0026`, "&amp;"}
+
+func unescape(u string) string {
+	for _, e := range escapes {
+		u = strings.ReplaceAll(u, e, "&")
+	}
+	return u
+}
+
+// escapeAs escapes the URL the same way the original one was escaped.
+func escapeAs(original, u string) string {
+	for _, e := range escapes {
+		if strings.Contains(original, e) {
+			return strings.ReplaceAll(u, "&", e)
+		}
 	}
-	return nil
+	return u
 }
 
-var cdnReg = regexp.MustCompile(`https:\/\/cdn\.discordapp\.com\/attachments\/[^"\s,]+`)
+var cdnReg = regexp.MustCompile(`https:\/\/(cdn\.discordapp\.com|media\.discordapp\.net)\/(ephemeral-)?attachments\/[^"'<>\s,]+`)
 
 type refreshURLsRequest struct {
 	AttachmentURLs []string `json:"attachment_urls"`
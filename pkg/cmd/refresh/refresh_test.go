@@ -0,0 +1,85 @@
+package refresh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/discord"
+)
+
+func TestExpiry(t *testing.T) {
+	tests := []struct {
+		url  string
+		want time.Time
+		ok   bool
+	}{
+		{"https://cdn.discordapp.com/attachments/1/2/image.png?ex=65e1f3a0&is=65cf7ea0&hm=abc", time.Unix(0x65e1f3a0, 0), true},
+		{"https://media.discordapp.net/attachments/1/2/image.png?ex=65e1f3a0", time.Unix(0x65e1f3a0, 0), true},
+		{"https://cdn.discordapp.com/attachments/1/2/image.png", time.Time{}, false},
+		{"https://cdn.discordapp.com/attachments/1/2/image.png?ex=zz", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := Expiry(tt.url)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("Expiry(%s) = %v, %v; want %v, %v", tt.url, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCDNRegex(t *testing.T) {
+	text := `{"url": "https://cdn.discordapp.com/attachments/1/2/a.png?ex=1&is=2"}
+<img src="https://media.discordapp.net/attachments/1/2/b.png?ex=1&amp;is=2">`
+	matches := cdnReg.FindAllString(text, -1)
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d: %v", len(matches), matches)
+	}
+	want := []string{
+		"https://cdn.discordapp.com/attachments/1/2/a.png?ex=1&is=2",
+		"https://media.discordapp.net/attachments/1/2/b.png?ex=1&is=2",
+	}
+	for i, m := range matches {
+		if got := unescape(m); got != want[i] {
+			t.Errorf("unescape(%s) = %s; want %s", m, got, want[i])
+		}
+		if got := escapeAs(m, unescape(m)); got != m {
+			t.Errorf("escapeAs(%s) = %s; want %s", m, got, m)
+		}
+	}
+}
+
+func TestRefreshBatches(t *testing.T) {
+	var pending []string
+	for i := 0; i < 3*batchSize; i++ {
+		pending = append(pending, fmt.Sprintf("https://cdn.discordapp.com/attachments/1/2/%d.png?ex=1", i))
+	}
+
+	// Failed batches are skipped
+	var calls int
+	refreshed, err := refreshBatches(context.Background(), pending, 0, func(_ context.Context, batch []string) (map[string]string, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("bad gateway")
+		}
+		results := map[string]string{}
+		for _, u := range batch {
+			results[shortURL(u)] = u + "&refreshed"
+		}
+		return results, nil
+	})
+	if calls != 3 || len(refreshed) != 2*batchSize || err == nil {
+		t.Errorf("got %d calls, %d refreshed, error %v", calls, len(refreshed), err)
+	}
+
+	// An invalid session aborts immediately
+	calls = 0
+	_, err = refreshBatches(context.Background(), pending, 0, func(context.Context, []string) (map[string]string, error) {
+		calls++
+		return nil, fmt.Errorf("%w: 401 unauthorized", discord.ErrSessionInvalid)
+	})
+	if calls != 1 || !errors.Is(err, discord.ErrSessionInvalid) {
+		t.Errorf("got %d calls, error %v", calls, err)
+	}
+}
@@ -1,6 +1,10 @@
 package discord
 
-import "github.com/bwmarrin/discordgo"
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
 
 type InteractionCommand struct {
 	Type          int                    `json:"type"`
@@ -42,6 +46,9 @@ const (
 	InteractionSuccessEvent = "INTERACTION_SUCCESS"
 	MessageCreateEvent      = "MESSAGE_CREATE"
 	MessageUpdateEvent      = "MESSAGE_UPDATE"
+	// MessageHistoryEvent is used to replay messages fetched from the channel
+	// history. It isn't sent by discord.
+	MessageHistoryEvent = "MESSAGE_HISTORY"
 )
 
 type Message struct {
@@ -55,6 +62,12 @@ type Message struct {
 	// The ID of the guild in which the message was sent.
 	GuildID string `json:"guild_id,omitempty"`
 
+	// The author of the message.
+	Author *discordgo.User `json:"author,omitempty"`
+
+	// The time at which the message was sent.
+	Timestamp time.Time `json:"timestamp"`
+
 	// The content of the message.
 	Content string `json:"content"`
 
@@ -6,7 +6,10 @@ import (
 	"compress/zlib"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,7 +17,9 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +27,7 @@ import (
 	http "github.com/Danny-Dasilva/fhttp"
 	"github.com/andybalholm/brotli"
 	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
 )
 
 type Client struct {
@@ -33,14 +39,30 @@ type Client struct {
 	locale          string
 	userAgent       string
 	client          *http.Client
+	downloadClient  *http.Client
 	session         *discordgo.Session
 	callbacks       []func(*discordgo.Event)
 	dm              map[string]string
 	debug           bool
 
-	callbackLck *sync.Mutex
-	doLck       *sync.Mutex
-	downloadLck *sync.Mutex
+	reconnection       *Reconnection
+	invalid            chan struct{}
+	invalidErr         error
+	invalidOnce        *sync.Once
+	reconnectCallbacks []func(bool)
+	disconnected       chan struct{}
+	connections        int32
+	cancel             context.CancelFunc
+	watched            map[string]string
+	downloadsPerHost   int
+	downloadSlots      map[string]chan struct{}
+
+	callbackLck  *sync.Mutex
+	dmLck        *sync.Mutex
+	reconnectLck *sync.Mutex
+	historyLck   *sync.Mutex
+	doLck        *sync.Mutex
+	downloadLck  *sync.Mutex
 }
 
 type Config struct {
@@ -50,8 +72,16 @@ type Config struct {
 	UserAgent       string
 	Referer         string
 	HTTPClient      *http.Client
-	Dialer          func(ctx context.Context, network, addr string) (net.Conn, error)
-	Debug           bool
+	// DownloadClient is used to download files, defaults to HTTPClient.
+	DownloadClient *http.Client
+	Dialer         func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLSConfig verifies the certificates of the gateway websocket, defaults
+	// to the system roots.
+	TLSConfig *tls.Config
+	Debug     bool
+	// DownloadsPerHost is the maximum number of concurrent downloads from the
+	// same host, defaults to 1.
+	DownloadsPerHost int
 }
 
 type SuperProperties struct {
@@ -72,6 +102,15 @@ type SuperProperties struct {
 	raw                 string
 }
 
+// ParseSuperProperties decodes base64 encoded super properties.
+func ParseSuperProperties(raw string) (*SuperProperties, error) {
+	s := &SuperProperties{raw: raw}
+	if err := s.Unmarshal(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 func (s *SuperProperties) Unmarshal() error {
 	if s.raw == "" {
 		return fmt.Errorf("discord: super properties are empty")
@@ -97,46 +136,78 @@ func (s *SuperProperties) Marshal() error {
 
 func New(ctx context.Context, cfg *Config) (*Client, error) {
 	// Parse super properties
-	superProperties := &SuperProperties{
-		raw: cfg.SuperProperties,
-	}
-	if err := superProperties.Unmarshal(); err != nil {
+	superProperties, err := ParseSuperProperties(cfg.SuperProperties)
+	if err != nil {
 		return nil, err
 	}
-	split := strings.SplitN(cfg.Token, ".", 2)
-	if len(split) != 2 {
-		return nil, fmt.Errorf("discord: couldn't parse token")
-	}
-	userID, err := base64.RawStdEncoding.DecodeString(split[0])
+	userID, err := TokenUserID(cfg.Token)
 	if err != nil {
-		return nil, fmt.Errorf("discord: couldn't decode user id %s: %w", string(split[0]), err)
+		return nil, err
 	}
 
-	session, err := newSession(cfg.Dialer, cfg.Token, cfg.UserAgent)
+	session, err := newSession(cfg.Dialer, cfg.TLSConfig, cfg.Token, cfg.UserAgent)
 	if err != nil {
 		return nil, fmt.Errorf("discord: couldn't create session: %w", err)
 	}
 
+	downloadsPerHost := cfg.DownloadsPerHost
+	if downloadsPerHost < 1 {
+		downloadsPerHost = 1
+	}
+
+	downloadClient := cfg.DownloadClient
+	if downloadClient == nil {
+		downloadClient = cfg.HTTPClient
+	}
+
 	c := &Client{
-		token:           cfg.Token,
-		userID:          string(userID),
-		superProperties: superProperties,
-		locale:          cfg.Locale,
-		userAgent:       cfg.UserAgent,
-		Referer:         cfg.Referer,
-		client:          cfg.HTTPClient,
-		callbacks:       []func(*discordgo.Event){},
-		session:         session,
-		dm:              make(map[string]string),
-		debug:           cfg.Debug,
-		callbackLck:     &sync.Mutex{},
-		doLck:           &sync.Mutex{},
-		downloadLck:     &sync.Mutex{},
+		token:            cfg.Token,
+		userID:           userID,
+		superProperties:  superProperties,
+		locale:           cfg.Locale,
+		userAgent:        cfg.UserAgent,
+		Referer:          cfg.Referer,
+		client:           cfg.HTTPClient,
+		downloadClient:   downloadClient,
+		callbacks:        []func(*discordgo.Event){},
+		session:          session,
+		dm:               make(map[string]string),
+		debug:            cfg.Debug,
+		reconnection:     newReconnection(),
+		invalid:          make(chan struct{}),
+		invalidOnce:      &sync.Once{},
+		disconnected:     make(chan struct{}, 1),
+		watched:          make(map[string]string),
+		downloadsPerHost: downloadsPerHost,
+		downloadSlots:    make(map[string]chan struct{}),
+		callbackLck:      &sync.Mutex{},
+		dmLck:            &sync.Mutex{},
+		reconnectLck:     &sync.Mutex{},
+		historyLck:       &sync.Mutex{},
+		doLck:            &sync.Mutex{},
+		downloadLck:      &sync.Mutex{},
 	}
 	return c, nil
 }
 
+// TokenUserID returns the user ID encoded in the first part of the token.
+func TokenUserID(token string) (string, error) {
+	split := strings.SplitN(token, ".", 2)
+	if len(split) != 2 {
+		return "", fmt.Errorf("discord: couldn't parse token")
+	}
+	userID, err := base64.RawStdEncoding.DecodeString(split[0])
+	if err != nil {
+		return "", fmt.Errorf("discord: couldn't decode user id %s: %w", split[0], err)
+	}
+	return string(userID), nil
+}
+
+// Session returns the current gateway session ID.
+// It may change after a reconnection, so it must be read for each interaction.
 func (c *Client) Session() string {
+	c.session.State.RLock()
+	defer c.session.State.RUnlock()
 	return c.session.State.SessionID
 }
 
@@ -147,35 +218,66 @@ func (c *Client) OnEvent(callback func(*discordgo.Event)) {
 }
 
 func (c *Client) DM(userID string) string {
+	c.dmLck.Lock()
+	defer c.dmLck.Unlock()
 	return c.dm[userID]
 }
 
+func (c *Client) updateDM() {
+	c.session.State.RLock()
+	defer c.session.State.RUnlock()
+	c.dmLck.Lock()
+	defer c.dmLck.Unlock()
+	for _, p := range c.session.State.PrivateChannels {
+		if len(p.Recipients) != 1 {
+			continue
+		}
+		c.dm[p.Recipients[0].ID] = p.ID
+	}
+}
+
 func (c *Client) Start(ctx context.Context) error {
 	c.session.AddHandler(func(s *discordgo.Session, e interface{}) {
 		evt, ok := e.(*discordgo.Event)
 		if !ok {
 			return
 		}
-		c.callbackLck.Lock()
-		defer c.callbackLck.Unlock()
-		for _, callback := range c.callbacks {
-			callback(evt)
+		c.seen(evt)
+		c.replay(evt)
+	})
+	c.session.AddHandler(func(s *discordgo.Session, e *discordgo.Ready) {
+		c.onReady(false)
+	})
+	c.session.AddHandler(func(s *discordgo.Session, e *discordgo.Resumed) {
+		c.onReady(true)
+	})
+	c.session.AddHandler(func(s *discordgo.Session, e *discordgo.Disconnect) {
+		select {
+		case c.disconnected <- struct{}{}:
+		default:
 		}
 	})
+
+	// Reconnections are handled by the supervisor
+	c.session.ShouldReconnectOnError = false
 	if err := c.session.Open(); err != nil {
-		return fmt.Errorf("discord: couldn't open session: %w", err)
-	}
-	for _, p := range c.session.State.PrivateChannels {
-		if len(p.Recipients) != 1 {
-			continue
+		if authenticationFailed(err) {
+			err = c.invalidate(err)
 		}
-		c.dm[p.Recipients[0].ID] = p.ID
+		return fmt.Errorf("discord: couldn't open session: %w", err)
 	}
+	c.updateDM()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.supervise(ctx)
 	return nil
 }
 
 func (c *Client) Stop() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
 	return c.session.Close()
 }
 
@@ -194,13 +296,90 @@ func (c *Client) Do(ctx context.Context, method string, path string, body interf
 
 var errBadGateway = errors.New("discord: bad gateway")
 
+// ErrSessionInvalid is returned when discord rejects the token or the
+// cookies of the session, because they expired or were revoked.
+// Requests aren't retried, a new session must be created.
+var ErrSessionInvalid = errors.New("discord: session is invalid or expired")
+
+// closeAuthenticationFailed is the gateway close code sent when the token is
+// invalid.
+const closeAuthenticationFailed = 4004
+
+// permissionCodes are the error codes of forbidden responses that are caused
+// by missing permissions instead of an invalid session.
+var permissionCodes = map[int]bool{
+	50001: true, // Missing access
+	50007: true, // Cannot send messages to this user
+	50013: true, // Missing permissions
+}
+
+// invalidSession returns whether an error response means that the session is
+// no longer valid.
+// The error is the one decoded from the response body, nil if the body isn't
+// a discord error.
+// Forbidden responses that aren't discord errors, like cloudflare blocks or
+// banned proxies, aren't caused by the session.
+func invalidSession(statusCode int, err error) bool {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		var discordErr Error
+		if !errors.As(err, &discordErr) || discordErr.Message == "" {
+			return false
+		}
+		return !permissionCodes[discordErr.Code]
+	default:
+		return false
+	}
+}
+
+// authenticationFailed returns whether the gateway connection was closed
+// because the token is invalid.
+func authenticationFailed(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) && closeErr.Code == closeAuthenticationFailed
+}
+
+// invalidate marks the session as invalid and returns the error wrapped with
+// ErrSessionInvalid.
+func (c *Client) invalidate(err error) error {
+	err = fmt.Errorf("%w: %w", ErrSessionInvalid, err)
+	c.invalidOnce.Do(func() {
+		c.invalidErr = err
+		close(c.invalid)
+	})
+	return err
+}
+
+// Invalid returns a channel that is closed when discord rejects the session.
+func (c *Client) Invalid() <-chan struct{} {
+	return c.invalid
+}
+
+// Err returns the error that invalidated the session, or nil if the session
+// is valid.
+func (c *Client) Err() error {
+	select {
+	case <-c.invalid:
+		return c.invalidErr
+	default:
+		return nil
+	}
+}
+
 type Error struct {
-	Code      int    `json:"code"`
-	Message   string `json:"message"`
-	temporary bool
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int `json:"-"`
+	temporary  bool
 }
 
 func (e Error) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("discord: %s", e.Message)
+	}
 	return fmt.Sprintf("discord: %s (%d)", e.Message, e.Code)
 }
 
@@ -210,11 +389,12 @@ func (e Error) Temporary() bool {
 
 var ErrMessageNotFound = &Error{Message: "Unknown Message", Code: 10008, temporary: false}
 
-func parseError(raw string) error {
+func parseError(statusCode int, raw string) error {
 	var err Error
 	if err := json.Unmarshal([]byte(raw), &err); err != nil {
 		return nil
 	}
+	err.StatusCode = statusCode
 	err.temporary = true
 	switch err.Code {
 	case 10008:
@@ -298,38 +478,113 @@ func (c *Client) do(method string, path string, body interface{}) ([]byte, error
 		return nil, errBadGateway
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		if err := parseError(string(data)); err != nil {
-			return nil, err
+		parsed := parseError(resp.StatusCode, string(data))
+		err := parsed
+		if err == nil {
+			err = Error{
+				Message:    fmt.Sprintf("request %s returned status code %d (%s)", path, resp.StatusCode, string(data)),
+				StatusCode: resp.StatusCode,
+				temporary:  true,
+			}
 		}
-		return nil, fmt.Errorf("discord: request %s returned status code %d (%s)", path, resp.StatusCode, string(data))
+		if invalidSession(resp.StatusCode, parsed) {
+			return nil, c.invalidate(err)
+		}
+		return nil, err
 	}
 	return data, nil
 }
 
-func (c *Client) Download(ctx context.Context, u string, output string) error {
-	return retry(ctx, 5, func() error {
-		return c.download(ctx, u, output)
+// File is a downloaded file.
+type File struct {
+	// Path of the file, its extension is obtained from the content type.
+	Path        string
+	ContentType string
+	Size        int64
+	// Hash is the hex encoded SHA-256 of the file.
+	Hash string
+}
+
+var contentTypeExts = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+// Download downloads a file to the output path.
+// The file is written to a temporary `.part` file, which is used to resume
+// the download if it's interrupted, and renamed when it's complete.
+// The output extension is replaced by the one of the content type.
+func (c *Client) Download(ctx context.Context, u string, output string) (*File, error) {
+	var file *File
+	err := retry(ctx, 5, func() error {
+		f, err := c.download(ctx, u, output)
+		if err != nil {
+			return err
+		}
+		file = f
+		return nil
 	})
+	return file, err
 }
 
-func (c *Client) download(ctx context.Context, u string, output string) error {
-	// Rate limit
+// downloadSlot waits until a download slot for the host of the url is
+// available. The returned function releases the slot after a small random
+// delay, so the same host doesn't receive bursts of requests.
+func (c *Client) downloadSlot(ctx context.Context, u string) (func(), error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("discord: couldn't parse url %s: %w", u, err)
+	}
 	c.downloadLck.Lock()
-	defer func() {
-		rnd, _ := rand.Int(rand.Reader, big.NewInt(1000))
+	slots, ok := c.downloadSlots[parsed.Host]
+	if !ok {
+		slots = make(chan struct{}, c.downloadsPerHost)
+		c.downloadSlots[parsed.Host] = slots
+	}
+	c.downloadLck.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case slots <- struct{}{}:
+	}
+	return func() {
+		rnd, _ := rand.Int(rand.Reader, big.NewInt(500))
 		ms := time.Duration(int(rnd.Int64())) * time.Millisecond
-		time.Sleep(1*time.Second + ms)
-		c.downloadLck.Unlock()
-	}()
+		time.Sleep(ms)
+		<-slots
+	}, nil
+}
+
+func (c *Client) download(ctx context.Context, u string, output string) (*File, error) {
+	// Rate limit
+	release, err := c.downloadSlot(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Check if there is a partial download
+	part := output + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		return fmt.Errorf("discord: couldn't create request: %w", err)
+		return nil, fmt.Errorf("discord: couldn't create request: %w", err)
 	}
 	c.addHeaders(req)
-	resp, err := c.client.Do(req)
+	if offset > 0 {
+		req.Header.Set("range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("accept-encoding", "identity")
+	}
+	resp, err := c.downloadClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("discord: couldn't do request %s: %w", u, err)
+		return nil, fmt.Errorf("discord: couldn't do request %s: %w", u, err)
 	}
 	defer resp.Body.Close()
 
@@ -342,34 +597,79 @@ func (c *Client) download(ctx context.Context, u string, output string) error {
 	case "gzip":
 		respBody, err = gzip.NewReader(resp.Body)
 		if err != nil {
-			return fmt.Errorf("discord: couldn't create gzip reader: %w", err)
+			return nil, fmt.Errorf("discord: couldn't create gzip reader: %w", err)
 		}
 	case "deflate":
 		respBody, err = zlib.NewReader(resp.Body)
 		if err != nil {
-			return fmt.Errorf("discord: couldn't create zlib reader: %w", err)
+			return nil, fmt.Errorf("discord: couldn't create zlib reader: %w", err)
 		}
 	}
 
 	if resp.StatusCode == http.StatusBadGateway {
-		return errBadGateway
+		return nil, errBadGateway
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The partial download is invalid, start again
+		_ = os.Remove(part)
+		return nil, fmt.Errorf("discord: couldn't resume download %s", u)
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		respBody, err := io.ReadAll(respBody)
 		if err != nil {
-			return fmt.Errorf("discord: couldn't read response body: %w", err)
+			return nil, fmt.Errorf("discord: couldn't read response body: %w", err)
 		}
-		return fmt.Errorf("discord: request %s returned status code %d (%s)", u, resp.StatusCode, string(respBody))
+		return nil, fmt.Errorf("discord: request %s returned status code %d (%s)", u, resp.StatusCode, string(respBody))
 	}
-	f, err := os.Create(output)
+
+	// Append to the partial download only if the server supports ranges
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resp.StatusCode == http.StatusPartialContent {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(part, flags, 0644)
 	if err != nil {
-		return fmt.Errorf("discord: couldn't create file %s: %w", output, err)
+		return nil, fmt.Errorf("discord: couldn't create file %s: %w", part, err)
 	}
-	defer f.Close()
-	if _, err = io.Copy(f, respBody); err != nil {
-		return fmt.Errorf("discord: couldn't write to file %s: %w", output, err)
+	n, err := io.Copy(f, respBody)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("discord: couldn't write to file %s: %w", part, err)
 	}
-	return nil
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("discord: couldn't close file %s: %w", part, err)
+	}
+	if resp.ContentLength >= 0 && resp.Header.Get("content-encoding") == "" && n != resp.ContentLength {
+		return nil, fmt.Errorf("discord: incomplete download %s: got %d bytes, want %d", u, n, resp.ContentLength)
+	}
+
+	// Obtain the extension from the content type
+	contentType := strings.TrimSpace(strings.Split(resp.Header.Get("content-type"), ";")[0])
+	if ext, ok := contentTypeExts[contentType]; ok {
+		output = strings.TrimSuffix(output, filepath.Ext(output)) + ext
+	}
+
+	// Calculate size and hash
+	f, err = os.Open(part)
+	if err != nil {
+		return nil, fmt.Errorf("discord: couldn't open file %s: %w", part, err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	_ = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("discord: couldn't read file %s: %w", part, err)
+	}
+
+	if err := os.Rename(part, output); err != nil {
+		return nil, fmt.Errorf("discord: couldn't rename file %s: %w", part, err)
+	}
+	return &File{
+		Path:        output,
+		ContentType: contentType,
+		Size:        size,
+		Hash:        hex.EncodeToString(h.Sum(nil)),
+	}, nil
 }
 
 var backoff = []time.Duration{
@@ -390,7 +690,10 @@ func retry(ctx context.Context, maxAttempts int, fn func() error) error {
 		if attempts >= maxAttempts {
 			return err
 		}
-		// If the error is not temporary, we stop
+		// If the session is invalid or the error is not temporary, we stop
+		if errors.Is(err, ErrSessionInvalid) {
+			return err
+		}
 		var discordErr Error
 		if errors.As(err, &discordErr) && !discordErr.Temporary() {
 			return err
@@ -435,10 +738,13 @@ func webkitID(length int) string {
 	return string(b)
 }
 
+// addHeaders sets the headers of discord requests.
+// Browser dependent headers (user agent, language, client hints) and the
+// header order are set by the http client based on its browser profile.
 func (c *Client) addHeaders(req *http.Request) {
 	// Add headers
 	switch req.URL.Host {
-	case "cdn.discordapp.com":
+	case "cdn.discordapp.com", mediaProxyHost:
 		req.Header = http.Header{
 			"accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9"},
 			"accept-encoding":           {"gzip, deflate, br"},
@@ -498,32 +804,4 @@ func (c *Client) addHeaders(req *http.Request) {
 			}
 		}
 	}
-	// Add headers order
-	req.Header[http.HeaderOrderKey] = []string{
-		"accept",
-		"accept-encoding",
-		"accept-language",
-		"content-type",
-		"cookie",
-		"origin",
-		"referer",
-		"sec-ch-ua",
-		"sec-ch-ua-mobile",
-		"sec-ch-ua-platform",
-		"sec-fetch-dest",
-		"sec-fetch-mode",
-		"sec-fetch-site",
-		"sec-fetch-user",
-		"upgrade-insecure-requests",
-		"user-agent",
-		"x-debug-options",
-		"x-discord-locale",
-		"x-super-properties",
-	}
-	req.Header[http.PHeaderOrderKey] = []string{
-		":authority",
-		":method",
-		":path",
-		":scheme",
-	}
 }
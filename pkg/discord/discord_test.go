@@ -1,9 +1,27 @@
 package discord
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	http "github.com/Danny-Dasilva/fhttp"
 	"github.com/bwmarrin/snowflake"
+	"github.com/gorilla/websocket"
+	bulkaihttp "github.com/igolaizola/bulkai/pkg/http"
 )
 
 func TestSnowflake(t *testing.T) {
@@ -31,3 +49,221 @@ func TestMarshalSuperProperties(t *testing.T) {
 		t.Errorf("got %s, want %s", got.raw, want.raw)
 	}
 }
+
+func TestSnowflakeFromTime(t *testing.T) {
+	// 1067911534862139392 was created at 2023-01-25T20:59:10.748Z
+	ts := time.Date(2023, 1, 25, 20, 59, 10, 748000000, time.UTC)
+	got := SnowflakeFromTime(ts)
+	if want := "1067911534862139392"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if !snowflakeLess(got, "1067911534862139393") {
+		t.Errorf("got %s, want lower than 1067911534862139393", got)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		ranges = append(ranges, r.Header.Get("range"))
+		w.Header().Set("content-type", "image/png")
+		nethttp.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "image.webp")
+	if err := os.WriteFile(output+".part", content[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{
+		downloadClient:   &http.Client{},
+		downloadLck:      &sync.Mutex{},
+		downloadsPerHost: 1,
+		downloadSlots:    make(map[string]chan struct{}),
+	}
+	file, err := c.Download(context.Background(), srv.URL+"/image.webp", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bytes=4000-"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got ranges %v, want %v", ranges, want)
+	}
+	if want := filepath.Join(dir, "image.png"); file.Path != want {
+		t.Errorf("got path %s, want %s", file.Path, want)
+	}
+	got, err := os.ReadFile(file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded content mismatch")
+	}
+	sum := sha256.Sum256(content)
+	if file.Size != int64(len(content)) || file.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("got size %d hash %s", file.Size, file.Hash)
+	}
+	if _, err := os.Stat(output + ".part"); !os.IsNotExist(err) {
+		t.Error("partial file wasn't removed")
+	}
+}
+
+func TestMediaProxyURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		width int
+		want  string
+		ok    bool
+	}{
+		{
+			"https://cdn.discordapp.com/attachments/1/2/image.png?ex=65e1f3a0&is=65cf7ea0&hm=abc",
+			512,
+			"https://media.discordapp.net/attachments/1/2/image.png?ex=65e1f3a0&format=webp&hm=abc&is=65cf7ea0&width=512",
+			true,
+		},
+		{
+			"https://media.discordapp.net/attachments/1/2/image.png?width=256&format=png",
+			1024,
+			"https://media.discordapp.net/attachments/1/2/image.png?format=webp&width=1024",
+			true,
+		},
+		{"https://cdn.midjourney.com/abc/0_0.png", 512, "", false},
+		{"https://cdn.discordapp.com/avatars/1/2.png", 512, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := MediaProxyURL(tt.url, tt.width)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("MediaProxyURL(%s, %d) = %s, %v; want %s, %v", tt.url, tt.width, got, ok, tt.want, tt.ok)
+		}
+		if ok && MediaProxyWidth(got) != tt.width {
+			t.Errorf("MediaProxyWidth(%s) = %d; want %d", got, MediaProxyWidth(got), tt.width)
+		}
+	}
+}
+
+func TestSessionInvalid(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		body       string
+		want       bool
+	}{
+		{401, `{"message": "401: Unauthorized", "code": 0}`, true},
+		{403, `{"message": "You need to verify your account", "code": 40002}`, true},
+		{403, `{"message": "Missing Access", "code": 50001}`, false},
+		{403, `{"message": "Missing Permissions", "code": 50013}`, false},
+		{403, `<!DOCTYPE html><html><title>Attention Required! | Cloudflare</title></html>`, false},
+		{403, `{}`, false},
+		{401, `<html>401 Unauthorized</html>`, true},
+		{429, `{"message": "You are being rate limited.", "code": 0}`, false},
+	}
+	for _, tt := range tests {
+		err := parseError(tt.statusCode, tt.body)
+		if got := invalidSession(tt.statusCode, err); got != tt.want {
+			t.Errorf("%d %s: got %v, want %v", tt.statusCode, tt.body, got, tt.want)
+		}
+	}
+
+	c := &Client{
+		invalid:     make(chan struct{}),
+		invalidOnce: &sync.Once{},
+	}
+	if c.Err() != nil {
+		t.Fatal("new client shouldn't be invalid")
+	}
+
+	// Invalid sessions aren't retried
+	var attempts int
+	err := retry(context.Background(), 3, func() error {
+		attempts++
+		return c.invalidate(parseError(401, `{"message": "401: Unauthorized", "code": 0}`))
+	})
+	if !errors.Is(err, ErrSessionInvalid) || attempts != 1 {
+		t.Errorf("got %v after %d attempts", err, attempts)
+	}
+	select {
+	case <-c.Invalid():
+	default:
+		t.Error("invalid channel isn't closed")
+	}
+	if !errors.Is(c.Err(), ErrSessionInvalid) {
+		t.Errorf("got %v, want ErrSessionInvalid", c.Err())
+	}
+
+	// Gateway authentication failures are detected
+	closeErr := &websocket.CloseError{Code: closeAuthenticationFailed, Text: "Authentication failed."}
+	if !authenticationFailed(fmt.Errorf("wrapped: %w", closeErr)) {
+		t.Error("authentication failure not detected")
+	}
+	if authenticationFailed(&websocket.CloseError{Code: 4000}) {
+		t.Error("unexpected authentication failure")
+	}
+}
+
+func TestAddHeadersMedia(t *testing.T) {
+	c := &Client{}
+	for _, u := range []string{
+		"https://cdn.discordapp.com/attachments/1/2/image.png",
+		"https://media.discordapp.net/attachments/1/2/image.png?format=webp&width=256",
+	} {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.addHeaders(req)
+		// Headers are set in lowercase, so they aren't canonicalized
+		if dest := req.Header["sec-fetch-dest"]; len(dest) != 1 || dest[0] != "document" {
+			t.Errorf("%s: missing image headers: %v", u, req.Header)
+		}
+	}
+}
+
+func TestGatewayTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *bulkaihttp.TLSConfig
+		wantErr bool
+	}{
+		{"system roots", nil, true},
+		{"custom ca", &bulkaihttp.TLSConfig{CAFiles: []string{caFile}}, false},
+		{"insecure", &bulkaihttp.TLSConfig{Insecure: true}, false},
+	}
+	for _, tt := range tests {
+		tlsConfig, err := tt.cfg.Std()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The gateway connects through the dialer of the proxy pool
+		var dialer net.Dialer
+		s, err := newSession(dialer.DialContext, tlsConfig, "token", "agent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, _, err := s.Dialer.Dial("wss://"+srv.Listener.Addr().String(), nil)
+		if err == nil {
+			_ = conn.Close()
+		}
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// historyLimit is the maximum number of messages per history request.
+	historyLimit = 100
+	// historyMaxPages is the maximum number of history requests per backfill.
+	historyMaxPages = 20
+	// discordEpoch is the first second of 2015 in milliseconds.
+	discordEpoch = 1420070400000
+)
+
+// SnowflakeFromTime returns the smallest snowflake ID of the given time.
+// It can be used to fetch the messages sent after that time.
+func SnowflakeFromTime(t time.Time) string {
+	ms := t.UnixMilli() - discordEpoch
+	if ms < 0 {
+		ms = 0
+	}
+	return strconv.FormatInt(ms<<22, 10)
+}
+
+// Watch adds a channel to be backfilled from its history when the gateway
+// reconnects with a new session.
+func (c *Client) Watch(channelID string) {
+	c.historyLck.Lock()
+	defer c.historyLck.Unlock()
+	if _, ok := c.watched[channelID]; ok {
+		return
+	}
+	c.watched[channelID] = SnowflakeFromTime(time.Now())
+}
+
+// seen updates the last message seen in a watched channel.
+func (c *Client) seen(e *discordgo.Event) {
+	if e.Type != MessageCreateEvent {
+		return
+	}
+	var msg struct {
+		ID        string `json:"id"`
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(e.RawData, &msg); err != nil {
+		return
+	}
+	c.historyLck.Lock()
+	defer c.historyLck.Unlock()
+	last, ok := c.watched[msg.ChannelID]
+	if !ok || !snowflakeLess(last, msg.ID) {
+		return
+	}
+	c.watched[msg.ChannelID] = msg.ID
+}
+
+// backfillWatched backfills the watched channels and returns whether all of
+// them were backfilled successfully.
+func (c *Client) backfillWatched(ctx context.Context) bool {
+	c.historyLck.Lock()
+	watched := make(map[string]string)
+	for channelID, last := range c.watched {
+		watched[channelID] = last
+	}
+	c.historyLck.Unlock()
+
+	ok := true
+	for channelID, last := range watched {
+		if err := c.Backfill(ctx, channelID, last); err != nil {
+			log.Println(err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Backfill fetches the messages of a channel sent after the given message ID
+// and replays them, from oldest to newest, to the event callbacks using the
+// MessageHistoryEvent type.
+func (c *Client) Backfill(ctx context.Context, channelID, after string) error {
+	for page := 0; page < historyMaxPages; page++ {
+		entries, err := c.history(ctx, channelID, after)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			c.replay(&discordgo.Event{
+				Type:    MessageHistoryEvent,
+				RawData: e.raw,
+			})
+			after = e.id
+		}
+		if len(entries) < historyLimit {
+			return nil
+		}
+	}
+	log.Printf("discord: channel %s history backfill stopped after %d messages\n", channelID, historyLimit*historyMaxPages)
+	return nil
+}
+
+// Messages returns the next page of messages of a channel sent after the
+// given message ID, sorted from oldest to newest.
+// Use "0" to start from the first message of the channel.
+func (c *Client) Messages(ctx context.Context, channelID, after string) ([]*Message, error) {
+	entries, err := c.history(ctx, channelID, after)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for _, e := range entries {
+		var msg Message
+		if err := json.Unmarshal(e.raw, &msg); err != nil {
+			return nil, fmt.Errorf("discord: couldn't unmarshal message %s: %w", string(e.raw), err)
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+type historyEntry struct {
+	id  string
+	raw json.RawMessage
+}
+
+// history returns a page of raw messages of a channel sent after the given
+// message ID, sorted from oldest to newest.
+func (c *Client) history(ctx context.Context, channelID, after string) ([]historyEntry, error) {
+	u := fmt.Sprintf("channels/%s/messages?after=%s&limit=%d", channelID, after, historyLimit)
+	resp, err := c.Do(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("discord: couldn't get channel %s messages: %w", channelID, err)
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(resp, &raws); err != nil {
+		return nil, fmt.Errorf("discord: couldn't unmarshal channel messages %s: %w", string(resp), err)
+	}
+	var entries []historyEntry
+	for _, raw := range raws {
+		var msg struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return nil, fmt.Errorf("discord: couldn't unmarshal message %s: %w", string(raw), err)
+		}
+		entries = append(entries, historyEntry{id: msg.ID, raw: raw})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return snowflakeLess(entries[i].id, entries[j].id)
+	})
+	return entries, nil
+}
+
+// replay sends an event to the event callbacks.
+func (c *Client) replay(evt *discordgo.Event) {
+	c.callbackLck.Lock()
+	defer c.callbackLck.Unlock()
+	for _, callback := range c.callbacks {
+		callback(evt)
+	}
+}
+
+// snowflakeLess reports whether the snowflake a is lower than b.
+func snowflakeLess(a, b string) bool {
+	x, _ := strconv.ParseUint(a, 10, 64)
+	y, _ := strconv.ParseUint(b, 10, 64)
+	return x < y
+}
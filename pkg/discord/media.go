@@ -0,0 +1,52 @@
+package discord
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const mediaProxyHost = "media.discordapp.net"
+
+// MediaProxyURL returns the URL of an attachment served by the discord media
+// proxy as a WebP image resized to the given width.
+// It returns false if the URL isn't a discord attachment.
+func MediaProxyURL(u string, width int) (string, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", false
+	}
+	switch parsed.Host {
+	case "cdn.discordapp.com", mediaProxyHost:
+	default:
+		return "", false
+	}
+	if !strings.HasPrefix(parsed.Path, "/attachments/") && !strings.HasPrefix(parsed.Path, "/ephemeral-attachments/") {
+		return "", false
+	}
+	parsed.Host = mediaProxyHost
+
+	// Signature parameters must be kept, otherwise the proxy rejects the
+	// request
+	query := parsed.Query()
+	query.Set("format", "webp")
+	if width > 0 {
+		query.Set("width", strconv.Itoa(width))
+	} else {
+		query.Del("width")
+	}
+	query.Del("height")
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), true
+}
+
+// MediaProxyWidth returns the width requested by a media proxy URL, or 0 if
+// it isn't set.
+func MediaProxyWidth(u string) int {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return 0
+	}
+	width, _ := strconv.Atoi(parsed.Query().Get("width"))
+	return width
+}
@@ -3,6 +3,7 @@ package discord
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
@@ -11,15 +12,18 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func newSession(dialer func(ctx context.Context, network, addr string) (net.Conn, error), token, userAgent string) (*discordgo.Session, error) {
+func newSession(dialer func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config, token, userAgent string) (*discordgo.Session, error) {
 	s, err := discordgo.New(token)
 	if err != nil {
 		return nil, err
 	}
 	s.Dialer = &websocket.Dialer{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
 	}
 	if dialer != nil {
+		// The dialer already connects through the proxy, if any
+		s.Dialer.Proxy = nil
 		s.Dialer.NetDialContext = dialer
 	}
 	s.Client = &http.Client{
@@ -0,0 +1,179 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// healthInterval is the time between gateway health checks.
+	healthInterval = 15 * time.Second
+	// heartbeatTimeout is the maximum time without receiving a heartbeat
+	// acknowledgement before the gateway is considered dead.
+	// Discord heartbeat interval is around 41 seconds.
+	heartbeatTimeout = 2 * time.Minute
+	// maxReconnectWait is the maximum time to wait between reconnect attempts.
+	maxReconnectWait = 2 * time.Minute
+)
+
+// ErrSessionLost is returned when the gateway reconnects with a new session
+// and events sent while disconnected may have been lost.
+var ErrSessionLost = errors.New("discord: gateway session lost")
+
+// Reconnection is used to wait for the next gateway reconnection.
+type Reconnection struct {
+	done    chan struct{}
+	resumed bool
+}
+
+func newReconnection() *Reconnection {
+	return &Reconnection{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed when the gateway reconnects.
+func (r *Reconnection) Done() <-chan struct{} {
+	return r.done
+}
+
+// Resumed reports whether the events missed while disconnected have been
+// replayed, either by resuming the previous session or by backfilling the
+// watched channels history.
+// It must be called after Done is closed.
+func (r *Reconnection) Resumed() bool {
+	return r.resumed
+}
+
+// Reconnection returns the next gateway reconnection.
+func (c *Client) Reconnection() *Reconnection {
+	c.reconnectLck.Lock()
+	defer c.reconnectLck.Unlock()
+	return c.reconnection
+}
+
+// OnReconnect adds a callback that is called each time the gateway is ready
+// after a reconnection.
+func (c *Client) OnReconnect(callback func(resumed bool)) {
+	c.reconnectLck.Lock()
+	defer c.reconnectLck.Unlock()
+	c.reconnectCallbacks = append(c.reconnectCallbacks, callback)
+}
+
+// onReady is called when the gateway sends a ready or resumed event.
+func (c *Client) onReady(resumed bool) {
+	c.updateDM()
+
+	// The first ready event is the initial connection
+	if atomic.AddInt32(&c.connections, 1) == 1 {
+		return
+	}
+	if resumed {
+		log.Println("discord: gateway session resumed")
+	} else {
+		log.Println("discord: gateway reconnected with a new session, backfilling channel history")
+		// Events sent while disconnected are lost, so they are fetched from
+		// the history of the watched channels
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		resumed = c.backfillWatched(ctx)
+		cancel()
+	}
+
+	c.reconnectLck.Lock()
+	r := c.reconnection
+	c.reconnection = newReconnection()
+	callbacks := append([]func(bool){}, c.reconnectCallbacks...)
+	c.reconnectLck.Unlock()
+
+	r.resumed = resumed
+	close(r.done)
+	for _, callback := range callbacks {
+		callback(resumed)
+	}
+}
+
+// supervise watches the gateway connection and reconnects it when it has
+// been closed or heartbeats are no longer acknowledged.
+func (c *Client) supervise(ctx context.Context) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.invalid:
+			return
+		case <-c.disconnected:
+			// Give some time to the reconnection events to be processed
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			if c.ready() {
+				continue
+			}
+			log.Println("discord: gateway disconnected, reconnecting")
+		case <-ticker.C:
+			if c.healthy() {
+				continue
+			}
+			log.Println("discord: gateway heartbeat not acknowledged, reconnecting")
+		}
+		c.reconnect(ctx)
+	}
+}
+
+// healthy returns whether the gateway heartbeats are being acknowledged.
+func (c *Client) healthy() bool {
+	c.session.RLock()
+	defer c.session.RUnlock()
+	return time.Since(c.session.LastHeartbeatAck) < heartbeatTimeout
+}
+
+// ready returns whether the gateway connection is open.
+func (c *Client) ready() bool {
+	c.session.RLock()
+	defer c.session.RUnlock()
+	return c.session.DataReady
+}
+
+// reconnect closes the current gateway connection and opens it again until it
+// succeeds. The session is resumed if possible.
+func (c *Client) reconnect(ctx context.Context) {
+	// A non normal close code is used so the session can be resumed
+	_ = c.session.CloseWithCode(websocket.CloseServiceRestart)
+
+	wait := time.Second
+	for {
+		err := c.session.Open()
+		if err == nil || errors.Is(err, discordgo.ErrWSAlreadyOpen) {
+			break
+		}
+		if authenticationFailed(err) {
+			log.Printf("discord: gateway rejected the session, not reconnecting: %v\n", err)
+			_ = c.invalidate(err)
+			return
+		}
+		log.Printf("discord: couldn't reconnect gateway, retrying in %s: %v\n", wait, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > maxReconnectWait {
+			wait = maxReconnectWait
+		}
+	}
+
+	// Ignore disconnections notified while reconnecting
+	select {
+	case <-c.disconnected:
+	default:
+	}
+}
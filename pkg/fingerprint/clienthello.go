@@ -0,0 +1,312 @@
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLS extension IDs used to compute fingerprints.
+const (
+	extServerName          uint16 = 0
+	extSupportedGroups     uint16 = 10
+	extECPointFormats      uint16 = 11
+	extSignatureAlgorithms uint16 = 13
+	extALPN                uint16 = 16
+	extSupportedVersions   uint16 = 43
+)
+
+// ClientHello contains the fields of a TLS ClientHello used by the JA3 and
+// JA4 fingerprints.
+type ClientHello struct {
+	Version           uint16
+	Ciphers           []uint16
+	Extensions        []uint16
+	Curves            []uint16
+	Points            []uint8
+	SignatureAlgs     []uint16
+	SupportedVersions []uint16
+	ALPN              []string
+	ServerName        string
+}
+
+// readClientHello reads the records of a ClientHello from r.
+// The raw bytes are returned so the handshake can be replayed.
+func readClientHello(r io.Reader) (*ClientHello, []byte, error) {
+	var raw, msg []byte
+	need := -1
+	for need < 0 || len(msg) < need {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, raw, fmt.Errorf("fingerprint: couldn't read tls record: %w", err)
+		}
+		if header[0] != 22 {
+			return nil, raw, fmt.Errorf("fingerprint: unexpected tls record type %d", header[0])
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, raw, fmt.Errorf("fingerprint: couldn't read tls record: %w", err)
+		}
+		raw = append(raw, header...)
+		raw = append(raw, body...)
+		msg = append(msg, body...)
+		if need < 0 && len(msg) >= 4 {
+			if msg[0] != 1 {
+				return nil, raw, fmt.Errorf("fingerprint: unexpected handshake type %d", msg[0])
+			}
+			need = 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		}
+	}
+	hello, err := parseClientHello(msg[4:need])
+	return hello, raw, err
+}
+
+var errShortHello = errors.New("fingerprint: client hello is truncated")
+
+// parseClientHello parses the body of a ClientHello handshake message.
+func parseClientHello(b []byte) (*ClientHello, error) {
+	s := &reader{b: b}
+	h := &ClientHello{}
+	h.Version = s.uint16()
+	s.skip(32)             // random
+	s.skip(int(s.uint8())) // session id
+	ciphers := s.bytes(int(s.uint16()))
+	for i := 0; i+1 < len(ciphers); i += 2 {
+		h.Ciphers = append(h.Ciphers, binary.BigEndian.Uint16(ciphers[i:]))
+	}
+	s.skip(int(s.uint8())) // compression methods
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.empty() {
+		return h, nil
+	}
+	exts := &reader{b: s.bytes(int(s.uint16()))}
+	for !exts.empty() && exts.err == nil {
+		id := exts.uint16()
+		data := &reader{b: exts.bytes(int(exts.uint16()))}
+		h.Extensions = append(h.Extensions, id)
+		switch id {
+		case extServerName:
+			list := &reader{b: data.bytes(int(data.uint16()))}
+			for !list.empty() && list.err == nil {
+				typ := list.uint8()
+				name := list.bytes(int(list.uint16()))
+				if typ == 0 {
+					h.ServerName = string(name)
+				}
+			}
+		case extSupportedGroups:
+			h.Curves = data.uint16s(int(data.uint16()))
+		case extECPointFormats:
+			h.Points = data.bytes(int(data.uint8()))
+		case extSignatureAlgorithms:
+			h.SignatureAlgs = data.uint16s(int(data.uint16()))
+		case extSupportedVersions:
+			h.SupportedVersions = data.uint16s(int(data.uint8()))
+		case extALPN:
+			list := &reader{b: data.bytes(int(data.uint16()))}
+			for !list.empty() && list.err == nil {
+				h.ALPN = append(h.ALPN, string(list.bytes(int(list.uint8()))))
+			}
+		}
+		if data.err != nil {
+			return nil, data.err
+		}
+	}
+	if exts.err != nil {
+		return nil, exts.err
+	}
+	return h, nil
+}
+
+// reader reads big endian values from a byte slice, recording the first
+// error.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = errShortHello
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) skip(n int) {
+	_ = r.bytes(n)
+}
+
+func (r *reader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint16s(n int) []uint16 {
+	b := r.bytes(n)
+	var v []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		v = append(v, binary.BigEndian.Uint16(b[i:]))
+	}
+	return v
+}
+
+func (r *reader) empty() bool {
+	return len(r.b) == 0
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var v []uint16
+	for _, x := range values {
+		if !isGREASE(x) {
+			v = append(v, x)
+		}
+	}
+	return v
+}
+
+// version returns the highest TLS version offered by the client.
+func (h *ClientHello) version() uint16 {
+	v := h.Version
+	for _, sv := range withoutGREASE(h.SupportedVersions) {
+		if sv > v {
+			v = sv
+		}
+	}
+	return v
+}
+
+// JA3 returns the JA3 string of the ClientHello without GREASE values.
+// As in the fingerprints reported by scrapfly, the version is the highest
+// one of the supported versions extension instead of the legacy version.
+func (h *ClientHello) JA3() string {
+	points := make([]string, 0, len(h.Points))
+	for _, p := range h.Points {
+		points = append(points, strconv.Itoa(int(p)))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version())),
+		joinUint16(withoutGREASE(h.Ciphers), "-", 10),
+		joinUint16(withoutGREASE(h.Extensions), "-", 10),
+		joinUint16(withoutGREASE(h.Curves), "-", 10),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+// JA3Hash returns the MD5 hash of the JA3 string.
+func (h *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4Parts returns the prefix, sorted ciphers, sorted extensions and
+// signature algorithms of the JA4 fingerprint.
+func (h *ClientHello) ja4Parts() (string, string, string, string) {
+	var version string
+	switch v := h.version(); v {
+	case 0x0304:
+		version = "13"
+	case 0x0303:
+		version = "12"
+	case 0x0302:
+		version = "11"
+	case 0x0301:
+		version = "10"
+	case 0x0300:
+		version = "s3"
+	default:
+		version = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		first := h.ALPN[0]
+		alpn = string(first[0]) + string(first[len(first)-1])
+	}
+	ciphers := withoutGREASE(h.Ciphers)
+	exts := withoutGREASE(h.Extensions)
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min(len(ciphers), 99), min(len(exts), 99), alpn)
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	var sortedExts []uint16
+	for _, e := range exts {
+		if e != extServerName && e != extALPN {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+	return prefix, joinUint16(sortedCiphers, ",", 16), joinUint16(sortedExts, ",", 16), joinUint16(h.SignatureAlgs, ",", 16)
+}
+
+// JA4 returns the hashed JA4 fingerprint of the ClientHello.
+func (h *ClientHello) JA4() string {
+	prefix, ciphers, exts, sigAlgs := h.ja4Parts()
+	c := exts
+	if sigAlgs != "" {
+		c += "_" + sigAlgs
+	}
+	return prefix + "_" + truncatedHash(ciphers) + "_" + truncatedHash(c)
+}
+
+// JA4R returns the raw JA4 fingerprint of the ClientHello.
+func (h *ClientHello) JA4R() string {
+	prefix, ciphers, exts, sigAlgs := h.ja4Parts()
+	r := prefix + "_" + ciphers + "_" + exts
+	if sigAlgs != "" {
+		r += "_" + sigAlgs
+	}
+	return r
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return strings.Repeat("0", 12)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinUint16(values []uint16, sep string, base int) string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		if base == 16 {
+			s = append(s, fmt.Sprintf("%04x", v))
+			continue
+		}
+		s = append(s, strconv.Itoa(int(v)))
+	}
+	return strings.Join(s, sep)
+}
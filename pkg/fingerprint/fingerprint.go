@@ -0,0 +1,100 @@
+// Package fingerprint captures the TLS and HTTP/2 fingerprint of a client
+// using a local server, so it can be checked without external services.
+package fingerprint
+
+import (
+	"sort"
+	"strings"
+)
+
+// Fingerprint is the fingerprint of a client observed by the server.
+type Fingerprint struct {
+	JA3     string
+	JA3Hash string
+	JA4     string
+	JA4R    string
+	// HTTP2 is the Akamai HTTP/2 fingerprint, empty if the client didn't
+	// use HTTP/2.
+	HTTP2 string
+	// Protocol is the protocol negotiated with ALPN.
+	Protocol string
+	// HeaderOrder contains the names of the request headers in the order
+	// they were sent, pseudo headers excluded.
+	HeaderOrder []string
+	UserAgent   string
+	Hello       *ClientHello
+}
+
+// Expected is the fingerprint a client should have.
+type Expected struct {
+	// TLS is a JA3, JA4 or JA4_r fingerprint.
+	TLS       string
+	UserAgent string
+	// HTTP2 is the Akamai HTTP/2 fingerprint, it isn't compared if empty.
+	HTTP2 string
+}
+
+// Difference is a field whose observed value differs from the expected one.
+type Difference struct {
+	Field    string
+	Expected string
+	Observed string
+}
+
+// Diff returns the differences between the observed and the expected
+// fingerprint.
+// The order of JA3 extensions is ignored, because browsers like chrome
+// shuffle them on each connection.
+func (f *Fingerprint) Diff(e *Expected) []Difference {
+	var diffs []Difference
+	add := func(field, expected, observed string) {
+		if expected != observed {
+			diffs = append(diffs, Difference{Field: field, Expected: expected, Observed: observed})
+		}
+	}
+	switch tls := strings.TrimSpace(e.TLS); {
+	case strings.HasPrefix(tls, "t") && strings.Count(tls, "_") == 2 && len(tls) == 36:
+		add("ja4", tls, f.JA4)
+	case strings.HasPrefix(tls, "t"):
+		add("ja4_r", tls, f.JA4R)
+	default:
+		if normalizeJA3(tls) != normalizeJA3(f.JA3) {
+			diffs = append(diffs, Difference{Field: "ja3", Expected: tls, Observed: f.JA3})
+		}
+	}
+	add("user-agent", e.UserAgent, f.UserAgent)
+	if e.HTTP2 != "" {
+		add("http2", e.HTTP2, f.HTTP2)
+	}
+	return diffs
+}
+
+// normalizeJA3 removes GREASE values and sorts the extensions.
+func normalizeJA3(ja3 string) string {
+	fields := strings.Split(ja3, ",")
+	for i, field := range fields {
+		var values []string
+		for _, v := range strings.Split(field, "-") {
+			if isGREASEString(v) {
+				continue
+			}
+			values = append(values, v)
+		}
+		if i == 2 {
+			sort.Strings(values)
+		}
+		fields[i] = strings.Join(values, "-")
+	}
+	return strings.Join(fields, ",")
+}
+
+func isGREASEString(v string) bool {
+	var n uint16
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
+		n = n*10 + uint16(c-'0')
+	}
+	return v != "" && isGREASE(n)
+}
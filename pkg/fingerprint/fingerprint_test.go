@@ -0,0 +1,80 @@
+package fingerprint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/http"
+)
+
+func TestCapture(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, srv.CertificatePEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ja3 := "772,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	userAgent := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	h2 := "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"
+	client, err := http.NewClient(ja3, userAgent, "en-US", "",
+		http.WithHTTP2Fingerprint(h2),
+		http.WithTLSConfig(&http.TLSConfig{CAFiles: []string{ca}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = http.Close(client) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(srv.URL())
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		errs <- err
+	}()
+	fp, err := srv.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if fp.Protocol != "h2" {
+		t.Errorf("unexpected protocol %s", fp.Protocol)
+	}
+	if diffs := fp.Diff(&Expected{TLS: ja3, UserAgent: userAgent, HTTP2: h2}); len(diffs) > 0 {
+		t.Errorf("unexpected differences: %+v", diffs)
+	}
+	if diffs := fp.Diff(&Expected{TLS: fp.JA4R, UserAgent: userAgent}); len(diffs) > 0 {
+		t.Errorf("unexpected ja4_r differences: %+v", diffs)
+	}
+	if fp.Hello.ServerName != "localhost" {
+		t.Errorf("unexpected server name %q", fp.Hello.ServerName)
+	}
+	if len(fp.HeaderOrder) == 0 || fp.HeaderOrder[0] == "" {
+		t.Errorf("header order not captured: %v", fp.HeaderOrder)
+	}
+	if diffs := fp.Diff(&Expected{TLS: ja3, UserAgent: "other"}); len(diffs) != 1 || diffs[0].Field != "user-agent" {
+		t.Errorf("expected user agent difference, got %+v", diffs)
+	}
+}
+
+func TestNormalizeJA3(t *testing.T) {
+	a := "772,2570-4865-4866,2570-0-23-65281,29-23,0"
+	b := "772,4865-4866,65281-23-0,29-23,0"
+	if normalizeJA3(a) != normalizeJA3(b) {
+		t.Errorf("normalizeJA3 mismatch: %s != %s", normalizeJA3(a), normalizeJA3(b))
+	}
+}
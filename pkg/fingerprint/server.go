@@ -0,0 +1,307 @@
+package fingerprint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// Server is a local TLS and HTTP/2 server that captures the fingerprint of
+// the clients that connect to it.
+type Server struct {
+	ln      net.Listener
+	config  *tls.Config
+	certPEM []byte
+	results chan result
+}
+
+type result struct {
+	fp  *Fingerprint
+	err error
+}
+
+// NewServer starts a server listening on a random local port.
+// Its certificate is self-signed, clients must trust CertificatePEM.
+func NewServer() (*Server, error) {
+	cert, certPEM, err := selfSigned("localhost")
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint: couldn't listen: %w", err)
+	}
+	s := &Server{
+		ln: ln,
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+		},
+		certPEM: certPEM,
+		results: make(chan result, 16),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the URL of the server.
+// The host is a name instead of an IP, so clients send the SNI extension.
+func (s *Server) URL() string {
+	_, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return "https://localhost:" + port + "/"
+}
+
+// CertificatePEM returns the PEM encoded certificate of the server.
+func (s *Server) CertificatePEM() []byte {
+	return s.certPEM
+}
+
+// Next waits for the fingerprint of the next request.
+func (s *Server) Next(ctx context.Context) (*Fingerprint, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-s.results:
+		return r.fp, r.err
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+			fp, err := s.capture(conn)
+			select {
+			case s.results <- result{fp: fp, err: err}:
+			default:
+			}
+		}()
+	}
+}
+
+// capture reads the ClientHello, completes the handshake and reads the
+// request.
+func (s *Server) capture(conn net.Conn) (*Fingerprint, error) {
+	hello, raw, err := readClientHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	fp := &Fingerprint{
+		JA3:     hello.JA3(),
+		JA3Hash: hello.JA3Hash(),
+		JA4:     hello.JA4(),
+		JA4R:    hello.JA4R(),
+		Hello:   hello,
+	}
+
+	// Replay the ClientHello to the TLS server
+	tlsConn := tls.Server(&replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(raw), conn)}, s.config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("fingerprint: tls handshake failed: %w", err)
+	}
+	fp.Protocol = tlsConn.ConnectionState().NegotiatedProtocol
+	if fp.Protocol == http2.NextProtoTLS {
+		err = captureHTTP2(tlsConn, fp)
+	} else {
+		err = captureHTTP1(tlsConn, fp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// captureHTTP2 reads the frames sent by the client until the request
+// headers and answers with an empty response.
+func captureHTTP2(conn net.Conn, fp *Fingerprint) error {
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return fmt.Errorf("fingerprint: couldn't read http2 preface: %w", err)
+	}
+	if string(preface) != http2.ClientPreface {
+		return fmt.Errorf("fingerprint: invalid http2 preface %q", preface)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return fmt.Errorf("fingerprint: couldn't write settings: %w", err)
+	}
+
+	var settings, priorities []string
+	var windowUpdate uint32
+	var block []byte
+	var streamID uint32
+	for streamID == 0 {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("fingerprint: couldn't read http2 frame: %w", err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			_ = f.ForeachSetting(func(s http2.Setting) error {
+				settings = append(settings, fmt.Sprintf("%d:%d", s.ID, s.Val))
+				return nil
+			})
+			if err := framer.WriteSettingsAck(); err != nil {
+				return fmt.Errorf("fingerprint: couldn't write settings ack: %w", err)
+			}
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 && windowUpdate == 0 {
+				windowUpdate = f.Increment
+			}
+		case *http2.PriorityFrame:
+			exclusive := 0
+			if f.Exclusive {
+				exclusive = 1
+			}
+			priorities = append(priorities, fmt.Sprintf("%d:%d:%d:%d", f.StreamID, exclusive, f.StreamDep, int(f.Weight)+1))
+		case *http2.HeadersFrame:
+			block = append(block, f.HeaderBlockFragment()...)
+			if f.HeadersEnded() {
+				streamID = f.StreamID
+			}
+		case *http2.ContinuationFrame:
+			block = append(block, f.HeaderBlockFragment()...)
+			if f.HeadersEnded() {
+				streamID = f.StreamID
+			}
+		}
+	}
+
+	fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+	if err != nil {
+		return fmt.Errorf("fingerprint: couldn't decode headers: %w", err)
+	}
+	var pseudo []string
+	for _, f := range fields {
+		if f.IsPseudo() {
+			pseudo = append(pseudo, f.Name[1:2])
+			continue
+		}
+		fp.HeaderOrder = append(fp.HeaderOrder, f.Name)
+		if f.Name == "user-agent" {
+			fp.UserAgent = f.Value
+		}
+	}
+	wu := "00"
+	if windowUpdate > 0 {
+		wu = fmt.Sprint(windowUpdate)
+	}
+	prio := "0"
+	if len(priorities) > 0 {
+		prio = strings.Join(priorities, ",")
+	}
+	fp.HTTP2 = strings.Join([]string{strings.Join(settings, ";"), wu, prio, strings.Join(pseudo, ",")}, "|")
+
+	// Send an empty response
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	_ = enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	_ = enc.WriteField(hpack.HeaderField{Name: "content-length", Value: "0"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}); err != nil {
+		return fmt.Errorf("fingerprint: couldn't write response: %w", err)
+	}
+	_ = framer.WriteGoAway(streamID, http2.ErrCodeNo, nil)
+
+	// Wait for the client to close the connection, so the response isn't
+	// lost
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _ = io.Copy(io.Discard, conn)
+	return nil
+}
+
+// captureHTTP1 reads the request headers and answers with an empty
+// response.
+func captureHTTP1(conn net.Conn, fp *Fingerprint) error {
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil {
+		return fmt.Errorf("fingerprint: couldn't read request line: %w", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("fingerprint: couldn't read header: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		name = strings.ToLower(name)
+		fp.HeaderOrder = append(fp.HeaderOrder, name)
+		if name == "user-agent" {
+			fp.UserAgent = strings.TrimSpace(value)
+		}
+	}
+	_, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+	return err
+}
+
+// replayConn reads from r, which starts with the bytes already consumed
+// from the connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// selfSigned creates a self-signed certificate for the host.
+func selfSigned(host string) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("fingerprint: couldn't generate key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("fingerprint: couldn't create certificate: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM, nil
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	httpgo "net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,19 +17,18 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-func NewDialer(ja3, userAgent, lang, proxyURL string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
-	var dialer proxy.ContextDialer
-	dialer = &ctxDialer{Dialer: proxy.Direct}
-	rt := newRoundTripper(ja3, userAgent, lang, dialer).(*roundTripper)
-	return rt.dialer.DialContext, nil
-}
-
-func NewGoClient(ja3, userAgent, lang, proxyURL string) (*httpgo.Client, error) {
-	var dialer proxy.ContextDialer
-	dialer = &ctxDialer{Dialer: proxy.Direct}
-	if proxyURL != "" {
-		var err error
-		dialer, err = newConnectDialer(proxyURL)
+// NewGoClient creates a client that uses the standard library transport.
+// The dialer and TLS options work like in NewClient, the HTTP/2 fingerprint
+// is ignored.
+func NewGoClient(ja3, userAgent, lang, proxyURL string, opts ...Option) (*httpgo.Client, error) {
+	o := newOptions(opts)
+	v, err := newVerifier(o.tls)
+	if err != nil {
+		return nil, err
+	}
+	var dialer proxy.ContextDialer = dialFunc(o.dialer)
+	if o.dialer == nil {
+		dialer, err = newProxyDialer(proxyURL, v)
 		if err != nil {
 			return nil, err
 		}
@@ -37,107 +36,299 @@ func NewGoClient(ja3, userAgent, lang, proxyURL string) (*httpgo.Client, error)
 	rt := newRoundTripper(ja3, userAgent, lang, dialer).(*roundTripper)
 	tr := httpgo.DefaultTransport.(*httpgo.Transport).Clone()
 	tr.DialContext = rt.dialer.DialContext
+	// The server name is set by the transport for each connection
+	tr.TLSClientConfig = v.tlsConfig("")
 	return &httpgo.Client{
 		Transport: tr,
 		Timeout:   30 * time.Second,
 	}, nil
 }
 
-func NewClient(ja3, userAgent, lang, proxyURL string) (*http.Client, error) {
-	var dialer proxy.ContextDialer
-	dialer = &ctxDialer{Dialer: proxy.Direct}
-	if proxyURL != "" {
-		var err error
-		dialer, err = newConnectDialer(proxyURL)
+// Option configures the http client.
+type Option func(*options)
+
+type options struct {
+	http2  string
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	tls    *TLSConfig
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithHTTP2Fingerprint sets the Akamai HTTP/2 fingerprint of the browser.
+// It is ignored if empty.
+func WithHTTP2Fingerprint(fp string) Option {
+	return func(o *options) {
+		o.http2 = fp
+	}
+}
+
+// WithDialer sets the dial function used for all connections, e.g. one
+// obtained from a proxy pool.
+// The proxy URL is ignored when a dialer is set.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.dialer = dial
+	}
+}
+
+// WithTLSConfig sets how server certificates are verified.
+// By default they are verified against the system roots.
+func WithTLSConfig(cfg *TLSConfig) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+func NewClient(ja3, userAgent, lang, proxyURL string, opts ...Option) (*http.Client, error) {
+	o := newOptions(opts)
+	v, err := newVerifier(o.tls)
+	if err != nil {
+		return nil, err
+	}
+	var dialer proxy.ContextDialer = dialFunc(o.dialer)
+	if o.dialer == nil {
+		dialer, err = newProxyDialer(proxyURL, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rt := newRoundTripper(ja3, userAgent, lang, dialer).(*roundTripper)
+	rt.verifier = v
+	if o.http2 != "" {
+		fp, err := ParseHTTP2Fingerprint(o.http2)
 		if err != nil {
 			return nil, err
 		}
+		rt.profile.HTTP2 = fp
 	}
 	return &http.Client{
-		Transport: newRoundTripper(ja3, userAgent, lang, dialer),
+		Transport: rt,
 		Timeout:   30 * time.Second,
 	}, nil
 }
 
+// dialFunc adapts a dial function to a proxy dialer.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// ctxDialer adds context support to dialers that don't have it.
+// If the context is done before the dial finishes, the dial is abandoned and
+// its connection closed.
 type ctxDialer struct {
 	proxy.Dialer
 }
 
 func (d *ctxDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return proxy.Direct.Dial(network, addr)
+	if cd, ok := d.Dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.conn, r.err
+	}
 }
 
-var errProtocolNegotiated = errors.New("protocol negotiated")
+const (
+	// idleTimeout is how long unused connections and transports are kept.
+	idleTimeout = 90 * time.Second
+	// dialTimeout is used for dials that don't receive a context.
+	dialTimeout = 30 * time.Second
+)
 
-type roundTripper struct {
-	sync.Mutex
+var errClosed = errors.New("http: client is closed")
 
+// roundTripper sends requests using the TLS fingerprint of the browser.
+// The protocol of each address is negotiated with ALPN on the first request
+// and a transport is cached for it.
+// It is safe for concurrent use.
+type roundTripper struct {
 	JA3       string
 	UserAgent string
 	Language  string
+	profile   *BrowserProfile
+	verifier  *verifier
 
-	cachedConnections map[string]net.Conn
-	cachedTransports  map[string]http.RoundTripper
+	lck          sync.Mutex
+	transports   map[string]*cachedTransport
+	connections  map[string]*cachedConn
+	negotiations map[string]chan struct{}
+	closed       bool
 
 	dialer proxy.ContextDialer
 }
 
+type cachedTransport struct {
+	http.RoundTripper
+	lastUsed time.Time
+}
+
+// cachedConn is the connection used to negotiate the protocol, it is reused
+// by the first request to the address.
+type cachedConn struct {
+	net.Conn
+	created time.Time
+}
+
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	chromeVersion := "109"
-	if idx := strings.Index(rt.UserAgent, "Chrome/"); idx != -1 {
-		candidate := strings.Split(rt.UserAgent[idx+7:], ".")[0]
-		if _, err := strconv.Atoi(chromeVersion); err == nil {
-			chromeVersion = candidate
-		}
+	rt.profile.SetHeaders(req.Header)
+
+	t, err := rt.transport(req.Context(), req.URL.Scheme, rt.getDialTLSAddr(req))
+	if err != nil {
+		return nil, err
 	}
-	req.Header.Set("accept-language", rt.Language)
-	req.Header.Set("sec-ch-ua", fmt.Sprintf(`"Not A;Brand";v="99", "Google Chrome";v="%s", "Chromium";v="%s"`, chromeVersion, chromeVersion))
-	req.Header.Set("sec-ch-ua-mobile", "?0")
-	req.Header.Set("sec-ch-ua-platform", `"Windows"`)
-	req.Header.Set("user-agent", rt.UserAgent)
+	return t.RoundTrip(req)
+}
 
-	addr := rt.getDialTLSAddr(req)
-	if _, ok := rt.cachedTransports[addr]; !ok {
-		if err := rt.getTransport(req, addr); err != nil {
-			return nil, err
+// transport returns the cached transport of the address, negotiating it if
+// needed.
+// Concurrent requests to the same address wait for a single negotiation.
+func (rt *roundTripper) transport(ctx context.Context, scheme, addr string) (http.RoundTripper, error) {
+	for {
+		rt.lck.Lock()
+		if rt.closed {
+			rt.lck.Unlock()
+			return nil, errClosed
+		}
+		rt.evict()
+		if t, ok := rt.transports[addr]; ok {
+			t.lastUsed = time.Now()
+			rt.lck.Unlock()
+			return t.RoundTripper, nil
+		}
+		wait, ok := rt.negotiations[addr]
+		if !ok {
+			done := make(chan struct{})
+			rt.negotiations[addr] = done
+			rt.lck.Unlock()
+
+			t, err := rt.negotiate(ctx, scheme, addr)
+
+			rt.lck.Lock()
+			delete(rt.negotiations, addr)
+			if err == nil {
+				rt.transports[addr] = &cachedTransport{RoundTripper: t, lastUsed: time.Now()}
+			}
+			rt.lck.Unlock()
+			close(done)
+			return t, err
+		}
+		rt.lck.Unlock()
+
+		// Another request is negotiating, wait for it and check the cache
+		// again.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
 		}
 	}
-	return rt.cachedTransports[addr].RoundTrip(req)
 }
 
-func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
-	switch strings.ToLower(req.URL.Scheme) {
+// negotiate creates the transport for the address.
+// For https addresses a connection is established to learn the protocol
+// negotiated with ALPN, and it is cached to be used by the transport.
+func (rt *roundTripper) negotiate(ctx context.Context, scheme, addr string) (http.RoundTripper, error) {
+	switch strings.ToLower(scheme) {
 	case "http":
-		rt.cachedTransports[addr] = &http.Transport{DialContext: rt.dialer.DialContext, DisableKeepAlives: true}
-		return nil
+		return &http.Transport{DialContext: rt.dialer.DialContext, DisableKeepAlives: true}, nil
 	case "https":
 	default:
-		return fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
+		return nil, fmt.Errorf("invalid URL scheme: [%v]", scheme)
+	}
+
+	conn, err := rt.handshake(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err := rt.dialTLS(context.Background(), "tcp", addr)
-	switch err {
-	case errProtocolNegotiated:
-	case nil:
-		// Should never happen.
-		panic("dialTLS returned no error when determining cachedTransports")
+	var t http.RoundTripper
+	switch conn.ConnectionState().NegotiatedProtocol {
+	case http2.NextProtoTLS:
+		if addr == "gateway.discord.gg:443" {
+			t = &http.Transport{DialTLSContext: rt.dialTLS, IdleConnTimeout: idleTimeout}
+			break
+		}
+		t2 := &http2.Transport{
+			DialTLS:         rt.dialTLShttp2,
+			PushHandler:     &http2.DefaultPushHandler{},
+			Navigator:       rt.profile.navigator(),
+			ReadIdleTimeout: idleTimeout,
+		}
+		if rt.profile.HTTP2 != nil {
+			t2.HTTP2Settings = rt.profile.HTTP2.transportSettings()
+		}
+		t = t2
 	default:
-		return err
+		// Assume the remote peer is speaking http 1.x + TLS.
+		t = &http.Transport{DialTLSContext: rt.dialTLS, IdleConnTimeout: idleTimeout}
 	}
 
-	return nil
+	// Stash the connection just established for use servicing the
+	// actual request (should be near-immediate).
+	rt.lck.Lock()
+	defer rt.lck.Unlock()
+	if rt.closed {
+		_ = conn.Close()
+		return nil, errClosed
+	}
+	if old := rt.connections[addr]; old != nil {
+		_ = old.Close()
+	}
+	rt.connections[addr] = &cachedConn{Conn: conn, created: time.Now()}
+	return t, nil
 }
 
 func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
-	rt.Lock()
-	defer rt.Unlock()
+	// If we have the connection from when we determined the transport to
+	// use, return that.
+	rt.lck.Lock()
+	if conn := rt.connections[addr]; conn != nil {
+		delete(rt.connections, addr)
+		rt.lck.Unlock()
+		return conn.Conn, nil
+	}
+	rt.lck.Unlock()
+	return rt.handshake(ctx, network, addr)
+}
 
-	// If we have the connection from when we determined the httpS
-	// cachedTransports to use, return that.
-	if conn := rt.cachedConnections[addr]; conn != nil {
-		delete(rt.cachedConnections, addr)
-		return conn, nil
+// handshake dials the address and performs the TLS handshake using the
+// fingerprint of the browser.
+func (rt *roundTripper) handshake(ctx context.Context, network, addr string) (*utls.UConn, error) {
+	spec, err := StringToSpec(rt.JA3, rt.UserAgent)
+	if err != nil {
+		return nil, err
 	}
+
 	rawConn, err := rt.dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
@@ -147,23 +338,19 @@ func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.
 	if host, _, err = net.SplitHostPort(addr); err != nil {
 		host = addr
 	}
-	//////////////////
-
-	spec, err := StringToSpec(rt.JA3, rt.UserAgent)
-	if err != nil {
-		return nil, err
-	}
 
-	conn := utls.UClient(rawConn, &utls.Config{ServerName: host, InsecureSkipVerify: true}, // MinVersion:         tls.VersionTLS10,
-		// MaxVersion:         tls.VersionTLS13,
-
-		utls.HelloCustom)
+	conn := utls.UClient(rawConn, rt.verifier.utlsConfig(host), utls.HelloCustom)
 
 	if err := conn.ApplyPreset(spec); err != nil {
+		_ = rawConn.Close()
 		return nil, err
 	}
 
-	if err = conn.Handshake(); err != nil {
+	err = conn.HandshakeContext(ctx)
+	if r, ok := rawConn.(handshakeReporter); ok {
+		r.reportHandshake(err)
+	}
+	if err != nil {
 		_ = conn.Close()
 
 		if err.Error() == "tls: CurvePreferences includes unsupported curve" {
@@ -172,38 +359,73 @@ func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.
 		}
 		return nil, fmt.Errorf("uTlsConn.Handshake() error: %+v", err)
 	}
+	return conn, nil
+}
 
-	//////////
-	if rt.cachedTransports[addr] != nil {
-		return conn, nil
-	}
+// dialTLShttp2 is used by the http2 transport, which doesn't provide a
+// context, so the dial timeout is used instead.
+func (rt *roundTripper) dialTLShttp2(network, addr string, _ *utls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return rt.dialTLS(ctx, network, addr)
+}
 
-	// No http.Transport constructed yet, create one based on the results
-	// of ALPN.
-	negotiatedProtocol := conn.ConnectionState().NegotiatedProtocol
-	switch {
-	case negotiatedProtocol == http2.NextProtoTLS && addr != "gateway.discord.gg:443":
-		parsedUserAgent := parseUserAgent(rt.UserAgent)
-		t2 := http2.Transport{DialTLS: rt.dialTLShttp2,
-			PushHandler: &http2.DefaultPushHandler{},
-			Navigator:   parsedUserAgent,
+// evict closes the connections and transports that haven't been used for
+// a while, the lock must be held.
+func (rt *roundTripper) evict() {
+	now := time.Now()
+	for addr, conn := range rt.connections {
+		if now.Sub(conn.created) > idleTimeout {
+			_ = conn.Close()
+			delete(rt.connections, addr)
 		}
-		rt.cachedTransports[addr] = &t2
-	default:
-		// Assume the remote peer is speaking http 1.x + TLS.
-		rt.cachedTransports[addr] = &http.Transport{DialTLSContext: rt.dialTLS}
+	}
+	for addr, t := range rt.transports {
+		if now.Sub(t.lastUsed) > idleTimeout {
+			closeIdleConnections(t.RoundTripper)
+			delete(rt.transports, addr)
+		}
+	}
+}
 
+// CloseIdleConnections closes the connections that aren't in use.
+func (rt *roundTripper) CloseIdleConnections() {
+	rt.lck.Lock()
+	defer rt.lck.Unlock()
+	for addr, conn := range rt.connections {
+		_ = conn.Close()
+		delete(rt.connections, addr)
+	}
+	for _, t := range rt.transports {
+		closeIdleConnections(t.RoundTripper)
 	}
+}
 
-	// Stash the connection just established for use servicing the
-	// actual request (should be near-immediate).
-	rt.cachedConnections[addr] = conn
+// Close releases the connections of the round tripper.
+// Requests in flight aren't interrupted, but new requests fail.
+func (rt *roundTripper) Close() error {
+	rt.CloseIdleConnections()
+	rt.lck.Lock()
+	defer rt.lck.Unlock()
+	rt.closed = true
+	rt.transports = make(map[string]*cachedTransport)
+	return nil
+}
 
-	return nil, errProtocolNegotiated
+func closeIdleConnections(t http.RoundTripper) {
+	if c, ok := t.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
 }
 
-func (rt *roundTripper) dialTLShttp2(network, addr string, _ *utls.Config) (net.Conn, error) {
-	return rt.dialTLS(context.Background(), network, addr)
+// Close releases the connections of a client created with NewClient.
+// The client can't be used after closing it.
+func Close(client *http.Client) error {
+	if c, ok := client.Transport.(io.Closer); ok {
+		return c.Close()
+	}
+	client.CloseIdleConnections()
+	return nil
 }
 
 func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
@@ -215,27 +437,21 @@ func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
 }
 
 func newRoundTripper(ja3, userAgent, lang string, dialer ...proxy.ContextDialer) http.RoundTripper {
-	if len(dialer) > 0 {
-		return &roundTripper{
-			dialer: dialer[0],
-
-			JA3:               ja3,
-			UserAgent:         userAgent,
-			Language:          lang,
-			cachedTransports:  make(map[string]http.RoundTripper),
-			cachedConnections: make(map[string]net.Conn),
-		}
+	rt := &roundTripper{
+		JA3:          ja3,
+		UserAgent:    userAgent,
+		Language:     lang,
+		profile:      NewBrowserProfile(userAgent, ja3, lang),
+		transports:   make(map[string]*cachedTransport),
+		connections:  make(map[string]*cachedConn),
+		negotiations: make(map[string]chan struct{}),
 	}
-
-	return &roundTripper{
-		dialer: &ctxDialer{Dialer: proxy.FromEnvironment()},
-
-		JA3:               ja3,
-		UserAgent:         userAgent,
-		Language:          lang,
-		cachedTransports:  make(map[string]http.RoundTripper),
-		cachedConnections: make(map[string]net.Conn),
+	if len(dialer) > 0 {
+		rt.dialer = dialer[0]
+	} else {
+		rt.dialer = &ctxDialer{Dialer: proxy.FromEnvironment()}
 	}
+	return rt
 }
 
 const (
@@ -253,11 +469,3 @@ func parseUserAgent(userAgent string) string {
 		return chrome
 	}
 }
-
-type contextDialer struct {
-	proxy.Dialer
-}
-
-func (d *contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return d.Dial(network, addr)
-}
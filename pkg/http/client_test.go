@@ -1,10 +1,18 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	httpgo "net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	http "github.com/Danny-Dasilva/fhttp"
 	"github.com/igolaizola/bulkai/pkg/scrapfly"
@@ -159,3 +167,74 @@ func TestHeaders(t *testing.T) {
 		t.Errorf("got  %s\nwant %s", got, want)
 	}
 }
+
+func TestRoundTripperConcurrent(t *testing.T) {
+	srv := httptest.NewUnstartedServer(httpgo.HandlerFunc(func(w httpgo.ResponseWriter, r *httpgo.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	userAgent := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	client, err := NewClient(chromeJA3, userAgent, "en-US", "", WithTLSConfig(&TLSConfig{CAFiles: []string{writeCA(t, srv)}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			if string(b) != "HTTP/2.0" {
+				errs <- fmt.Errorf("unexpected protocol %s", b)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	rt := client.Transport.(*roundTripper)
+	if len(rt.transports) != 1 {
+		t.Errorf("expected 1 cached transport, got %d", len(rt.transports))
+	}
+	if err := Close(client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(srv.URL); !errors.Is(err, errClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
+
+func TestRoundTripperContext(t *testing.T) {
+	// The dialer blocks until the context is done
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	client, err := NewClient(chromeJA3, "", "", "", WithDialer(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://discord.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
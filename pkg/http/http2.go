@@ -0,0 +1,121 @@
+package http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	http2 "github.com/Danny-Dasilva/fhttp/http2"
+)
+
+// HTTP2Fingerprint is the HTTP/2 fingerprint of a browser, as defined by
+// Akamai: `SETTINGS|WINDOW_UPDATE|PRIORITY|PSEUDO_HEADER_ORDER`.
+// For example `1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p`.
+type HTTP2Fingerprint struct {
+	Settings     []http2.Setting
+	WindowUpdate uint32
+	Priorities   []http2.PriorityFrame
+	// PseudoHeaderOrder contains the pseudo headers, e.g. `:method`.
+	PseudoHeaderOrder []string
+	raw               string
+}
+
+var pseudoHeaders = map[string]string{
+	"m": ":method",
+	"a": ":authority",
+	"s": ":scheme",
+	"p": ":path",
+}
+
+// ParseHTTP2Fingerprint parses an Akamai HTTP/2 fingerprint.
+func ParseHTTP2Fingerprint(raw string) (*HTTP2Fingerprint, error) {
+	parts := strings.Split(strings.TrimSpace(raw), "|")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("http: invalid http2 fingerprint %q: expected 4 parts separated by |", raw)
+	}
+	fp := &HTTP2Fingerprint{raw: raw}
+
+	// Settings
+	for _, s := range strings.Split(parts[0], ";") {
+		if s == "" {
+			continue
+		}
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("http: invalid http2 setting %q", s)
+		}
+		id, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("http: invalid http2 setting id %q: %w", s, err)
+		}
+		val, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("http: invalid http2 setting value %q: %w", s, err)
+		}
+		fp.Settings = append(fp.Settings, http2.Setting{ID: http2.SettingID(id), Val: uint32(val)})
+	}
+
+	// Window update, `00` means no window update frame was sent.
+	// The transport can't omit it, so the browser default is used instead.
+	if parts[1] != "" && strings.Trim(parts[1], "0") != "" {
+		wu, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("http: invalid http2 window update %q: %w", parts[1], err)
+		}
+		fp.WindowUpdate = uint32(wu)
+	}
+
+	// Priority frames, `0` means no priority frames were sent
+	if parts[2] != "" && parts[2] != "0" {
+		for _, p := range strings.Split(parts[2], ",") {
+			fields := strings.Split(p, ":")
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("http: invalid http2 priority %q: expected stream:exclusive:dependency:weight", p)
+			}
+			var values [4]uint64
+			for i, f := range fields {
+				v, err := strconv.ParseUint(f, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("http: invalid http2 priority %q: %w", p, err)
+				}
+				values[i] = v
+			}
+			if values[3] < 1 || values[3] > 256 {
+				return nil, fmt.Errorf("http: invalid http2 priority weight %q", p)
+			}
+			fp.Priorities = append(fp.Priorities, http2.PriorityFrame{
+				FrameHeader: http2.FrameHeader{StreamID: uint32(values[0])},
+				PriorityParam: http2.PriorityParam{
+					Exclusive: values[1] == 1,
+					StreamDep: uint32(values[2]),
+					// Akamai weights are 1-256, frame weights are zero-indexed
+					Weight: uint8(values[3] - 1),
+				},
+			})
+		}
+	}
+
+	// Pseudo header order
+	for _, h := range strings.Split(parts[3], ",") {
+		name, ok := pseudoHeaders[h]
+		if !ok {
+			return nil, fmt.Errorf("http: invalid http2 pseudo header %q", h)
+		}
+		fp.PseudoHeaderOrder = append(fp.PseudoHeaderOrder, name)
+	}
+	return fp, nil
+}
+
+// String returns the fingerprint in Akamai format.
+func (fp *HTTP2Fingerprint) String() string {
+	return fp.raw
+}
+
+// transportSettings returns the settings used by the HTTP/2 transport.
+func (fp *HTTP2Fingerprint) transportSettings() *http2.HTTP2Settings {
+	return &http2.HTTP2Settings{
+		Settings:       fp.Settings,
+		ConnectionFlow: int(fp.WindowUpdate),
+		PriorityFrames: fp.Priorities,
+	}
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"reflect"
+	"testing"
+
+	http2 "github.com/Danny-Dasilva/fhttp/http2"
+)
+
+func TestParseHTTP2Fingerprint(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    *HTTP2Fingerprint
+		wantErr bool
+	}{
+		{
+			raw: "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p",
+			want: &HTTP2Fingerprint{
+				Settings: []http2.Setting{
+					{ID: http2.SettingHeaderTableSize, Val: 65536},
+					{ID: http2.SettingEnablePush, Val: 0},
+					{ID: http2.SettingInitialWindowSize, Val: 6291456},
+					{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+				},
+				WindowUpdate:      15663105,
+				PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+			},
+		},
+		{
+			raw: "1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101|m,p,a,s",
+			want: &HTTP2Fingerprint{
+				Settings: []http2.Setting{
+					{ID: http2.SettingHeaderTableSize, Val: 65536},
+					{ID: http2.SettingInitialWindowSize, Val: 131072},
+					{ID: http2.SettingMaxFrameSize, Val: 16384},
+				},
+				WindowUpdate: 12517377,
+				Priorities: []http2.PriorityFrame{
+					{FrameHeader: http2.FrameHeader{StreamID: 3}, PriorityParam: http2.PriorityParam{Weight: 200}},
+					{FrameHeader: http2.FrameHeader{StreamID: 5}, PriorityParam: http2.PriorityParam{Weight: 100}},
+				},
+				PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+			},
+		},
+		{raw: "1:65536|15663105|0", wantErr: true},
+		{raw: "1:65536|15663105|0|m,x,s,p", wantErr: true},
+		{raw: "1:65536|15663105|3:0:0:0|m,a,s,p", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHTTP2Fingerprint(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseHTTP2Fingerprint(%s) expected error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseHTTP2Fingerprint(%s) unexpected error: %v", tt.raw, err)
+			continue
+		}
+		tt.want.raw = tt.raw
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseHTTP2Fingerprint(%s) = %+v; want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -1,119 +1,440 @@
 package http
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
 	utls "github.com/refraction-networking/utls"
 )
 
-// StringToSpec creates a ClientHelloSpec based on a JA3 string
-func StringToSpec(ja3 string, userAgent string) (*utls.ClientHelloSpec, error) {
-	parsedUserAgent := parseUserAgent(userAgent)
-	extMap := genMap()
+// tlsFingerprint is a parsed JA3 or JA4_r fingerprint.
+type tlsFingerprint struct {
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []uint8
+	// sigAlgs and alpn are only available in JA4_r fingerprints.
+	sigAlgs []utls.SignatureScheme
+	alpn    []string
+	// grease is true if the fingerprint includes GREASE values, which are
+	// then used as positional placeholders.
+	grease bool
+	// sorted is true if the order of ciphers and extensions is unknown.
+	sorted bool
+}
+
+// TLS extension IDs.
+const (
+	extServerName           uint16 = 0
+	extStatusRequest        uint16 = 5
+	extSupportedGroups      uint16 = 10
+	extECPointFormats       uint16 = 11
+	extSignatureAlgorithms  uint16 = 13
+	extALPN                 uint16 = 16
+	extStatusRequestV2      uint16 = 17
+	extSCT                  uint16 = 18
+	extPadding              uint16 = 21
+	extEncryptThenMAC       uint16 = 22
+	extExtendedMasterSecret uint16 = 23
+	extTokenBinding         uint16 = 24
+	extCompressCertificate  uint16 = 27
+	extRecordSizeLimit      uint16 = 28
+	extDelegatedCredentials uint16 = 34
+	extSessionTicket        uint16 = 35
+	extPreSharedKey         uint16 = 41
+	extEarlyData            uint16 = 42
+	extSupportedVersions    uint16 = 43
+	extCookie               uint16 = 44
+	extPSKKeyExchangeModes  uint16 = 45
+	extPostHandshakeAuth    uint16 = 49
+	extSignatureAlgsCert    uint16 = 50
+	extKeyShare             uint16 = 51
+	extQUICTransportParams  uint16 = 57
+	extNPN                  uint16 = 13172
+	extApplicationSettings  uint16 = 17513
+	extApplicationSettings2 uint16 = 17613
+	extChannelID            uint16 = 30032
+	extEncryptedClientHello uint16 = 65037
+	extRenegotiationInfo    uint16 = 65281
+)
+
+var extensionNames = map[uint16]string{
+	extServerName:           "server_name",
+	extStatusRequest:        "status_request",
+	extSupportedGroups:      "supported_groups",
+	extECPointFormats:       "ec_point_formats",
+	extSignatureAlgorithms:  "signature_algorithms",
+	extALPN:                 "application_layer_protocol_negotiation",
+	extStatusRequestV2:      "status_request_v2",
+	extSCT:                  "signed_certificate_timestamp",
+	extPadding:              "padding",
+	extEncryptThenMAC:       "encrypt_then_mac",
+	extExtendedMasterSecret: "extended_master_secret",
+	extTokenBinding:         "token_binding",
+	extCompressCertificate:  "compress_certificate",
+	extRecordSizeLimit:      "record_size_limit",
+	extDelegatedCredentials: "delegated_credentials",
+	extSessionTicket:        "session_ticket",
+	extPreSharedKey:         "pre_shared_key",
+	extEarlyData:            "early_data",
+	extSupportedVersions:    "supported_versions",
+	extCookie:               "cookie",
+	extPSKKeyExchangeModes:  "psk_key_exchange_modes",
+	extPostHandshakeAuth:    "post_handshake_auth",
+	extSignatureAlgsCert:    "signature_algorithms_cert",
+	extKeyShare:             "key_share",
+	extQUICTransportParams:  "quic_transport_parameters",
+	extNPN:                  "next_protocol_negotiation",
+	extApplicationSettings:  "application_settings",
+	extApplicationSettings2: "application_settings (new codepoint)",
+	extChannelID:            "channel_id",
+	extEncryptedClientHello: "encrypted_client_hello",
+	extRenegotiationInfo:    "renegotiation_info",
+}
+
+func extensionName(id uint16) string {
+	if name, ok := extensionNames[id]; ok {
+		return fmt.Sprintf("%d (%s)", id, name)
+	}
+	return fmt.Sprintf("%d (unknown)", id)
+}
+
+// Post-quantum hybrid groups can't be used for key exchange by the TLS
+// library, so they are removed from the supported groups. Otherwise servers
+// preferring them would request a key share that can't be generated.
+var postQuantumCurves = map[uint16]string{
+	0x6399: "X25519Kyber768Draft00",
+	0x11ec: "X25519MLKEM768",
+	0x11eb: "SecP256r1MLKEM768",
+}
+
+// isGREASE returns whether a value is a GREASE value (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// StringToSpec creates a ClientHelloSpec based on a JA3 or JA4_r string.
+// Chromium GREASE values are added if the fingerprint doesn't include them
+// and the user agent is a chromium browser.
+func StringToSpec(fingerprint string, userAgent string) (*utls.ClientHelloSpec, error) {
+	fp, err := parseTLSFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return fp.spec(NewBrowserProfile(userAgent, fingerprint, ""))
+}
+
+var ja4HashRegex = regexp.MustCompile(`^[tq]\d{2}[di]\d{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+
+func parseTLSFingerprint(s string) (*tlsFingerprint, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("http: empty tls fingerprint")
+	case ja4HashRegex.MatchString(s):
+		return nil, fmt.Errorf("http: ja4 fingerprint %s is hashed and can't be reproduced, use the raw ja4_r format instead", s)
+	case s[0] == 't' || s[0] == 'q':
+		return parseJA4R(s)
+	default:
+		return parseJA3(s)
+	}
+}
+
+// parseJA3 parses a JA3 string: `version,ciphers,extensions,curves,points`.
+func parseJA3(ja3 string) (*tlsFingerprint, error) {
 	tokens := strings.Split(ja3, ",")
+	if len(tokens) != 5 {
+		return nil, fmt.Errorf("http: invalid ja3 %q: expected 5 fields separated by commas, got %d", ja3, len(tokens))
+	}
+	if _, err := strconv.ParseUint(tokens[0], 10, 16); err != nil {
+		return nil, fmt.Errorf("http: invalid ja3 tls version %q: %w", tokens[0], err)
+	}
+	fp := &tlsFingerprint{}
+	var err error
+	if fp.ciphers, err = parseUint16List(tokens[1], "-", 10); err != nil {
+		return nil, fmt.Errorf("http: invalid ja3 ciphers: %w", err)
+	}
+	if fp.extensions, err = parseUint16List(tokens[2], "-", 10); err != nil {
+		return nil, fmt.Errorf("http: invalid ja3 extensions: %w", err)
+	}
+	if fp.curves, err = parseUint16List(tokens[3], "-", 10); err != nil {
+		return nil, fmt.Errorf("http: invalid ja3 curves: %w", err)
+	}
+	points, err := parseUint16List(tokens[4], "-", 10)
+	if err != nil {
+		return nil, fmt.Errorf("http: invalid ja3 point formats: %w", err)
+	}
+	for _, p := range points {
+		if p > 255 {
+			return nil, fmt.Errorf("http: invalid ja3 point format %d", p)
+		}
+		fp.points = append(fp.points, uint8(p))
+	}
+	if len(fp.ciphers) == 0 {
+		return nil, fmt.Errorf("http: invalid ja3 %q: no ciphers", ja3)
+	}
+	for _, list := range [][]uint16{fp.ciphers, fp.extensions, fp.curves} {
+		for _, v := range list {
+			if isGREASE(v) {
+				fp.grease = true
+			}
+		}
+	}
+	return fp, nil
+}
 
-	version := tokens[0]
-	ciphers := strings.Split(tokens[1], "-")
-	extensions := strings.Split(tokens[2], "-")
-	curves := strings.Split(tokens[3], "-")
-	if len(curves) == 1 && curves[0] == "" {
-		curves = []string{}
-	}
-	pointFormats := strings.Split(tokens[4], "-")
-	if len(pointFormats) == 1 && pointFormats[0] == "" {
-		pointFormats = []string{}
-	}
-	// parse curves
-	var targetCurves []utls.CurveID
-	targetCurves = append(targetCurves, utls.CurveID(utls.GREASE_PLACEHOLDER)) //append grease for Chrome browsers
-	for _, c := range curves {
-		cid, err := strconv.ParseUint(c, 10, 16)
+// parseJA4R parses a raw JA4 string:
+// `t13d1516h2_ciphers_extensions_signaturealgorithms`, where ciphers and
+// extensions are sorted hex values.
+// Supported groups aren't part of JA4, so browser defaults are used.
+func parseJA4R(ja4 string) (*tlsFingerprint, error) {
+	tokens := strings.Split(ja4, "_")
+	if len(tokens) != 3 && len(tokens) != 4 {
+		return nil, fmt.Errorf("http: invalid ja4_r %q: expected 4 fields separated by underscores, got %d", ja4, len(tokens))
+	}
+	a := tokens[0]
+	if len(a) != 10 {
+		return nil, fmt.Errorf("http: invalid ja4_r prefix %q", a)
+	}
+	if a[0] == 'q' {
+		return nil, fmt.Errorf("http: ja4_r %q is a QUIC fingerprint, only TCP (t) is supported", ja4)
+	}
+	fp := &tlsFingerprint{
+		sorted: true,
+		curves: []uint16{uint16(utls.X25519), uint16(utls.CurveP256), uint16(utls.CurveP384)},
+		points: []uint8{0},
+	}
+	var err error
+	if fp.ciphers, err = parseUint16List(tokens[1], ",", 16); err != nil {
+		return nil, fmt.Errorf("http: invalid ja4_r ciphers: %w", err)
+	}
+	if fp.extensions, err = parseUint16List(tokens[2], ",", 16); err != nil {
+		return nil, fmt.Errorf("http: invalid ja4_r extensions: %w", err)
+	}
+	if len(tokens) == 4 {
+		sigAlgs, err := parseUint16List(tokens[3], ",", 16)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("http: invalid ja4_r signature algorithms: %w", err)
 		}
-		targetCurves = append(targetCurves, utls.CurveID(cid))
-		// if cid != uint64(utls.CurveP521) {
-		// CurveP521 sometimes causes handshake errors
-		// }
+		for _, s := range sigAlgs {
+			fp.sigAlgs = append(fp.sigAlgs, utls.SignatureScheme(s))
+		}
+	}
+
+	// SNI and ALPN are excluded from the extension list but defined in the
+	// prefix
+	if a[3] == 'd' {
+		fp.extensions = append([]uint16{extServerName}, fp.extensions...)
 	}
-	extMap["10"] = &utls.SupportedCurvesExtension{Curves: targetCurves}
+	switch a[8:10] {
+	case "00":
+	case "h2":
+		fp.alpn = []string{"h2", "http/1.1"}
+		fp.extensions = append(fp.extensions, extALPN)
+	case "h1":
+		fp.alpn = []string{"http/1.1"}
+		fp.extensions = append(fp.extensions, extALPN)
+	default:
+		return nil, fmt.Errorf("http: unsupported ja4_r alpn %q", a[8:10])
+	}
+	if n, err := strconv.Atoi(a[4:6]); err != nil || n != len(fp.ciphers) {
+		return nil, fmt.Errorf("http: invalid ja4_r %q: cipher count %s doesn't match %d ciphers", ja4, a[4:6], len(fp.ciphers))
+	}
+	if n, err := strconv.Atoi(a[6:8]); err != nil || n != len(fp.extensions) {
+		return nil, fmt.Errorf("http: invalid ja4_r %q: extension count %s doesn't match %d extensions", ja4, a[6:8], len(fp.extensions))
+	}
+	return fp, nil
+}
 
-	// parse point formats
-	var targetPointFormats []byte
-	for _, p := range pointFormats {
-		pid, err := strconv.ParseUint(p, 10, 8)
+func parseUint16List(s, sep string, base int) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var values []uint16
+	for _, v := range strings.Split(s, sep) {
+		n, err := strconv.ParseUint(v, base, 16)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid value %q", v)
 		}
-		targetPointFormats = append(targetPointFormats, byte(pid))
+		values = append(values, uint16(n))
 	}
-	extMap["11"] = &utls.SupportedPointsExtension{SupportedPoints: targetPointFormats}
+	return values, nil
+}
 
-	// set extension 43
-	vid64, err := strconv.ParseUint(version, 10, 16)
-	if err != nil {
-		return nil, err
+// spec builds the ClientHelloSpec of the fingerprint.
+func (fp *tlsFingerprint) spec(profile *BrowserProfile) (*utls.ClientHelloSpec, error) {
+	chromium := profile.navigator() == chrome
+	addGREASE := chromium && !fp.grease
+	firefoxDefaults := profile.Browser == BrowserFirefox
+
+	// Cipher suites
+	var suites []uint16
+	if addGREASE {
+		suites = append(suites, utls.GREASE_PLACEHOLDER)
+	}
+	for _, c := range fp.ciphers {
+		if isGREASE(c) {
+			c = utls.GREASE_PLACEHOLDER
+		}
+		suites = append(suites, c)
+	}
+
+	// Supported groups
+	var curves []utls.CurveID
+	if addGREASE {
+		curves = append(curves, utls.CurveID(utls.GREASE_PLACEHOLDER))
+	}
+	for _, c := range fp.curves {
+		if _, ok := postQuantumCurves[c]; ok {
+			continue
+		}
+		if isGREASE(c) {
+			c = utls.GREASE_PLACEHOLDER
+		}
+		curves = append(curves, utls.CurveID(c))
+	}
+
+	// Key shares
+	keyShares := []utls.KeyShare{{Group: utls.X25519}}
+	if firefoxDefaults {
+		keyShares = append(keyShares, utls.KeyShare{Group: utls.CurveP256})
+	}
+	if chromium {
+		keyShares = append([]utls.KeyShare{{Group: utls.CurveID(utls.GREASE_PLACEHOLDER), Data: []byte{0}}}, keyShares...)
+	}
+
+	// Supported versions
+	versions := []uint16{utls.VersionTLS13, utls.VersionTLS12}
+	if chromium {
+		versions = append([]uint16{utls.GREASE_PLACEHOLDER}, versions...)
+	}
+
+	// Signature algorithms
+	sigAlgs := fp.sigAlgs
+	if len(sigAlgs) == 0 {
+		if firefoxDefaults {
+			sigAlgs = firefoxSignatureAlgorithms
+		} else {
+			sigAlgs = chromeSignatureAlgorithms
+		}
+	}
+
+	alpn := fp.alpn
+	if len(alpn) == 0 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+
+	certCompression := []utls.CertCompressionAlgo{utls.CertCompressionBrotli}
+	if firefoxDefaults {
+		certCompression = []utls.CertCompressionAlgo{utls.CertCompressionZlib, utls.CertCompressionBrotli, utls.CertCompressionZstd}
 	}
-	vid := uint16(vid64)
-	// extMap["43"] = &utls.SupportedVersionsExtension{
-	// 	Versions: []uint16{
-	// 		utls.VersionTLS12,
-	// 	},
-	// }
 
-	// build extenions list
+	// Extensions
 	var exts []utls.TLSExtension
-	//Optionally Add Chrome Grease Extension
-	if parsedUserAgent == chrome {
+	if addGREASE {
 		exts = append(exts, &utls.UtlsGREASEExtension{})
 	}
-	for _, e := range extensions {
-		te, ok := extMap[e]
-		if !ok {
-			// eAsint, err := strconv.Atoi(e)
-			// if err != nil {
-			// 	return nil, err
-			// }
-			// te = &utls.GenericExtension{Id: uint16(eAsint)}
+	var hasPadding bool
+	for _, e := range fp.extensions {
+		if isGREASE(e) {
+			exts = append(exts, &utls.UtlsGREASEExtension{})
 			continue
-			// return nil, raiseExtensionError(e)
 		}
-		// //Optionally add Chrome Grease Extension
-		if e == "21" && parsedUserAgent == chrome {
-			exts = append(exts, &utls.UtlsGREASEExtension{})
+		var ext utls.TLSExtension
+		switch e {
+		case extServerName:
+			ext = &utls.SNIExtension{}
+		case extStatusRequest:
+			ext = &utls.StatusRequestExtension{}
+		case extSupportedGroups:
+			ext = &utls.SupportedCurvesExtension{Curves: curves}
+		case extECPointFormats:
+			ext = &utls.SupportedPointsExtension{SupportedPoints: fp.points}
+		case extSignatureAlgorithms:
+			ext = &utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: sigAlgs}
+		case extALPN:
+			ext = &utls.ALPNExtension{AlpnProtocols: alpn}
+		case extStatusRequestV2:
+			ext = &utls.StatusRequestV2Extension{}
+		case extSCT:
+			ext = &utls.SCTExtension{}
+		case extPadding:
+			hasPadding = true
+			// Chromium sends a GREASE extension before padding
+			if addGREASE {
+				exts = append(exts, &utls.UtlsGREASEExtension{})
+			}
+			ext = &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle}
+		case extEncryptThenMAC, extPostHandshakeAuth:
+			ext = &utls.GenericExtension{Id: e}
+		case extExtendedMasterSecret:
+			ext = &utls.ExtendedMasterSecretExtension{}
+		case extTokenBinding:
+			ext = &utls.FakeTokenBindingExtension{MajorVersion: 1, MinorVersion: 0, KeyParameters: []uint8{0, 1, 2}}
+		case extCompressCertificate:
+			ext = &utls.UtlsCompressCertExtension{Algorithms: certCompression}
+		case extRecordSizeLimit:
+			ext = &utls.FakeRecordSizeLimitExtension{Limit: 0x4001}
+		case extDelegatedCredentials:
+			ext = &utls.FakeDelegatedCredentialsExtension{SupportedSignatureAlgorithms: []utls.SignatureScheme{
+				utls.ECDSAWithP256AndSHA256,
+				utls.ECDSAWithP384AndSHA384,
+				utls.ECDSAWithP521AndSHA512,
+				utls.ECDSAWithSHA1,
+			}}
+		case extSessionTicket:
+			ext = &utls.SessionTicketExtension{}
+		case extPreSharedKey, extEarlyData:
+			// Only sent when resuming a previous session, new connections
+			// don't include them
+			continue
+		case extSupportedVersions:
+			ext = &utls.SupportedVersionsExtension{Versions: versions}
+		case extCookie:
+			ext = &utls.CookieExtension{}
+		case extPSKKeyExchangeModes:
+			ext = &utls.PSKKeyExchangeModesExtension{Modes: []uint8{utls.PskModeDHE}}
+		case extSignatureAlgsCert:
+			ext = &utls.SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: sigAlgs}
+		case extKeyShare:
+			ext = &utls.KeyShareExtension{KeyShares: keyShares}
+		case extNPN:
+			ext = &utls.NPNExtension{}
+		case extApplicationSettings:
+			ext = &utls.ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}}
+		case extApplicationSettings2:
+			// Same payload as application_settings with the new codepoint
+			ext = &utls.GenericExtension{Id: e, Data: []byte{0x00, 0x03, 0x02, 'h', '2'}}
+		case extChannelID:
+			ext = &utls.FakeChannelIDExtension{}
+		case extEncryptedClientHello:
+			data, err := greaseECH()
+			if err != nil {
+				return nil, err
+			}
+			ext = &utls.GenericExtension{Id: e, Data: data}
+		case extRenegotiationInfo:
+			ext = &utls.RenegotiationInfoExtension{Renegotiation: utls.RenegotiateOnceAsClient}
+		default:
+			return nil, fmt.Errorf("http: unsupported tls extension %s", extensionName(e))
 		}
-		exts = append(exts, te)
-	}
-	//Add this back in if user agent is chrome and no padding extension is given
-	// if parsedUserAgent == chrome {
-	// 	exts = append(exts, &utls.UtlsGREASEExtension{})
-	// 	exts = append(exts, &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle})
-	// }
-	// build SSLVersion
-	// vid64, err := strconv.ParseUint(version, 10, 16)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// build CipherSuites
-	var suites []uint16
-	//Optionally Add Chrome Grease Extension
-	if parsedUserAgent == chrome {
-		suites = append(suites, utls.GREASE_PLACEHOLDER)
+		exts = append(exts, ext)
 	}
-	for _, c := range ciphers {
-		cid, err := strconv.ParseUint(c, 10, 16)
-		if err != nil {
-			return nil, err
-		}
-		suites = append(suites, uint16(cid))
+	// Chromium sends a GREASE extension at the end if there is no padding
+	if addGREASE && !hasPadding {
+		exts = append(exts, &utls.UtlsGREASEExtension{})
 	}
-	_ = vid
+	// The order of JA4 extensions is unknown, chromium browsers shuffle them
+	// on each connection anyway
+	if fp.sorted && chromium {
+		exts = utls.ShuffleChromeTLSExtensions(exts)
+	}
+
 	return &utls.ClientHelloSpec{
-		// TLSVersMin:         vid,
-		// TLSVersMax:         vid,
 		CipherSuites:       suites,
 		CompressionMethods: []byte{0},
 		Extensions:         exts,
@@ -121,72 +442,52 @@ func StringToSpec(ja3 string, userAgent string) (*utls.ClientHelloSpec, error) {
 	}, nil
 }
 
-func genMap() (extMap map[string]utls.TLSExtension) {
-	extMap = map[string]utls.TLSExtension{
-		"0": &utls.SNIExtension{},
-		"5": &utls.StatusRequestExtension{},
-		// These are applied later
-		// "10": &tls.SupportedCurvesExtension{...}
-		// "11": &tls.SupportedPointsExtension{...}
-		"13": &utls.SignatureAlgorithmsExtension{
-			SupportedSignatureAlgorithms: []utls.SignatureScheme{
-				utls.ECDSAWithP256AndSHA256,
-				utls.ECDSAWithP384AndSHA384,
-				utls.ECDSAWithP521AndSHA512,
-				utls.PSSWithSHA256,
-				utls.PSSWithSHA384,
-				utls.PSSWithSHA512,
-				utls.PKCS1WithSHA256,
-				utls.PKCS1WithSHA384,
-				utls.PKCS1WithSHA512,
-				utls.ECDSAWithSHA1,
-				utls.PKCS1WithSHA1,
-			},
-		},
-		"16": &utls.ALPNExtension{
-			AlpnProtocols: []string{"h2", "http/1.1"},
-		},
-		"17": &utls.GenericExtension{Id: 17}, // status_request_v2
-		"18": &utls.SCTExtension{},
-		"21": &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle},
-		"22": &utls.GenericExtension{Id: 22}, // encrypt_then_mac
-		"23": &utls.ExtendedMasterSecretExtension{},
-		"27": &utls.UtlsCompressCertExtension{
-			Algorithms: []utls.CertCompressionAlgo{utls.CertCompressionBrotli},
-		},
-		"28": &utls.FakeRecordSizeLimitExtension{}, //Limit: 0x4001
-		"35": &utls.SessionTicketExtension{},
-		"34": &utls.GenericExtension{Id: 34},
-		"41": &utls.GenericExtension{Id: 41}, //FIXME pre_shared_key
-		"43": &utls.SupportedVersionsExtension{Versions: []uint16{
-			utls.GREASE_PLACEHOLDER,
-			utls.VersionTLS13,
-			utls.VersionTLS12,
-			utls.VersionTLS11,
-			utls.VersionTLS10}},
-		"44": &utls.CookieExtension{},
-		"45": &utls.PSKKeyExchangeModesExtension{Modes: []uint8{
-			utls.PskModeDHE,
-		}},
-		"49": &utls.GenericExtension{Id: 49}, // post_handshake_auth
-		"50": &utls.GenericExtension{Id: 50}, // signature_algorithms_cert
-		"51": &utls.KeyShareExtension{KeyShares: []utls.KeyShare{
-			{Group: utls.CurveID(utls.GREASE_PLACEHOLDER), Data: []byte{0}},
-			{Group: utls.X25519},
-
-			// {Group: utls.CurveP384}, known bug missing correct extensions for handshake
-		}},
-		"30032": &utls.GenericExtension{Id: 0x7550, Data: []byte{0}}, //FIXME
-		"13172": &utls.NPNExtension{},
-		"17513": &utls.ApplicationSettingsExtension{
-			SupportedProtocols: []string{
-				"h2",
-			},
-		},
-		"65281": &utls.RenegotiationInfoExtension{
-			Renegotiation: utls.RenegotiateOnceAsClient,
-		},
-	}
-	return
+// greaseECH returns the payload of a GREASE encrypted_client_hello extension,
+// as sent by chromium browsers when ECH isn't configured.
+func greaseECH() ([]byte, error) {
+	// Random public key and a payload with the size of an encrypted inner
+	// client hello
+	enc := make([]byte, 32)
+	payload := make([]byte, 144+16)
+	configID := make([]byte, 1)
+	for _, b := range [][]byte{enc, payload, configID} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("http: couldn't generate grease ech: %w", err)
+		}
+	}
+	data := []byte{
+		0x00,       // outer client hello
+		0x00, 0x01, // HKDF-SHA256
+		0x00, 0x01, // AES-128-GCM
+		configID[0],
+		byte(len(enc) >> 8), byte(len(enc)),
+	}
+	data = append(data, enc...)
+	data = append(data, byte(len(payload)>>8), byte(len(payload)))
+	return append(data, payload...), nil
+}
+
+var chromeSignatureAlgorithms = []utls.SignatureScheme{
+	utls.ECDSAWithP256AndSHA256,
+	utls.PSSWithSHA256,
+	utls.PKCS1WithSHA256,
+	utls.ECDSAWithP384AndSHA384,
+	utls.PSSWithSHA384,
+	utls.PKCS1WithSHA384,
+	utls.PSSWithSHA512,
+	utls.PKCS1WithSHA512,
+}
 
+var firefoxSignatureAlgorithms = []utls.SignatureScheme{
+	utls.ECDSAWithP256AndSHA256,
+	utls.ECDSAWithP384AndSHA384,
+	utls.ECDSAWithP521AndSHA512,
+	utls.PSSWithSHA256,
+	utls.PSSWithSHA384,
+	utls.PSSWithSHA512,
+	utls.PKCS1WithSHA256,
+	utls.PKCS1WithSHA384,
+	utls.PKCS1WithSHA512,
+	utls.ECDSAWithSHA1,
+	utls.PKCS1WithSHA1,
 }
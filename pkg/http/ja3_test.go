@@ -0,0 +1,50 @@
+package http
+
+import (
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestStringToSpec(t *testing.T) {
+	chromeUA := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+	firefoxUA := "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+	tests := []struct {
+		name        string
+		fingerprint string
+		userAgent   string
+		err         string
+	}{
+		{"chrome 109", chromeJA3, chromeUA, ""},
+		{"chrome 131", "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,27-65281-0-23-16-18-5-45-17613-43-65037-11-35-51-13-10,4588-29-23-24,0", chromeUA, ""},
+		{"chrome with grease", "771,2570-4865-4866-4867-49195-49199,2570-0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-6682-21,2570-29-23-24,0", chromeUA, ""},
+		{"firefox", firefoxJA3, firefoxUA, ""},
+		{"ja4_r", "t13d1516h2_002f,0035,009c,009d,1301,1302,1303,c013,c014,c02b,c02c,c02f,c030,cca8,cca9_0005,000a,000b,000d,0012,0017,001b,0023,002b,002d,0033,4469,fe0d,ff01_0403,0804,0401,0503,0805,0501,0806,0601", chromeUA, ""},
+		{"ja4 hash", "t13d1516h2_8daaf6152771_02713d6af862", chromeUA, "use the raw ja4_r format"},
+		{"unknown extension", "771,4865-4866,0-23-12345,29,0", chromeUA, "unsupported tls extension 12345"},
+		{"quic extension", "771,4865-4866,0-23-57,29,0", chromeUA, "quic_transport_parameters"},
+		{"invalid", "771,4865-4866,0-23", chromeUA, "expected 5 fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := StringToSpec(tt.fingerprint, tt.userAgent)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := utls.UClient(nil, &utls.Config{ServerName: "discord.com"}, utls.HelloCustom)
+			if err := conn.ApplyPreset(spec); err != nil {
+				t.Fatalf("couldn't apply spec: %v", err)
+			}
+			if err := conn.BuildHandshakeState(); err != nil {
+				t.Fatalf("couldn't build client hello: %v", err)
+			}
+		})
+	}
+}
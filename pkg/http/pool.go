@@ -0,0 +1,352 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// proxyMaxFailures is the number of consecutive dial or TLS failures
+	// after which a proxy is quarantined.
+	proxyMaxFailures = 3
+	// proxyQuarantine is how long a quarantined proxy is left out of the
+	// download rotation.
+	proxyQuarantine = 5 * time.Minute
+	// proxyCheckAddr is the address dialed to check the health of proxies.
+	proxyCheckAddr = "discord.com:443"
+)
+
+// ParseProxies returns the proxies of an inline list, separated by commas or
+// spaces, and of a file with one proxy per line.
+// Empty lines and lines starting with # are ignored.
+func ParseProxies(inline, file string) ([]string, error) {
+	proxies := strings.FieldsFunc(inline, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	if file == "" {
+		return proxies, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("http: couldn't open proxy file: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		proxies = append(proxies, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("http: couldn't read proxy file: %w", err)
+	}
+	return proxies, nil
+}
+
+// ProxyPool manages a list of proxies.
+// Each account is pinned to a sticky proxy, so the IP seen by discord stays
+// the same for the account, while download traffic is rotated across all the
+// proxies of the pool.
+// Proxies that fail repeatedly are quarantined and left out of the download
+// rotation for a while.
+// Accounts whose session is rejected by discord can be disabled, without
+// affecting the rest of the accounts or the downloads.
+// An empty pool connects directly.
+type ProxyPool struct {
+	lck      sync.Mutex
+	proxies  []*poolProxy
+	accounts map[string]*poolProxy
+	disabled map[string]bool
+	next     int
+	// now is used to mock time in tests.
+	now func() time.Time
+}
+
+type poolProxy struct {
+	url         string
+	dialer      proxy.ContextDialer
+	failures    int
+	quarantined time.Time
+}
+
+// NewProxyPool creates a pool with the given proxy URLs.
+// Only the TLS config option is used, for https proxies.
+func NewProxyPool(proxies []string, opts ...Option) (*ProxyPool, error) {
+	v, err := newVerifier(newOptions(opts).tls)
+	if err != nil {
+		return nil, err
+	}
+	p := &ProxyPool{
+		accounts: make(map[string]*poolProxy),
+		disabled: make(map[string]bool),
+		now:      time.Now,
+	}
+	seen := make(map[string]struct{})
+	for _, u := range proxies {
+		if _, ok := seen[u]; ok {
+			continue
+		}
+		seen[u] = struct{}{}
+		d, err := newProxyDialer(u, v)
+		if err != nil {
+			return nil, err
+		}
+		p.proxies = append(p.proxies, &poolProxy{url: u, dialer: d})
+	}
+	return p, nil
+}
+
+// Len returns the number of proxies of the pool.
+func (p *ProxyPool) Len() int {
+	return len(p.proxies)
+}
+
+// Check dials discord through each proxy and quarantines the ones that fail.
+// An error is returned if none of the proxies works.
+func (p *ProxyPool) Check(ctx context.Context) error {
+	if len(p.proxies) == 0 {
+		return nil
+	}
+	errs := make([]error, len(p.proxies))
+	var wg sync.WaitGroup
+	for i, px := range p.proxies {
+		wg.Add(1)
+		go func(i int, px *poolProxy) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			defer cancel()
+			conn, err := px.dialer.DialContext(ctx, "tcp", proxyCheckAddr)
+			if err != nil {
+				errs[i] = fmt.Errorf("http: proxy %s failed health check: %w", redactProxy(px.url), err)
+				return
+			}
+			_ = conn.Close()
+		}(i, px)
+	}
+	wg.Wait()
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	healthy := 0
+	for i, px := range p.proxies {
+		if errs[i] != nil {
+			px.failures = proxyMaxFailures
+			px.quarantined = p.now()
+			continue
+		}
+		px.failures = 0
+		px.quarantined = time.Time{}
+		healthy++
+	}
+	if healthy == 0 {
+		return fmt.Errorf("http: no healthy proxies: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Sticky returns the proxy URL assigned to the account, empty if the pool is
+// empty.
+// Accounts are assigned using rendezvous hashing over the healthy proxies, so
+// an account gets the same proxy between runs as long as it stays healthy.
+// Once assigned, the proxy isn't changed during the life of the pool.
+func (p *ProxyPool) Sticky(account string) string {
+	px := p.sticky(account)
+	if px == nil {
+		return ""
+	}
+	return px.url
+}
+
+func (p *ProxyPool) sticky(account string) *poolProxy {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if len(p.proxies) == 0 {
+		return nil
+	}
+	if px, ok := p.accounts[account]; ok {
+		return px
+	}
+	candidates := p.available()
+	if len(candidates) == 0 {
+		candidates = p.proxies
+	}
+	var best *poolProxy
+	var bestScore uint64
+	for _, px := range candidates {
+		sum := sha256.Sum256([]byte(account + "\x00" + px.url))
+		score := binary.BigEndian.Uint64(sum[:8])
+		if best == nil || score > bestScore {
+			best, bestScore = px, score
+		}
+	}
+	p.accounts[account] = best
+	return best
+}
+
+// ErrAccountDisabled is returned when dialing for a disabled account.
+var ErrAccountDisabled = errors.New("http: account is disabled")
+
+// Dialer returns a dial function that connects through the sticky proxy of
+// the account.
+// The dial function fails once the account is disabled.
+func (p *ProxyPool) Dialer(account string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := directDialer.DialContext
+	if px := p.sticky(account); px != nil {
+		d := &poolDialer{pool: p, pick: func() (*poolProxy, error) { return px, nil }}
+		dial = d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if p.Disabled(account) {
+			return nil, fmt.Errorf("%w: %s", ErrAccountDisabled, account)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// Disable stops the traffic of an account, used when its session is no longer
+// valid.
+// The sticky proxy of the account isn't quarantined, so downloads and other
+// accounts keep using it.
+func (p *ProxyPool) Disable(account string) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.disabled[account] = true
+}
+
+// Disabled returns whether the account is disabled.
+func (p *ProxyPool) Disabled(account string) bool {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return p.disabled[account]
+}
+
+// DownloadDialer returns a dial function that connects through a different
+// proxy for each connection, skipping the quarantined ones.
+// It must only be used for downloads, the rest of the traffic of an account
+// must go through its sticky proxy.
+func (p *ProxyPool) DownloadDialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(p.proxies) == 0 {
+		return directDialer.DialContext
+	}
+	d := &poolDialer{pool: p, pick: p.rotate, retries: len(p.proxies) - 1}
+	return d.DialContext
+}
+
+var directDialer = &net.Dialer{}
+
+// rotate returns the next proxy that isn't quarantined.
+func (p *ProxyPool) rotate() (*poolProxy, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	candidates := p.available()
+	if len(candidates) == 0 {
+		return nil, errors.New("http: all proxies are quarantined")
+	}
+	px := candidates[p.next%len(candidates)]
+	p.next++
+	return px, nil
+}
+
+// available returns the proxies that aren't quarantined, the lock must be
+// held.
+func (p *ProxyPool) available() []*poolProxy {
+	var candidates []*poolProxy
+	now := p.now()
+	for _, px := range p.proxies {
+		if px.failures >= proxyMaxFailures && now.Sub(px.quarantined) < proxyQuarantine {
+			continue
+		}
+		candidates = append(candidates, px)
+	}
+	return candidates
+}
+
+// report records the result of a connection through the proxy.
+func (p *ProxyPool) report(px *poolProxy, err error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if err == nil {
+		px.failures = 0
+		return
+	}
+	px.failures++
+	if px.failures >= proxyMaxFailures {
+		px.quarantined = p.now()
+	}
+}
+
+// poolDialer dials through the proxies of a pool and reports the failures.
+type poolDialer struct {
+	pool    *ProxyPool
+	pick    func() (*poolProxy, error)
+	retries int
+}
+
+func (d *poolDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *poolDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var err error
+	for i := 0; i <= d.retries; i++ {
+		var px *poolProxy
+		px, err = d.pick()
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		conn, err = px.dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return &poolConn{Conn: conn, pool: d.pool, proxy: px}, nil
+		}
+		d.pool.report(px, err)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// poolConn is a connection through a proxy of a pool.
+// The TLS handshake result is reported to the pool, so proxies that tamper
+// with the connection are quarantined too.
+type poolConn struct {
+	net.Conn
+	pool  *ProxyPool
+	proxy *poolProxy
+}
+
+func (c *poolConn) reportHandshake(err error) {
+	c.pool.report(c.proxy, err)
+}
+
+// handshakeReporter is implemented by connections that want to know the
+// result of the TLS handshake.
+type handshakeReporter interface {
+	reportHandshake(err error)
+}
+
+// redactProxy removes the credentials from a proxy URL.
+func redactProxy(u string) string {
+	scheme, rest, ok := strings.Cut(u, "://")
+	if !ok {
+		return u
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return scheme + "://" + rest
+}
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseProxies(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "proxies.txt")
+	data := "# residential\nsocks5://10.0.0.3:1080\n\nhttp://10.0.0.4:8080\n"
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseProxies("http://10.0.0.1:8080, http://10.0.0.2:8080", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "socks5://10.0.0.3:1080", "http://10.0.0.4:8080"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseProxies() = %v; want %v", got, want)
+	}
+}
+
+// fakeDialer fails while fail is true.
+type fakeDialer struct {
+	fail bool
+}
+
+func (d *fakeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.fail {
+		return nil, errors.New("connection refused")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestProxyPool(t *testing.T) {
+	urls := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080"}
+	pool, err := NewProxyPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	dialers := map[string]*fakeDialer{}
+	for _, px := range pool.proxies {
+		d := &fakeDialer{}
+		px.dialer = d
+		dialers[px.url] = d
+	}
+
+	// Sticky proxies are stable between pools
+	other, err := NewProxyPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sticky := pool.Sticky("account1")
+	if sticky == "" || other.Sticky("account1") != sticky {
+		t.Errorf("sticky proxy isn't stable: %s, %s", sticky, other.Sticky("account1"))
+	}
+
+	// Repeated failures quarantine the proxy, but the account keeps it
+	dialers[sticky].fail = true
+	dial := pool.Dialer("account1")
+	for i := 0; i < proxyMaxFailures; i++ {
+		if _, err := dial(context.Background(), "tcp", "discord.com:443"); err == nil {
+			t.Fatal("expected dial error")
+		}
+	}
+	if pool.Sticky("account1") != sticky {
+		t.Error("sticky proxy changed after failures")
+	}
+
+	// Downloads skip the quarantined proxy
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		px, err := pool.rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[px.url] = true
+	}
+	if seen[sticky] || len(seen) != 2 {
+		t.Errorf("unexpected download rotation %v, quarantined %s", seen, sticky)
+	}
+
+	// The proxy is back after the quarantine
+	dialers[sticky].fail = false
+	now = now.Add(proxyQuarantine)
+	if len(pool.available()) != len(urls) {
+		t.Error("quarantine didn't expire")
+	}
+	conn, err := pool.DownloadDialer()(context.Background(), "tcp", "cdn.discordapp.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestProxyPoolDisable(t *testing.T) {
+	pool, err := NewProxyPool([]string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, px := range pool.proxies {
+		px.dialer = &fakeDialer{}
+	}
+	dial1 := pool.Dialer("account1")
+	dial2 := pool.Dialer("account2")
+	pool.Disable("account1")
+
+	// Only the disabled account is affected
+	if _, err := dial1(context.Background(), "tcp", "discord.com:443"); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected ErrAccountDisabled, got %v", err)
+	}
+	for _, dial := range []func(context.Context, string, string) (net.Conn, error){dial2, pool.DownloadDialer()} {
+		conn, err := dial(context.Background(), "tcp", "discord.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if len(pool.available()) != 2 {
+		t.Error("disabling an account shouldn't quarantine its proxy")
+	}
+}
+
+func TestProxyPoolEmpty(t *testing.T) {
+	pool, err := NewProxyPool(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Sticky("account1") != "" {
+		t.Error("empty pool shouldn't assign proxies")
+	}
+}
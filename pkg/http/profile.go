@@ -0,0 +1,320 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	http "github.com/Danny-Dasilva/fhttp"
+)
+
+// Browser names of a profile.
+const (
+	BrowserChrome  = "chrome"
+	BrowserEdge    = "edge"
+	BrowserFirefox = "firefox"
+	BrowserSafari  = "safari"
+)
+
+// BrowserProfile describes the browser that is impersonated, so that TLS,
+// HTTP/2 and HTTP headers are consistent with each other.
+type BrowserProfile struct {
+	UserAgent string
+	JA3       string
+	Language  string
+	// Browser is one of the Browser* constants.
+	Browser string
+	// Version is the major version of the browser.
+	Version string
+	// Platform is the operating system as reported by sec-ch-ua-platform.
+	Platform string
+	Mobile   bool
+	// HTTP2 is the captured HTTP/2 fingerprint, if nil the defaults of the
+	// browser are used.
+	HTTP2 *HTTP2Fingerprint
+}
+
+// BrowserProperties are the browser fields reported to discord in the
+// super properties.
+type BrowserProperties struct {
+	OS               string
+	Browser          string
+	BrowserVersion   string
+	BrowserUserAgent string
+}
+
+var (
+	edgeRegex    = regexp.MustCompile(`Edg/(\d+)`)
+	chromeRegex  = regexp.MustCompile(`Chrome/(\d+)`)
+	firefoxRegex = regexp.MustCompile(`Firefox/(\d+)`)
+	safariRegex  = regexp.MustCompile(`Version/(\d+)[\d.]* .*Safari/`)
+)
+
+// NewBrowserProfile creates a profile from a user agent, a JA3 fingerprint and
+// an accept-language value.
+func NewBrowserProfile(userAgent, ja3, language string) *BrowserProfile {
+	p := &BrowserProfile{
+		UserAgent: userAgent,
+		JA3:       ja3,
+		Language:  language,
+		Browser:   BrowserChrome,
+		Version:   "109",
+		Platform:  "Windows",
+	}
+	for _, b := range []struct {
+		name  string
+		regex *regexp.Regexp
+	}{
+		{BrowserEdge, edgeRegex},
+		{BrowserFirefox, firefoxRegex},
+		{BrowserChrome, chromeRegex},
+		{BrowserSafari, safariRegex},
+	} {
+		if m := b.regex.FindStringSubmatch(userAgent); m != nil {
+			p.Browser = b.name
+			p.Version = m[1]
+			break
+		}
+	}
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		p.Platform = "Android"
+		p.Mobile = true
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		p.Platform = "iOS"
+		p.Mobile = true
+	case strings.Contains(userAgent, "Windows"):
+		p.Platform = "Windows"
+	case strings.Contains(userAgent, "Macintosh"), strings.Contains(userAgent, "Mac OS X"):
+		p.Platform = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		p.Platform = "Chrome OS"
+	case strings.Contains(userAgent, "Linux"), strings.Contains(userAgent, "X11"):
+		p.Platform = "Linux"
+	}
+	return p
+}
+
+// defaultJA3 are the JA3 fingerprints of recent versions of each browser.
+var defaultJA3 = map[string]string{
+	BrowserChrome:  "772,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+	BrowserEdge:    "772,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+	BrowserFirefox: "772,4865-4867-4866-49195-49199-52393-52392-49196-49200-49162-49161-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-34-51-43-13-45-28-21,29-23-24-25-256-257,0",
+	BrowserSafari:  "772,4865-4866-4867-49196-49195-52393-49200-49199-52392-49162-49161-49172-49171-157-156-53-47-49160-49170-10,0-23-65281-10-11-16-5-13-18-51-45-43-27-21,29-23-24-25,0",
+}
+
+// DefaultJA3 returns the JA3 fingerprint of a recent version of the browser
+// of the user agent, for when the fingerprint of the browser can't be
+// captured.
+func DefaultJA3(userAgent string) string {
+	return defaultJA3[NewBrowserProfile(userAgent, "", "").Browser]
+}
+
+// chromium returns whether the browser sends client hints.
+func (p *BrowserProfile) chromium() bool {
+	return p.Browser == BrowserChrome || p.Browser == BrowserEdge
+}
+
+// navigator returns the browser family used to build HTTP/2 settings.
+func (p *BrowserProfile) navigator() string {
+	if p.Browser == BrowserFirefox {
+		return firefox
+	}
+	return chrome
+}
+
+// SetHeaders sets the headers that depend on the browser: user agent,
+// language and client hints, as well as the header order.
+// The header order is only set if the request doesn't define one.
+func (p *BrowserProfile) SetHeaders(h http.Header) {
+	h.Set("user-agent", p.UserAgent)
+	if p.Language != "" {
+		h.Set("accept-language", p.Language)
+	}
+	if p.chromium() {
+		mobile := "?0"
+		if p.Mobile {
+			mobile = "?1"
+		}
+		h.Set("sec-ch-ua", p.clientHintBrands())
+		h.Set("sec-ch-ua-mobile", mobile)
+		h.Set("sec-ch-ua-platform", fmt.Sprintf(`"%s"`, p.Platform))
+	} else {
+		h.Del("sec-ch-ua")
+		h.Del("sec-ch-ua-mobile")
+		h.Del("sec-ch-ua-platform")
+	}
+	if _, ok := h[http.HeaderOrderKey]; !ok {
+		h[http.HeaderOrderKey] = p.HeaderOrder()
+	}
+	if _, ok := h[http.PHeaderOrderKey]; !ok {
+		h[http.PHeaderOrderKey] = p.PseudoHeaderOrder()
+	}
+}
+
+func (p *BrowserProfile) clientHintBrands() string {
+	brand := "Google Chrome"
+	if p.Browser == BrowserEdge {
+		brand = "Microsoft Edge"
+	}
+	return fmt.Sprintf(`"Not A(Brand";v="99", "%s";v="%s", "Chromium";v="%s"`, brand, p.Version, p.Version)
+}
+
+// HeaderOrder returns the order in which the browser sends headers.
+func (p *BrowserProfile) HeaderOrder() []string {
+	switch p.Browser {
+	case BrowserFirefox:
+		return []string{
+			"host",
+			"user-agent",
+			"accept",
+			"accept-language",
+			"accept-encoding",
+			"range",
+			"content-type",
+			"content-length",
+			"authorization",
+			"x-super-properties",
+			"x-discord-locale",
+			"x-debug-options",
+			"origin",
+			"referer",
+			"cookie",
+			"upgrade-insecure-requests",
+			"sec-fetch-dest",
+			"sec-fetch-mode",
+			"sec-fetch-site",
+			"sec-fetch-user",
+			"te",
+		}
+	case BrowserSafari:
+		return []string{
+			"content-type",
+			"accept",
+			"authorization",
+			"sec-fetch-site",
+			"accept-language",
+			"sec-fetch-mode",
+			"accept-encoding",
+			"range",
+			"origin",
+			"user-agent",
+			"referer",
+			"content-length",
+			"sec-fetch-dest",
+			"x-super-properties",
+			"x-discord-locale",
+			"x-debug-options",
+			"cookie",
+		}
+	default:
+		return []string{
+			"content-length",
+			"sec-ch-ua",
+			"x-debug-options",
+			"sec-ch-ua-mobile",
+			"authorization",
+			"content-type",
+			"user-agent",
+			"x-discord-locale",
+			"x-super-properties",
+			"sec-ch-ua-platform",
+			"accept",
+			"origin",
+			"upgrade-insecure-requests",
+			"sec-fetch-site",
+			"sec-fetch-mode",
+			"sec-fetch-user",
+			"sec-fetch-dest",
+			"referer",
+			"accept-encoding",
+			"accept-language",
+			"cookie",
+			"range",
+		}
+	}
+}
+
+// PseudoHeaderOrder returns the order in which the browser sends HTTP/2
+// pseudo headers.
+func (p *BrowserProfile) PseudoHeaderOrder() []string {
+	if p.HTTP2 != nil && len(p.HTTP2.PseudoHeaderOrder) > 0 {
+		return p.HTTP2.PseudoHeaderOrder
+	}
+	switch p.Browser {
+	case BrowserFirefox:
+		return []string{":method", ":path", ":authority", ":scheme"}
+	case BrowserSafari:
+		return []string{":method", ":scheme", ":path", ":authority"}
+	default:
+		return []string{":method", ":authority", ":scheme", ":path"}
+	}
+}
+
+// Validate checks that the user agent, the JA3 fingerprint and the browser
+// properties describe the same browser. Properties are optional.
+// All mismatches are returned in a single error.
+func (p *BrowserProfile) Validate(props *BrowserProperties) error {
+	var errs []error
+	if _, err := StringToSpec(p.JA3, p.UserAgent); err != nil {
+		errs = append(errs, err)
+	}
+	if family := ja3Family(p.JA3); family != "" && family != p.navigator() {
+		errs = append(errs, fmt.Errorf("ja3 looks like %s but user agent is %s", family, p.Browser))
+	}
+	if props != nil {
+		if props.BrowserUserAgent != "" && props.BrowserUserAgent != p.UserAgent {
+			errs = append(errs, fmt.Errorf("super properties user agent %q doesn't match %q", props.BrowserUserAgent, p.UserAgent))
+		}
+		if props.Browser != "" && !strings.EqualFold(props.Browser, p.Browser) {
+			errs = append(errs, fmt.Errorf("super properties browser %s doesn't match user agent browser %s", props.Browser, p.Browser))
+		}
+		if props.BrowserVersion != "" && strings.Split(props.BrowserVersion, ".")[0] != p.Version {
+			errs = append(errs, fmt.Errorf("super properties browser version %s doesn't match user agent version %s", props.BrowserVersion, p.Version))
+		}
+		if name := superPropertiesOS(p.Platform); props.OS != "" && name != "" && props.OS != name {
+			errs = append(errs, fmt.Errorf("super properties os %s doesn't match user agent platform %s", props.OS, p.Platform))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("http: inconsistent browser profile: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// superPropertiesOS returns the os name used by discord super properties.
+func superPropertiesOS(platform string) string {
+	switch platform {
+	case "Windows", "Linux", "Android", "iOS":
+		return platform
+	case "macOS":
+		return "Mac OS X"
+	default:
+		return ""
+	}
+}
+
+// ja3Family guesses the browser family of a JA3 or JA4_r fingerprint using
+// extensions that are specific to each family.
+// An empty string is returned if it can't be guessed.
+func ja3Family(ja3 string) string {
+	fp, err := parseTLSFingerprint(ja3)
+	if err != nil {
+		return ""
+	}
+	exts := map[uint16]bool{}
+	for _, e := range fp.extensions {
+		exts[e] = true
+	}
+	switch {
+	// application_settings is only sent by chromium browsers
+	case exts[extApplicationSettings], exts[extApplicationSettings2]:
+		return chrome
+	// record_size_limit is sent by firefox but not by chromium browsers
+	case exts[extRecordSizeLimit]:
+		return firefox
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"testing"
+
+	http "github.com/Danny-Dasilva/fhttp"
+)
+
+const (
+	chromeJA3  = "772,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	firefoxJA3 = "772,4865-4867-4866-49195-49199-52393-52392-49196-49200-49162-49161-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-34-51-43-13-45-28-21,29-23-24-25-256-257,0"
+)
+
+func TestBrowserProfile(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		browser   string
+		version   string
+		platform  string
+		hints     bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", BrowserChrome, "120", "Windows", true},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91", BrowserEdge, "120", "macOS", true},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", BrowserFirefox, "121", "Linux", false},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15", BrowserSafari, "17", "macOS", false},
+	}
+	for _, tt := range tests {
+		p := NewBrowserProfile(tt.userAgent, "", "en-US")
+		if p.Browser != tt.browser || p.Version != tt.version || p.Platform != tt.platform {
+			t.Errorf("NewBrowserProfile(%s) = %s %s %s; want %s %s %s", tt.userAgent, p.Browser, p.Version, p.Platform, tt.browser, tt.version, tt.platform)
+		}
+		if err := NewBrowserProfile(tt.userAgent, DefaultJA3(tt.userAgent), "en-US").Validate(nil); err != nil {
+			t.Errorf("%s: invalid default ja3: %v", tt.browser, err)
+		}
+		h := http.Header{}
+		p.SetHeaders(h)
+		if got := h.Get("sec-ch-ua") != ""; got != tt.hints {
+			t.Errorf("%s: client hints sent = %v; want %v", tt.browser, got, tt.hints)
+		}
+		if h.Get("user-agent") != tt.userAgent {
+			t.Errorf("%s: unexpected user agent %s", tt.browser, h.Get("user-agent"))
+		}
+		if len(h[http.PHeaderOrderKey]) != 4 {
+			t.Errorf("%s: pseudo header order not set", tt.browser)
+		}
+	}
+}
+
+func TestBrowserProfileValidate(t *testing.T) {
+	chromeUA := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	props := &BrowserProperties{
+		OS:               "Windows",
+		Browser:          "Chrome",
+		BrowserVersion:   "120.0.0.0",
+		BrowserUserAgent: chromeUA,
+	}
+	if err := NewBrowserProfile(chromeUA, chromeJA3, "").Validate(props); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := NewBrowserProfile(chromeUA, firefoxJA3, "").Validate(props); err == nil {
+		t.Error("expected error with firefox ja3 and chrome user agent")
+	}
+	macProps := *props
+	macProps.OS = "Mac OS X"
+	if err := NewBrowserProfile(chromeUA, chromeJA3, "").Validate(&macProps); err == nil {
+		t.Error("expected error with mismatched os")
+	}
+	oldProps := *props
+	oldProps.BrowserVersion = "109.0.0.0"
+	if err := NewBrowserProfile(chromeUA, chromeJA3, "").Validate(&oldProps); err == nil {
+		t.Error("expected error with mismatched version")
+	}
+}
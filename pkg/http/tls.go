@@ -0,0 +1,169 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// pinnedDomains are the domains whose certificates are checked against the
+// pins, subdomains included.
+var pinnedDomains = []string{"discord.com"}
+
+// TLSConfig configures the verification of server certificates.
+// By default certificates are verified against the system roots.
+type TLSConfig struct {
+	// CAFiles are PEM files with certificates trusted in addition to the
+	// system roots, e.g. the CA of a TLS inspecting proxy.
+	CAFiles []string
+	// Pins are base64 encoded SHA-256 hashes of the subject public key info
+	// of a certificate, with an optional `sha256/` prefix.
+	// If set, the certificate chain of discord.com must contain one of them.
+	Pins []string
+	// Insecure disables certificate verification.
+	// It must only be used for debugging.
+	Insecure bool
+}
+
+// Std returns the standard TLS configuration that verifies certificates
+// with the config, for connections that don't use the clients of this
+// package, like the gateway websocket.
+// The server name is taken from the connection.
+// A nil config verifies certificates against the system roots.
+func (c *TLSConfig) Std() (*tls.Config, error) {
+	v, err := newVerifier(c)
+	if err != nil {
+		return nil, err
+	}
+	return v.tlsConfig(""), nil
+}
+
+// verifier verifies server certificates.
+// A nil verifier verifies certificates against the system roots.
+type verifier struct {
+	roots    *x509.CertPool
+	pins     map[string]struct{}
+	insecure bool
+}
+
+func newVerifier(cfg *TLSConfig) (*verifier, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	v := &verifier{
+		insecure: cfg.Insecure,
+		pins:     make(map[string]struct{}),
+	}
+	if len(cfg.CAFiles) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, f := range cfg.CAFiles {
+			pem, err := os.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("http: couldn't read ca file: %w", err)
+			}
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("http: no certificates found in ca file %s", f)
+			}
+		}
+		v.roots = roots
+	}
+	for _, p := range cfg.Pins {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("http: invalid certificate pin %q: expected a base64 encoded sha256 hash", p)
+		}
+		v.pins[p] = struct{}{}
+	}
+	return v, nil
+}
+
+// utlsConfig returns the uTLS configuration to connect to the host.
+func (v *verifier) utlsConfig(host string) *utls.Config {
+	cfg := &utls.Config{ServerName: host}
+	if v == nil {
+		return cfg
+	}
+	cfg.RootCAs = v.roots
+	cfg.InsecureSkipVerify = v.insecure
+	cfg.VerifyConnection = func(cs utls.ConnectionState) error {
+		return v.verifyPins(host, cs.PeerCertificates, cs.VerifiedChains)
+	}
+	return cfg
+}
+
+// tlsConfig returns the standard TLS configuration to connect to the host.
+// If the host is empty, the server name of the connection is used.
+func (v *verifier) tlsConfig(host string) *tls.Config {
+	cfg := &tls.Config{ServerName: host}
+	if v == nil {
+		return cfg
+	}
+	cfg.RootCAs = v.roots
+	cfg.InsecureSkipVerify = v.insecure
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		name := host
+		if name == "" {
+			name = cs.ServerName
+		}
+		return v.verifyPins(name, cs.PeerCertificates, cs.VerifiedChains)
+	}
+	return cfg
+}
+
+// verifyPins checks that one of the certificates of the verified chains
+// matches a pin, if the host is pinned.
+// Intermediate and root certificates of the chains are checked too, so
+// pinning the CA survives certificate renewals.
+// Certificates sent by the server that aren't part of a verified chain are
+// ignored, otherwise anyone could append the pinned certificate to its own.
+// If verification is disabled there are no verified chains, so only the leaf
+// certificate is checked.
+func (v *verifier) verifyPins(host string, peerCerts []*x509.Certificate, verifiedChains [][]*x509.Certificate) error {
+	if len(v.pins) == 0 || !isPinned(host) {
+		return nil
+	}
+	var certs []*x509.Certificate
+	switch {
+	case v.insecure:
+		if len(peerCerts) > 0 {
+			certs = peerCerts[:1]
+		}
+	default:
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+	for _, cert := range certs {
+		if _, ok := v.pins[CertificatePin(cert)]; ok {
+			return nil
+		}
+	}
+	return errors.New("http: certificate of " + host + " doesn't match any pin")
+}
+
+// CertificatePin returns the pin of the certificate, the base64 encoded
+// SHA-256 hash of its subject public key info.
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func isPinned(host string) bool {
+	for _, d := range pinnedDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	httpgo "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCA writes the certificate of the test server to a PEM file.
+func writeCA(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCertificateVerification(t *testing.T) {
+	srv := httptest.NewTLSServer(httpgo.HandlerFunc(func(w httpgo.ResponseWriter, r *httpgo.Request) {}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		cfg  *TLSConfig
+		err  string
+	}{
+		{"system roots", nil, "certificate"},
+		{"custom ca", &TLSConfig{CAFiles: []string{writeCA(t, srv)}}, ""},
+		{"insecure", &TLSConfig{Insecure: true}, ""},
+	}
+	for _, tt := range tests {
+		client, err := NewClient(chromeJA3, "", "", "", WithTLSConfig(tt.cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		goClient, err := NewGoClient(chromeJA3, "", "", "", WithTLSConfig(tt.cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both the fingerprinted and the standard clients must verify
+		for _, get := range []func(string) error{
+			func(u string) error {
+				resp, err := client.Get(u)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			},
+			func(u string) error {
+				resp, err := goClient.Get(u)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			},
+		} {
+			err := get(srv.URL)
+			if tt.err == "" && err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.err, err)
+			}
+		}
+	}
+}
+
+// newCert creates a certificate for the host signed by the parent, or
+// self-signed if the parent is nil.
+func newCert(t *testing.T, host string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: cert}
+}
+
+// handshake connects to a server that sends the given chain and returns the
+// client handshake error.
+func handshake(t *testing.T, v *verifier, chain tls.Certificate) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		_ = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{chain}}).Handshake()
+	}()
+	return tls.Client(client, v.tlsConfig("discord.com")).Handshake()
+}
+
+func TestCertificatePins(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	leaf := newCert(t, "discord.com", &ca)
+	// other is a certificate that isn't part of the chain, like the real
+	// intermediate of discord appended by an attacker
+	other := newCert(t, "other", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	tests := []struct {
+		name     string
+		pin      *x509.Certificate
+		extra    bool
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "leaf pin", pin: leaf.Leaf},
+		{name: "ca pin", pin: ca.Leaf},
+		{name: "mismatched pin", pin: other.Leaf, wantErr: true},
+		{name: "pin appended to the chain", pin: other.Leaf, extra: true, wantErr: true},
+		{name: "insecure leaf pin", pin: leaf.Leaf, insecure: true},
+		{name: "insecure ca pin", pin: ca.Leaf, insecure: true, wantErr: true},
+		{name: "insecure pin appended to the chain", pin: other.Leaf, extra: true, insecure: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		v, err := newVerifier(&TLSConfig{Pins: []string{"sha256/" + CertificatePin(tt.pin)}, Insecure: tt.insecure})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.roots = roots
+		chain := leaf
+		chain.Certificate = [][]byte{leaf.Certificate[0], ca.Certificate[0]}
+		if tt.extra {
+			chain.Certificate = append(chain.Certificate, other.Certificate[0])
+		}
+		err = handshake(t, v, chain)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+
+	// Only pinned hosts are checked
+	v, err := newVerifier(&TLSConfig{Pins: []string{"sha256/" + CertificatePin(other.Leaf)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := []*x509.Certificate{leaf.Leaf, other.Leaf}
+	if err := v.verifyPins("cdn.discordapp.com", peer, nil); err != nil {
+		t.Errorf("unpinned hosts shouldn't be checked: %v", err)
+	}
+	if err := v.verifyPins("gateway.discord.com", peer, [][]*x509.Certificate{{leaf.Leaf, ca.Leaf}}); err == nil {
+		t.Error("expected error with a pin outside the verified chain")
+	}
+
+	if _, err := newVerifier(&TLSConfig{Pins: []string{"invalid"}}); err == nil {
+		t.Error("expected error with invalid pin")
+	}
+}
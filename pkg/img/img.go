@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
@@ -145,3 +146,32 @@ func Resize(div int, path, output string) error {
 	}
 	return nil
 }
+
+// Verify checks that the image file can be fully decoded.
+func Verify(path string) error {
+	ext := filepath.Ext(path)
+	var decode func(io.Reader) (image.Image, error)
+	switch ext {
+	case ".png":
+		decode = png.Decode
+	case ".jpg", ".jpeg":
+		decode = jpeg.Decode
+	case ".webp":
+		decode = webp.Decode
+	case ".gif":
+		decode = gif.Decode
+	default:
+		return fmt.Errorf("img: unsupported extension: %s", ext)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("img: couldn't open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := decode(f); err != nil {
+		return fmt.Errorf("img: couldn't decode image %s: %w", path, err)
+	}
+	return nil
+}
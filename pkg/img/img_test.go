@@ -2,6 +2,7 @@ package img
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -45,3 +46,26 @@ func TestResize(t *testing.T) {
 	}
 
 }
+
+func TestVerify(t *testing.T) {
+	for _, tt := range []string{"testdata/test.webp", "testdata/test.jpg"} {
+		t.Run(tt, func(t *testing.T) {
+			if err := Verify(tt); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+		})
+	}
+
+	// Truncated image
+	data, err := os.ReadFile("testdata/test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(t.TempDir(), "truncated.jpg")
+	if err := os.WriteFile(truncated, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(truncated); err == nil {
+		t.Error("Verify() expected error for truncated image")
+	}
+}
@@ -16,6 +16,12 @@ type FPJA3 struct {
 	Digest string `json:"digest"`
 }
 
+// FPAkamai is the HTTP2 fingerprint in Akamai format.
+type FPAkamai struct {
+	Fingerprint string `json:"akamai_fingerprint"`
+	Digest      string `json:"akamai_fingerprint_hash"`
+}
+
 type InfoHTTP2 struct {
 	Headers map[string][]string `json:"headers"`
 }
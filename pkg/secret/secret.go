@@ -0,0 +1,294 @@
+// Package secret encrypts session files with a passphrase, so tokens and
+// cookies aren't stored in plain text.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// KeyEnv is the environment variable with the passphrase.
+	KeyEnv = "BULKAI_SESSION_KEY"
+	// KeyFileEnv is the environment variable with the path of a file that
+	// contains the passphrase.
+	KeyFileEnv = "BULKAI_SESSION_KEY_FILE"
+)
+
+const (
+	version   = "v1"
+	algorithm = "aes-256-gcm"
+	kdf       = "scrypt"
+)
+
+// ErrNoKey is returned when an encrypted file is read and no key is set.
+var ErrNoKey = fmt.Errorf("secret: file is encrypted, set the passphrase in %s or %s", KeyEnv, KeyFileEnv)
+
+// envelope is the format of encrypted files.
+// It is YAML, so encrypted files can still be identified and edited by
+// tools that expect a session file.
+type envelope struct {
+	Encrypted string `yaml:"encrypted"`
+	Algorithm string `yaml:"algorithm"`
+	KDF       string `yaml:"kdf"`
+	N         int    `yaml:"n"`
+	R         int    `yaml:"r"`
+	P         int    `yaml:"p"`
+	Salt      string `yaml:"salt"`
+	Nonce     string `yaml:"nonce"`
+	Data      string `yaml:"data"`
+}
+
+// Key returns the passphrase from the environment, empty if it isn't set.
+func Key() (string, error) {
+	if key := os.Getenv(KeyEnv); key != "" {
+		return key, nil
+	}
+	file := os.Getenv(KeyFileEnv)
+	if file == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("secret: couldn't read key file: %w", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("secret: key file %s is empty", file)
+	}
+	return key, nil
+}
+
+// IsEncrypted returns whether the data is an encrypted file.
+func IsEncrypted(data []byte) bool {
+	var e envelope
+	if err := yaml.Unmarshal(data, &e); err != nil {
+		return false
+	}
+	return e.Encrypted != "" && e.Data != ""
+}
+
+// Encrypt encrypts the data with a key derived from the passphrase.
+func Encrypt(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("secret: empty passphrase")
+	}
+	e := envelope{
+		Encrypted: version,
+		Algorithm: algorithm,
+		KDF:       kdf,
+		N:         1 << 15,
+		R:         8,
+		P:         1,
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("secret: couldn't generate salt: %w", err)
+	}
+	aead, err := newAEAD(passphrase, salt, e.N, e.R, e.P)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("secret: couldn't generate nonce: %w", err)
+	}
+	e.Salt = base64.StdEncoding.EncodeToString(salt)
+	e.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	e.Data = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, data, []byte(version)))
+	out, err := yaml.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't marshal envelope: %w", err)
+	}
+	return out, nil
+}
+
+// Decrypt decrypts data encrypted with the passphrase.
+func Decrypt(data []byte, passphrase string) ([]byte, error) {
+	var e envelope
+	if err := yaml.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("secret: couldn't unmarshal envelope: %w", err)
+	}
+	if e.Encrypted != version || e.Algorithm != algorithm || e.KDF != kdf {
+		return nil, fmt.Errorf("secret: unsupported format %s (%s, %s)", e.Encrypted, e.Algorithm, e.KDF)
+	}
+	if e.N < 1<<14 || e.N > 1<<20 || e.R < 1 || e.R > 32 || e.P < 1 || e.P > 16 {
+		return nil, fmt.Errorf("secret: unsupported scrypt parameters n=%d r=%d p=%d", e.N, e.R, e.P)
+	}
+	salt, err := base64.StdEncoding.DecodeString(e.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't decode salt: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't decode nonce: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(e.Data)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't decode data: %w", err)
+	}
+	aead, err := newAEAD(passphrase, salt, e.N, e.R, e.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("secret: invalid nonce size")
+	}
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(e.Encrypted))
+	if err != nil {
+		return nil, errors.New("secret: couldn't decrypt, the passphrase is wrong or the file is corrupted")
+	}
+	return plain, nil
+}
+
+func newAEAD(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("secret: couldn't create gcm: %w", err)
+	}
+	return aead, nil
+}
+
+// Open returns the plain content of data, decrypting it with the key from
+// the environment if it's encrypted.
+func Open(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	key, err := Key()
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, ErrNoKey
+	}
+	return Decrypt(data, key)
+}
+
+// ReadFile reads a file, decrypting it if it's encrypted.
+func ReadFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Open(data)
+}
+
+// WriteFile writes data to a file that only the owner can read.
+// Existing files keep their format, they are encrypted only if they already
+// were. New files are encrypted if a key is set in the environment.
+// Use EncryptFile and DecryptFile to change the format of a file.
+func WriteFile(name string, data []byte) error {
+	current, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	exists := err == nil
+	if exists && !IsEncrypted(current) {
+		return writeFile(name, data)
+	}
+	key, err := Key()
+	if err != nil {
+		return err
+	}
+	if key == "" && exists {
+		return ErrNoKey
+	}
+	if key != "" {
+		if data, err = Encrypt(data, key); err != nil {
+			return err
+		}
+	}
+	return writeFile(name, data)
+}
+
+// writeFile writes the file with 0600 permissions.
+// The data is written to a temporary file in the same directory which is
+// then renamed, so readers never see a partially written file.
+func writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// EncryptFile encrypts the input file with the key from the environment
+// and writes it to output, which can be the same file.
+func EncryptFile(input, output string) error {
+	key, err := Key()
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("secret: set the passphrase in %s or %s", KeyEnv, KeyFileEnv)
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("secret: couldn't read %s: %w", input, err)
+	}
+	if IsEncrypted(data) {
+		return fmt.Errorf("secret: %s is already encrypted", input)
+	}
+	enc, err := Encrypt(data, key)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(output, enc); err != nil {
+		return fmt.Errorf("secret: couldn't write %s: %w", output, err)
+	}
+	return nil
+}
+
+// DecryptFile decrypts the input file with the key from the environment and
+// writes it to output, which can be the same file.
+func DecryptFile(input, output string) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("secret: couldn't read %s: %w", input, err)
+	}
+	if !IsEncrypted(data) {
+		return fmt.Errorf("secret: %s isn't encrypted", input)
+	}
+	plain, err := Open(data)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(output, plain); err != nil {
+		return fmt.Errorf("secret: couldn't write %s: %w", output, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	plain := []byte("token: abc\ncookie: def\n")
+	enc, err := Encrypt(plain, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(enc) {
+		t.Error("encrypted data not detected")
+	}
+	if IsEncrypted(plain) {
+		t.Error("plain data detected as encrypted")
+	}
+	got, err := Decrypt(enc, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(plain) {
+		t.Errorf("Decrypt() = %q; want %q", got, plain)
+	}
+	if _, err := Decrypt(enc, "wrong"); err == nil {
+		t.Error("expected error with wrong passphrase")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session.yaml")
+	if err := os.WriteFile(file, []byte("token: old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("passphrase\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(KeyEnv, "")
+	t.Setenv(KeyFileEnv, keyFile)
+
+	// Plain files aren't encrypted on updates, even if the key is set
+	if err := WriteFile(file, []byte("token: new\n")); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "token: new\n" {
+		t.Errorf("plain file changed its format: %q", raw)
+	}
+
+	// New files are encrypted if the key is set
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(file, []byte("token: new\n")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions %v", info.Mode().Perm())
+	}
+	raw, err = os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(raw) {
+		t.Error("file isn't encrypted")
+	}
+
+	// Encrypted files stay encrypted on updates
+	if err := WriteFile(file, []byte("token: newer\n")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "token: newer\n" {
+		t.Errorf("ReadFile() = %q", got)
+	}
+
+	// Without key the file can't be read
+	t.Setenv(KeyFileEnv, "")
+	if _, err := ReadFile(file); err != ErrNoKey {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+	// Nor can it be written in plain text
+	if err := WriteFile(file, []byte("token: plain\n")); err != ErrNoKey {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/discord"
+	"github.com/igolaizola/bulkai/pkg/secret"
+	"gopkg.in/yaml.v2"
+)
+
+// profileExt is the extension of profile files.
+const profileExt = ".yaml"
+
+// defaultFile is the file in the profile directory with the name of the
+// default profile.
+const defaultFile = "default"
+
+var (
+	nameRegex   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	backupRegex = regexp.MustCompile(`^(.+)_\d{14}$`)
+)
+
+// ErrProfileNotFound is returned when a profile doesn't exist.
+var ErrProfileNotFound = errors.New("session: profile not found")
+
+// Profiles manages named sessions stored in a directory.
+// Each profile is a session file named after the profile.
+type Profiles struct {
+	dir string
+}
+
+// DefaultDir returns the default directory of profiles.
+func DefaultDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "sessions"
+	}
+	return filepath.Join(dir, "bulkai", "sessions")
+}
+
+// NewProfiles creates a profile manager for the directory.
+func NewProfiles(dir string) *Profiles {
+	return &Profiles{dir: dir}
+}
+
+// Info describes a profile.
+type Info struct {
+	Name string
+	Path string
+	// UserID is decoded from the token, empty if the session is encrypted
+	// and there is no key.
+	UserID    string
+	Encrypted bool
+	Default   bool
+	// Created is the creation date, or the modification date of the file if
+	// the session doesn't have one.
+	Created time.Time
+	// LastUsed is the last time the rotated cookies of the session were saved.
+	LastUsed time.Time
+	// Backups are the files left by previous versions of the session.
+	Backups []string
+	// Err is the error reading the session, if any.
+	Err error
+}
+
+// Path returns the session file of a profile.
+func (p *Profiles) Path(name string) (string, error) {
+	if !nameRegex.MatchString(name) || backupRegex.MatchString(name) {
+		return "", fmt.Errorf("session: invalid profile name %q", name)
+	}
+	return filepath.Join(p.dir, name+profileExt), nil
+}
+
+// Create creates the profile directory and returns the session file of a
+// profile, which may not exist yet.
+func (p *Profiles) Create(name string) (string, error) {
+	path, err := p.Path(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return "", fmt.Errorf("session: couldn't create profile directory: %w", err)
+	}
+	return path, nil
+}
+
+// Lookup returns the session file of an existing profile.
+func (p *Profiles) Lookup(name string) (string, error) {
+	path, err := p.Path(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrProfileNotFound, name)
+	}
+	return path, nil
+}
+
+// List returns the profiles sorted by name.
+func (p *Profiles) List() ([]*Info, error) {
+	entries, err := os.ReadDir(p.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session: couldn't read profile directory: %w", err)
+	}
+	def, err := p.Default()
+	if err != nil {
+		return nil, err
+	}
+	infos := map[string]*Info{}
+	backups := map[string][]string{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), profileExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if m := backupRegex.FindStringSubmatch(name); m != nil {
+			backups[m[1]] = append(backups[m[1]], filepath.Join(p.dir, e.Name()))
+			continue
+		}
+		if !nameRegex.MatchString(name) {
+			continue
+		}
+		infos[name] = p.info(name, filepath.Join(p.dir, e.Name()), def)
+	}
+	var list []*Info
+	for name, info := range infos {
+		info.Backups = backups[name]
+		sort.Strings(info.Backups)
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Info returns the information of a profile.
+func (p *Profiles) Info(name string) (*Info, error) {
+	list, err := p.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range list {
+		if info.Name == name {
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrProfileNotFound, name)
+}
+
+func (p *Profiles) info(name, path, def string) *Info {
+	info := &Info{
+		Name:    name,
+		Path:    path,
+		Default: name == def,
+	}
+	if fi, err := os.Stat(path); err == nil {
+		info.Created = fi.ModTime()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	info.Encrypted = secret.IsEncrypted(data)
+	if data, err = secret.Open(data); err != nil {
+		info.Err = err
+		return info
+	}
+	var values struct {
+		Token    string `yaml:"token"`
+		Created  string `yaml:"created"`
+		LastUsed string `yaml:"last-used"`
+	}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		info.Err = err
+		return info
+	}
+	if t, err := time.Parse(time.RFC3339, values.Created); err == nil {
+		info.Created = t
+	}
+	if t, err := time.Parse(time.RFC3339, values.LastUsed); err == nil {
+		info.LastUsed = t
+	}
+	if info.UserID, err = discord.TokenUserID(values.Token); err != nil {
+		info.Err = err
+	}
+	return info
+}
+
+// Remove deletes a profile and its backups.
+func (p *Profiles) Remove(name string) error {
+	info, err := p.Info(name)
+	if err != nil {
+		return err
+	}
+	for _, f := range append([]string{info.Path}, info.Backups...) {
+		if err := os.Remove(f); err != nil {
+			return fmt.Errorf("session: couldn't remove %s: %w", f, err)
+		}
+	}
+	if info.Default {
+		if err := os.Remove(filepath.Join(p.dir, defaultFile)); err != nil {
+			return fmt.Errorf("session: couldn't unset default profile: %w", err)
+		}
+	}
+	return nil
+}
+
+// Rename renames a profile and its backups.
+func (p *Profiles) Rename(name, newName string) error {
+	info, err := p.Info(name)
+	if err != nil {
+		return err
+	}
+	path, err := p.Path(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("session: profile %s already exists", newName)
+	}
+	if err := os.Rename(info.Path, path); err != nil {
+		return fmt.Errorf("session: couldn't rename %s: %w", name, err)
+	}
+	for _, b := range info.Backups {
+		suffix := strings.TrimPrefix(filepath.Base(b), name)
+		if err := os.Rename(b, filepath.Join(p.dir, newName+suffix)); err != nil {
+			return fmt.Errorf("session: couldn't rename %s: %w", b, err)
+		}
+	}
+	if info.Default {
+		return p.SetDefault(newName)
+	}
+	return nil
+}
+
+// Default returns the name of the default profile, empty if there is none.
+func (p *Profiles) Default() (string, error) {
+	data, err := os.ReadFile(filepath.Join(p.dir, defaultFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("session: couldn't read default profile: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SetDefault sets the default profile.
+func (p *Profiles) SetDefault(name string) error {
+	if _, err := p.Lookup(name); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(p.dir, defaultFile), []byte(name+"\n"), 0600); err != nil {
+		return fmt.Errorf("session: couldn't set default profile: %w", err)
+	}
+	return nil
+}
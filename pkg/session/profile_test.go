@@ -0,0 +1,95 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/igolaizola/bulkai/pkg/secret"
+)
+
+func TestProfiles(t *testing.T) {
+	t.Setenv(secret.KeyEnv, "")
+	t.Setenv(secret.KeyFileEnv, "")
+	profiles := NewProfiles(filepath.Join(t.TempDir(), "sessions"))
+
+	if list, err := profiles.List(); err != nil || len(list) != 0 {
+		t.Fatalf("expected no profiles, got %v %v", list, err)
+	}
+	if _, err := profiles.Create("../evil"); err == nil {
+		t.Error("expected error with invalid name")
+	}
+
+	// Create two profiles, the first one with a backup
+	for _, name := range []string{"work", "work", "home"} {
+		path, err := profiles.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := NewStore(path)
+		if _, err := store.Backup(); err != nil {
+			t.Fatal(err)
+		}
+		// The user id is the base64 encoded first part of the token
+		if err := store.Create([]byte("token: MTIzNDU2.abc.def\ncookie: a=1\n")); err != nil {
+			t.Fatal(err)
+		}
+		if name == "home" {
+			if err := store.SaveCookie("a=2"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := profiles.SetDefault("work"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := profiles.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "home" || list[1].Name != "work" {
+		t.Fatalf("unexpected profiles %+v", list)
+	}
+	home, work := list[0], list[1]
+	if home.UserID != "123456" || home.Created.IsZero() || home.LastUsed.IsZero() || home.Default || len(home.Backups) != 0 {
+		t.Errorf("unexpected home profile %+v", home)
+	}
+	if !work.LastUsed.IsZero() || !work.Default || len(work.Backups) != 1 {
+		t.Errorf("unexpected work profile %+v", work)
+	}
+
+	// Rename keeps backups and the default profile
+	if err := profiles.Rename("work", "job"); err != nil {
+		t.Fatal(err)
+	}
+	if err := profiles.Rename("job", "home"); err == nil {
+		t.Error("expected error renaming to an existing profile")
+	}
+	job, err := profiles.Info("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.Default || len(job.Backups) != 1 {
+		t.Errorf("unexpected job profile %+v", job)
+	}
+
+	// Remove deletes backups and unsets the default profile
+	if err := profiles.Remove("job"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := profiles.Lookup("job"); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("expected ErrProfileNotFound, got %v", err)
+	}
+	if def, err := profiles.Default(); err != nil || def != "" {
+		t.Errorf("unexpected default profile %q %v", def, err)
+	}
+	entries, err := os.ReadDir(profiles.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
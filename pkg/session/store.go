@@ -0,0 +1,320 @@
+// Package session loads and saves session files and manages named profiles.
+// Writes are atomic and serialized across processes with a lock file, so
+// concurrent runs with the same session don't clobber each other's cookies.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/secret"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// lockTimeout is the maximum time to wait for the lock of a session.
+	lockTimeout = 10 * time.Second
+	// lockStale is the age of a lock file to consider it abandoned.
+	// The lock is only held while the file is written.
+	lockStale = 30 * time.Second
+)
+
+// Metadata keys of session files, they aren't parameters of the session.
+const (
+	CreatedKey  = "created"
+	LastUsedKey = "last-used"
+)
+
+// IsMetadata returns whether a key of a session file is metadata.
+func IsMetadata(key string) bool {
+	return key == CreatedKey || key == LastUsedKey
+}
+
+// Store loads and saves a session file.
+type Store struct {
+	path string
+	lck  sync.Mutex
+}
+
+// NewStore creates a store for the session file.
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Path returns the path of the session file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Load returns the content of the session file, decrypting it if needed.
+// The error wraps os.ErrNotExist if the file doesn't exist.
+func (s *Store) Load() ([]byte, error) {
+	data, err := secret.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("session: couldn't load %s: %w", s.path, err)
+	}
+	return data, nil
+}
+
+// Save replaces the content of the session file.
+func (s *Store) Save(data []byte) error {
+	return s.Update(func([]byte) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// Update replaces the content of the session file with the result of fn,
+// which receives the current content or nil if the file doesn't exist.
+// The file is locked until it's written.
+func (s *Store) Update(fn func(data []byte) ([]byte, error)) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	unlock, err := lock(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := secret.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("session: couldn't read %s: %w", s.path, err)
+	}
+	data, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if err := secret.WriteFile(s.path, data); err != nil {
+		return fmt.Errorf("session: couldn't write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// Backup renames the session file adding a timestamp to its name and returns
+// the name of the backup, or an empty string if the file doesn't exist.
+func (s *Store) Backup() (string, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if _, err := os.Stat(s.path); err != nil {
+		return "", nil
+	}
+	unlock, err := lock(s.path)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	ext := filepath.Ext(s.path)
+	backup := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(s.path, ext), time.Now().Format("20060102150405"), ext)
+	if err := os.Rename(s.path, backup); err != nil {
+		return "", fmt.Errorf("session: couldn't backup %s: %w", s.path, err)
+	}
+	if err := os.Chmod(backup, 0600); err != nil {
+		return "", fmt.Errorf("session: couldn't change backup permissions: %w", err)
+	}
+	return backup, nil
+}
+
+// Create saves a new session setting its creation date.
+func (s *Store) Create(data []byte) error {
+	data, err := setValue(data, CreatedKey, func(string) string {
+		return time.Now().UTC().Format(time.RFC3339)
+	})
+	if err != nil {
+		return fmt.Errorf("session: couldn't set creation date of %s: %w", s.path, err)
+	}
+	return s.Save(data)
+}
+
+// SaveCookie updates the cookie of the session file and the date of its
+// last use.
+// Cookies are merged with the ones in the file, so cookies rotated by other
+// processes aren't lost.
+// The file is only written when discord rotates the cookies, so the last use
+// is the last time the session was used long enough to rotate them.
+func (s *Store) SaveCookie(cookie string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return s.Update(func(data []byte) ([]byte, error) {
+		if data == nil {
+			return nil, fmt.Errorf("session: %s doesn't exist", s.path)
+		}
+		data, err := setValue(data, "cookie", func(stored string) string {
+			return MergeCookies(stored, cookie)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("session: couldn't update %s: %w", s.path, err)
+		}
+		data, err = setValue(data, LastUsedKey, func(string) string {
+			return now
+		})
+		if err != nil {
+			return nil, fmt.Errorf("session: couldn't update %s: %w", s.path, err)
+		}
+		return data, nil
+	})
+}
+
+// setValue replaces a value of the yaml data keeping the order of the keys.
+// The key is appended if it doesn't exist.
+func setValue(data []byte, key string, fn func(string) string) ([]byte, error) {
+	var values yaml.MapSlice
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	var found bool
+	for i, item := range values {
+		if item.Key != key {
+			continue
+		}
+		current, _ := item.Value.(string)
+		values[i].Value = fn(current)
+		found = true
+	}
+	if !found {
+		values = append(values, yaml.MapItem{Key: key, Value: fn("")})
+	}
+	return yaml.Marshal(values)
+}
+
+// Checkpoint saves the cookies returned by get every interval while the
+// context is alive, only if they changed.
+// The returned function stops the checkpoints and saves the cookies one last
+// time.
+func (s *Store) Checkpoint(ctx context.Context, interval time.Duration, get func() (string, error)) func() {
+	last, err := get()
+	if err != nil {
+		log.Printf("session: couldn't get cookies: %v\n", err)
+	}
+	save := func() {
+		cookie, err := get()
+		if err != nil {
+			log.Printf("session: couldn't get cookies: %v\n", err)
+			return
+		}
+		if SameCookies(cookie, last) {
+			return
+		}
+		if err := s.SaveCookie(cookie); err != nil {
+			log.Println(err)
+			return
+		}
+		last = cookie
+	}
+
+	var lck sync.Mutex
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				lck.Lock()
+				save()
+				lck.Unlock()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			lck.Lock()
+			defer lck.Unlock()
+			save()
+		})
+	}
+}
+
+// lock creates a lock file next to the session file, waiting for other
+// processes to release it.
+// Lock files older than lockStale are considered abandoned and removed.
+func lock(path string) (func(), error) {
+	name := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			_ = f.Close()
+			return func() { _ = os.Remove(name) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("session: couldn't create lock %s: %w", name, err)
+		}
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > lockStale {
+			log.Printf("session: removing stale lock %s\n", name)
+			_ = os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("session: %s is locked by another process, remove %s if it isn't running", path, name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// MergeCookies returns the stored cookies updated with the given ones.
+// The order of the stored cookies is kept and new cookies are appended.
+func MergeCookies(stored, updated string) string {
+	names, values := parseCookies(stored)
+	newNames, newValues := parseCookies(updated)
+	for _, name := range newNames {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = newValues[name]
+	}
+	var cookies []string
+	for _, name := range names {
+		cookies = append(cookies, name+"="+values[name])
+	}
+	return strings.Join(cookies, "; ")
+}
+
+// SameCookies returns whether both strings contain the same cookies,
+// regardless of their order.
+func SameCookies(a, b string) bool {
+	_, av := parseCookies(a)
+	_, bv := parseCookies(b)
+	if len(av) != len(bv) {
+		return false
+	}
+	for k, v := range av {
+		if w, ok := bv[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCookies(raw string) ([]string, map[string]string) {
+	var names []string
+	values := map[string]string{}
+	for _, cookie := range strings.Split(raw, ";") {
+		cookie = strings.TrimSpace(cookie)
+		name, value, ok := strings.Cut(cookie, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+	return names, values
+}
@@ -0,0 +1,186 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/igolaizola/bulkai/pkg/secret"
+)
+
+func TestMergeCookies(t *testing.T) {
+	tests := []struct {
+		stored  string
+		updated string
+		want    string
+	}{
+		{"a=1; b=2", "b=3", "a=1; b=3"},
+		{"a=1", "c=3; a=2", "a=2; c=3"},
+		{"", "a=1", "a=1"},
+		{"a=1; b=2", "", "a=1; b=2"},
+	}
+	for _, tt := range tests {
+		if got := MergeCookies(tt.stored, tt.updated); got != tt.want {
+			t.Errorf("MergeCookies(%q, %q) = %q; want %q", tt.stored, tt.updated, got, tt.want)
+		}
+	}
+	if !SameCookies("a=1; b=2", "b=2; a=1") {
+		t.Error("expected same cookies")
+	}
+	if SameCookies("a=1; b=2", "a=1; b=3") {
+		t.Error("expected different cookies")
+	}
+}
+
+func TestSaveCookie(t *testing.T) {
+	t.Setenv(secret.KeyEnv, "")
+	t.Setenv(secret.KeyFileEnv, "")
+	file := filepath.Join(t.TempDir(), "session.yaml")
+	if err := os.WriteFile(file, []byte("ja3: foo\ntoken: bar\ncookie: a=1; b=2\nhttp2: baz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(file)
+	if err := store.SaveCookie("b=3; c=4"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last use is appended after the existing keys
+	want := "ja3: foo\ntoken: bar\ncookie: a=1; b=3; c=4\nhttp2: baz\nlast-used: "
+	if !strings.HasPrefix(string(data), want) {
+		t.Errorf("unexpected session:\n%s\nwant:\n%s", data, want)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(file + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed: %v", err)
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	t.Setenv(secret.KeyEnv, "")
+	t.Setenv(secret.KeyFileEnv, "")
+	file := filepath.Join(t.TempDir(), "session.yaml")
+
+	// Different stores simulate different processes
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := NewStore(file).Update(func(data []byte) ([]byte, error) {
+				n, _ := strconv.Atoi(string(data))
+				return []byte(strconv.Itoa(n + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := NewStore(file).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "10" {
+		t.Errorf("lost updates: got %s; want 10", data)
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	t.Setenv(secret.KeyEnv, "")
+	t.Setenv(secret.KeyFileEnv, "")
+	file := filepath.Join(t.TempDir(), "session.yaml")
+	lock := file + ".lock"
+	if err := os.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * lockStale)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewStore(file).Save([]byte("token: foo\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	t.Setenv(secret.KeyEnv, "")
+	t.Setenv(secret.KeyFileEnv, "")
+	file := filepath.Join(t.TempDir(), "session.yaml")
+	if err := os.WriteFile(file, []byte("token: foo\ncookie: a=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(file)
+
+	var lck sync.Mutex
+	cookie := "a=1"
+	get := func() (string, error) {
+		lck.Lock()
+		defer lck.Unlock()
+		return cookie, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := store.Checkpoint(ctx, 10*time.Millisecond, get)
+
+	lck.Lock()
+	cookie = "a=2"
+	lck.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(data), "token: foo\ncookie: a=2\nlast-used: ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cookie not checkpointed: %s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lck.Lock()
+	cookie = "a=3"
+	lck.Unlock()
+	stop()
+	stop()
+	data, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "token: foo\ncookie: a=3\nlast-used: ") {
+		t.Errorf("cookie not saved on stop: %s", data)
+	}
+
+	// The file isn't written if the cookies didn't change
+	before, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop = store.Checkpoint(ctx, 10*time.Millisecond, get)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	after, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || !after.ModTime().Equal(before.ModTime()) {
+		t.Error("session written without cookie changes")
+	}
+}